@@ -0,0 +1,78 @@
+package kvstore
+
+import "time"
+
+// Entry is a key-value pair written by a batch set.
+// A TTL of zero or less means the key does not expire. A non-zero ExpiresAt sets an absolute expiry instead.
+type Entry struct {
+	Key       string
+	Value     string
+	TTL       time.Duration
+	ExpiresAt time.Time
+}
+
+// expiry returns the absolute expiry of an entry written at now, or zero for none.
+func (e Entry) expiry(now time.Time) time.Time {
+	return expiryOf(e.TTL, e.ExpiresAt, now)
+}
+
+// expiryOf returns expiresAt if it is set, otherwise now plus a positive ttl, or zero for no expiry.
+func expiryOf(ttl time.Duration, expiresAt, now time.Time) time.Time {
+	if !expiresAt.IsZero() {
+		return expiresAt
+	}
+	if ttl > 0 {
+		return now.Add(ttl)
+	}
+	return time.Time{}
+}
+
+// Result is the outcome of looking up one key in a batch get.
+// Found is false if the key does not exist or has expired.
+type Result struct {
+	Value   string
+	Version uint64
+	Found   bool
+}
+
+// MSet stores every entry under a single lock acquisition, replacing any existing values and TTLs.
+// Later entries for the same key override earlier ones. Limits are enforced once the whole batch is stored.
+func (kv *KVStore) MSet(entries []Entry) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := kv.now()
+	for _, e := range entries {
+		kv.setLocked(e.Key, e.Value, e.expiry(now), 0)
+	}
+	kv.evictLocked()
+}
+
+// MGet looks up every key under a single lock acquisition.
+// The results are in the same order as keys.
+func (kv *KVStore) MGet(keys []string) []Result {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	now := kv.now()
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		it, ok := kv.getLocked(key, now)
+		results[i] = Result{Value: it.value, Version: it.version, Found: ok}
+	}
+	return results
+}
+
+// MDelete removes every key under a single lock acquisition.
+// Each result reports whether the corresponding key was found and deleted, as with Delete.
+func (kv *KVStore) MDelete(keys []string) []bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := kv.now()
+	deleted := make([]bool, len(keys))
+	for i, key := range keys {
+		deleted[i] = kv.deleteLocked(key, now)
+	}
+	return deleted
+}
@@ -0,0 +1,89 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testBatch exercises the batch methods of a Storage backend.
+func testBatch(t *testing.T, store Storage) {
+	t.Helper()
+
+	store.MSet([]Entry{
+		{Key: "a", Value: "1"},
+		{Key: "b", Value: "2", TTL: time.Hour},
+		{Key: "c", Value: "3"},
+		{Key: "a", Value: "4"},
+	})
+
+	results := store.MGet([]string{"a", "missing", "b", "c"})
+	want := []Result{{Value: "4", Found: true}, {}, {Value: "2", Found: true}, {Value: "3", Found: true}}
+	if len(results) != len(want) {
+		t.Fatalf("expected %d results, got %d", len(want), len(results))
+	}
+	for i := range want {
+		if results[i].Value != want[i].Value || results[i].Found != want[i].Found {
+			t.Fatalf("result %d: expected %+v, got %+v", i, want[i], results[i])
+		}
+	}
+
+	deleted := store.MDelete([]string{"a", "missing", "c", "a"})
+	if !deleted[0] || deleted[1] || !deleted[2] || deleted[3] {
+		t.Fatalf("unexpected delete results: %v", deleted)
+	}
+	if val, ok := store.Get("b"); !ok || val != "2" {
+		t.Fatalf("expected untouched key to remain, got found=%v val=%q", ok, val)
+	}
+}
+
+func TestKVStore_Batch(t *testing.T) {
+	store := New()
+	defer store.Close()
+	testBatch(t, store)
+}
+
+func TestShardedKVStore_Batch(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+	testBatch(t, store)
+}
+
+func TestKVStore_MSetEvictsOnce(t *testing.T) {
+	store := New(WithMaxEntries(2))
+	defer store.Close()
+
+	store.MSet([]Entry{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}, {Key: "c", Value: "3"}})
+	if stats := store.Stats(); stats.Keys != 2 || stats.Evicted != 1 {
+		t.Fatalf("unexpected stats after batch: %+v", stats)
+	}
+	if _, ok := store.Get("a"); ok {
+		t.Fatalf("expected least recently written key to be evicted")
+	}
+}
+
+func TestPersistentKVStore_Batch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	testBatch(t, store)
+
+	// Both batch writes reach the log with a single fsync each.
+	if store.syncCount != 2 {
+		t.Fatalf("expected one fsync per batch, got %d", store.syncCount)
+	}
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	defer store2.Close()
+	results := store2.MGet([]string{"a", "b", "c"})
+	if results[0].Found || !results[1].Found || results[2].Found {
+		t.Fatalf("unexpected results after recovery: %+v", results)
+	}
+}
@@ -0,0 +1,114 @@
+package kvstore
+
+import (
+	"io"
+	"time"
+)
+
+// BytesStorage is a byte-slice view of a key-value store, for values such as serialized protobufs
+// or compressed payloads that are not text. KVStore, PersistentKVStore, and ShardedKVStore implement it
+// directly. They keep values as Go strings, which hold arbitrary bytes and can be shared with readers
+// without locking because they are immutable; a value is copied once on the way in and once on the way
+// out, so callers may reuse or modify their slices freely.
+type BytesStorage interface {
+	// Close releases the backend's resources, stopping background work and flushing any buffered writes.
+	io.Closer
+
+	// SetBytes stores a copy of value under key without an expiry, like Set.
+	SetBytes(key string, value []byte)
+	// SetBytesWithTTL stores a copy of value under key, expiring after ttl if it is greater than zero,
+	// like SetWithTTL.
+	SetBytesWithTTL(key string, value []byte, ttl time.Duration)
+	// GetBytes returns a copy of the value of key, or nil and false if it does not exist or has expired.
+	GetBytes(key string) ([]byte, bool)
+	// Delete removes key, reporting whether it existed and had not expired.
+	Delete(key string) bool
+}
+
+// NewBytesStorage returns a BytesStorage backed by storage: storage itself if it implements BytesStorage,
+// or an adapter over its string methods otherwise. The string and byte-slice APIs can be mixed freely
+// on the same keys.
+func NewBytesStorage(storage Storage) BytesStorage {
+	if b, ok := storage.(BytesStorage); ok {
+		return b
+	}
+	return bytesAdapter{storage}
+}
+
+// SetBytes stores a copy of value under key without an expiration time.
+func (kv *KVStore) SetBytes(key string, value []byte) {
+	kv.Set(key, string(value))
+}
+
+// SetBytesWithTTL stores a copy of value under key, expiring after ttl if it is greater than zero.
+func (kv *KVStore) SetBytesWithTTL(key string, value []byte, ttl time.Duration) {
+	kv.SetWithTTL(key, string(value), ttl)
+}
+
+// GetBytes returns a copy of the value stored under key.
+// If the key does not exist or has expired, it returns nil and false.
+func (kv *KVStore) GetBytes(key string) ([]byte, bool) {
+	return bytesResult(kv.Get(key))
+}
+
+// SetBytes stores a copy of value under key without an expiration time and appends the operation to the log.
+func (p *PersistentKVStore) SetBytes(key string, value []byte) {
+	p.Set(key, string(value))
+}
+
+// SetBytesWithTTL stores a copy of value under key, expiring after ttl if it is greater than zero,
+// and appends the operation to the log.
+func (p *PersistentKVStore) SetBytesWithTTL(key string, value []byte, ttl time.Duration) {
+	p.SetWithTTL(key, string(value), ttl)
+}
+
+// GetBytes returns a copy of the value stored under key.
+// If the key does not exist or has expired, it returns nil and false.
+func (p *PersistentKVStore) GetBytes(key string) ([]byte, bool) {
+	return bytesResult(p.Get(key))
+}
+
+// SetBytes stores a copy of value under key in its shard without an expiration time.
+func (s *ShardedKVStore) SetBytes(key string, value []byte) {
+	s.Set(key, string(value))
+}
+
+// SetBytesWithTTL stores a copy of value under key in its shard, expiring after ttl if it is greater than zero.
+func (s *ShardedKVStore) SetBytesWithTTL(key string, value []byte, ttl time.Duration) {
+	s.SetWithTTL(key, string(value), ttl)
+}
+
+// GetBytes returns a copy of the value stored under key in its shard.
+// If the key does not exist or has expired, it returns nil and false.
+func (s *ShardedKVStore) GetBytes(key string) ([]byte, bool) {
+	return bytesResult(s.Get(key))
+}
+
+// bytesResult converts the result of a string lookup to a byte-slice one.
+func bytesResult(value string, ok bool) ([]byte, bool) {
+	if !ok {
+		return nil, false
+	}
+	return []byte(value), true
+}
+
+// bytesAdapter implements BytesStorage on top of the string methods of a Storage that does not implement it.
+type bytesAdapter struct {
+	Storage
+}
+
+// SetBytes stores a copy of value under key without an expiration time.
+func (a bytesAdapter) SetBytes(key string, value []byte) {
+	a.Set(key, string(value))
+}
+
+// SetBytesWithTTL stores a copy of value under key, expiring after ttl if it is greater than zero.
+func (a bytesAdapter) SetBytesWithTTL(key string, value []byte, ttl time.Duration) {
+	a.SetWithTTL(key, string(value), ttl)
+}
+
+// GetBytes returns a copy of the value stored under key.
+// If the key does not exist or has expired, it returns nil and false.
+func (a bytesAdapter) GetBytes(key string) ([]byte, bool) {
+	return bytesResult(a.Get(key))
+}
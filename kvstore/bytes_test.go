@@ -0,0 +1,102 @@
+package kvstore
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// binaryValue is not valid UTF-8 and contains NUL bytes and newlines.
+var binaryValue = []byte{0x00, 0xff, 0xfe, '\n', 0x80, 0x00, ' ', 0xc3}
+
+func TestBytesStorage_RoundTrip(t *testing.T) {
+	store := New()
+	defer store.Close()
+	b := NewBytesStorage(store)
+
+	value := append([]byte{}, binaryValue...)
+	b.SetBytes("blob", value)
+	value[0] = 'x' // the store keeps its own copy
+
+	got, ok := b.GetBytes("blob")
+	if !ok || !bytes.Equal(got, binaryValue) {
+		t.Fatalf("expected %v, got %v (found=%v)", binaryValue, got, ok)
+	}
+	got[1] = 'y' // and hands out copies
+	if again, _ := b.GetBytes("blob"); !bytes.Equal(again, binaryValue) {
+		t.Fatalf("expected returned slice to be a copy, got %v", again)
+	}
+
+	// The string API sees the same bytes.
+	if val, _ := store.Get("blob"); val != string(binaryValue) {
+		t.Fatalf("expected string API to return the same bytes, got %q", val)
+	}
+
+	if _, ok := b.GetBytes("missing"); ok {
+		t.Fatalf("expected missing key not to be found")
+	}
+	if !b.Delete("blob") {
+		t.Fatalf("expected delete to succeed")
+	}
+}
+
+func TestBytesStorage_Backends(t *testing.T) {
+	persistent, err := NewPersistentKVStore(filepath.Join(t.TempDir(), "kv.log"), false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for _, storage := range []Storage{New(), NewSharded(2), persistent} {
+		if _, ok := NewBytesStorage(storage).(bytesAdapter); ok {
+			t.Fatalf("expected %T to implement BytesStorage itself", storage)
+		}
+		storage.Close()
+	}
+
+	// Other backends get an adapter over their string methods.
+	b := NewBytesStorage(struct{ Storage }{New()})
+	defer b.Close()
+	b.SetBytes("blob", binaryValue)
+	if got, ok := b.GetBytes("blob"); !ok || !bytes.Equal(got, binaryValue) {
+		t.Fatalf("expected the adapter to round-trip %v, got %v", binaryValue, got)
+	}
+}
+
+func TestBytesStorage_TTL(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+	b := NewBytesStorage(store)
+
+	b.SetBytesWithTTL("blob", binaryValue, time.Minute)
+	clock.Advance(time.Minute)
+	if _, ok := b.GetBytes("blob"); ok {
+		t.Fatalf("expected value to expire")
+	}
+}
+
+func TestPersistentKVStore_BinaryValuesSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	NewBytesStorage(store).SetBytes("blob", binaryValue)
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	NewBytesStorage(store).SetBytes("tail", binaryValue)
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	defer store2.Close()
+	for _, key := range []string{"blob", "tail"} {
+		if got, _ := NewBytesStorage(store2).GetBytes(key); !bytes.Equal(got, binaryValue) {
+			t.Fatalf("expected %q to survive restart, got %v", key, got)
+		}
+	}
+}
@@ -0,0 +1,380 @@
+package kvstore
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrWrongType is returned by a hash, list, or set operation on a key that holds a different type of value.
+var ErrWrongType = errors.New("kvstore: operation against a key holding the wrong type of value")
+
+// ValueType identifies the type of value stored at a key.
+type ValueType int
+
+const (
+	// TypeString is a plain value, written by Set and read by Get.
+	TypeString ValueType = iota
+	// TypeHash is a map of fields to values.
+	TypeHash
+	// TypeList is an ordered list of elements.
+	TypeList
+	// TypeSet is an unordered set of unique members.
+	TypeSet
+)
+
+// Collections is implemented by storage backends that can hold hashes, lists, and sets as well as strings.
+// A collection is created by its first write and deleted once it becomes empty. Writing a collection
+// gives the key a new version, and Set, Delete, and the expiry methods work on keys of any type.
+// String reads of a collection see an empty value.
+type Collections interface {
+	// Type returns the type of the value stored at key, or false if the key does not exist.
+	Type(key string) (ValueType, bool)
+
+	// HSet sets fields of the hash at key and returns the number of fields that were added.
+	HSet(key string, fields map[string]string) (int, error)
+	// HGet returns the value of a field of the hash at key.
+	HGet(key, field string) (string, bool, error)
+	// HDel removes fields from the hash at key and returns the number that were removed.
+	HDel(key string, fields ...string) (int, error)
+	// HGetAll returns every field of the hash at key; it is empty if the key does not exist.
+	HGetAll(key string) (map[string]string, error)
+
+	// LPush inserts values at the head of the list at key, one after another, and returns the new length.
+	LPush(key string, values ...string) (int, error)
+	// RPush appends values to the tail of the list at key and returns the new length.
+	RPush(key string, values ...string) (int, error)
+	// LPop removes and returns up to count elements from the head of the list at key.
+	LPop(key string, count int) ([]string, error)
+	// LRange returns the elements of the list at key from start to stop inclusive. Negative
+	// indexes count from the end of the list, so -1 is the last element.
+	LRange(key string, start, stop int) ([]string, error)
+
+	// SAdd adds members to the set at key and returns the number that were not already present.
+	SAdd(key string, members ...string) (int, error)
+	// SRem removes members from the set at key and returns the number that were removed.
+	SRem(key string, members ...string) (int, error)
+	// SMembers returns the members of the set at key in ascending order.
+	SMembers(key string) ([]string, error)
+}
+
+// mutation is the outcome of a collection write.
+type mutation struct {
+	n       int      // fields or members added or removed, or the list's new length
+	popped  []string // elements removed by opLPop
+	version uint64   // the key's new version, or zero if nothing changed
+}
+
+// Type returns the type of the value stored at key, or false if the key does not exist or has expired.
+func (kv *KVStore) Type(key string) (ValueType, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, ok := kv.liveLocked(key, kv.now())
+	return it.kind, ok
+}
+
+// HSet sets fields of the hash at key, creating it if needed, and returns the number of fields that were added.
+func (kv *KVStore) HSet(key string, fields map[string]string) (int, error) {
+	m, err := kv.mutate(record{op: opHSet, key: key, fields: hashFields(fields)})
+	return m.n, err
+}
+
+// HGet returns the value of a field of the hash at key.
+func (kv *KVStore) HGet(key, field string) (string, bool, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, _, err := kv.collectionLocked(key, TypeHash)
+	value, ok := it.hash[field]
+	return value, ok, err
+}
+
+// HDel removes fields from the hash at key and returns the number that were removed.
+// The key is deleted once its last field is removed.
+func (kv *KVStore) HDel(key string, fields ...string) (int, error) {
+	m, err := kv.mutate(record{op: opHDel, key: key, fields: fields})
+	return m.n, err
+}
+
+// HGetAll returns a copy of every field of the hash at key; it is empty if the key does not exist.
+func (kv *KVStore) HGetAll(key string) (map[string]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, _, err := kv.collectionLocked(key, TypeHash)
+	fields := make(map[string]string, len(it.hash))
+	for field, value := range it.hash {
+		fields[field] = value
+	}
+	return fields, err
+}
+
+// LPush inserts values at the head of the list at key, creating it if needed, and returns the new length.
+// Values are inserted one after another, so the last one ends up first.
+func (kv *KVStore) LPush(key string, values ...string) (int, error) {
+	m, err := kv.mutate(record{op: opLPush, key: key, fields: values})
+	return m.n, err
+}
+
+// RPush appends values to the tail of the list at key, creating it if needed, and returns the new length.
+func (kv *KVStore) RPush(key string, values ...string) (int, error) {
+	m, err := kv.mutate(record{op: opRPush, key: key, fields: values})
+	return m.n, err
+}
+
+// LPop removes and returns up to count elements from the head of the list at key.
+// The key is deleted once its last element is removed.
+func (kv *KVStore) LPop(key string, count int) ([]string, error) {
+	m, err := kv.lpop(key, count)
+	return m.popped, err
+}
+
+// lpop removes up to count elements from the head of the list at key. It is logged as an opLPop
+// holding the removed elements, so that replay removes the same number.
+func (kv *KVStore) lpop(key string, count int) (mutation, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	it, _, err := kv.collectionLocked(key, TypeList)
+	if err != nil || count <= 0 {
+		return mutation{}, err
+	}
+	if count > len(it.list) {
+		count = len(it.list)
+	}
+	popped := append([]string(nil), it.list[:count]...)
+	return kv.mutateLocked(record{op: opLPop, key: key, fields: popped})
+}
+
+// LRange returns the elements of the list at key from start to stop inclusive.
+// Negative indexes count from the end of the list, so LRange(key, 0, -1) returns the whole list.
+func (kv *KVStore) LRange(key string, start, stop int) ([]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, _, err := kv.collectionLocked(key, TypeList)
+	if err != nil {
+		return nil, err
+	}
+	n := len(it.list)
+	if start < 0 {
+		start += n
+	}
+	if stop < 0 {
+		stop += n
+	}
+	if start < 0 {
+		start = 0
+	}
+	if stop >= n {
+		stop = n - 1
+	}
+	if start > stop {
+		return []string{}, nil
+	}
+	return append([]string{}, it.list[start:stop+1]...), nil
+}
+
+// SAdd adds members to the set at key, creating it if needed, and returns the number that were not
+// already present.
+func (kv *KVStore) SAdd(key string, members ...string) (int, error) {
+	m, err := kv.mutate(record{op: opSAdd, key: key, fields: members})
+	return m.n, err
+}
+
+// SRem removes members from the set at key and returns the number that were removed.
+// The key is deleted once its last member is removed.
+func (kv *KVStore) SRem(key string, members ...string) (int, error) {
+	m, err := kv.mutate(record{op: opSRem, key: key, fields: members})
+	return m.n, err
+}
+
+// SMembers returns the members of the set at key in ascending order.
+func (kv *KVStore) SMembers(key string) ([]string, error) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, _, err := kv.collectionLocked(key, TypeSet)
+	members := make([]string, 0, len(it.set))
+	for member := range it.set {
+		members = append(members, member)
+	}
+	sort.Strings(members)
+	return members, err
+}
+
+// collectionLocked looks up the live collection at key, failing with ErrWrongType if it holds another type.
+// A missing key returns an empty item and false. The caller must hold the read or write lock.
+func (kv *KVStore) collectionLocked(key string, kind ValueType) (item, bool, error) {
+	it, ok := kv.getLocked(key, kv.now())
+	if !ok {
+		return item{}, false, nil
+	}
+	if it.kind != kind {
+		return item{}, false, ErrWrongType
+	}
+	return it, true, nil
+}
+
+// mutate applies a collection write record under the write lock.
+func (kv *KVStore) mutate(rec record) (mutation, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	return kv.mutateLocked(rec)
+}
+
+// mutateLocked applies a collection write record, creating the collection if the key is missing and
+// deleting it once it is empty. A change gives the key the record's version, or the next version if
+// the record has none, and publishes a put event, or a delete event if the key was removed.
+// The caller must hold the write lock.
+func (kv *KVStore) mutateLocked(rec record) (mutation, error) {
+	kind := collectionType(rec.op)
+	it, found, err := kv.collectionLocked(rec.key, kind)
+	if err != nil {
+		return mutation{}, err
+	}
+	if !found {
+		it = item{kind: kind}
+	}
+
+	var m mutation
+	switch rec.op {
+	case opHSet:
+		if it.hash == nil {
+			it.hash = make(map[string]string, len(rec.fields)/2)
+		}
+		for i := 0; i+1 < len(rec.fields); i += 2 {
+			field, value := rec.fields[i], rec.fields[i+1]
+			if old, ok := it.hash[field]; ok {
+				it.elemBytes -= int64(len(field) + len(old))
+			} else {
+				m.n++
+			}
+			it.hash[field] = value
+			it.elemBytes += int64(len(field) + len(value))
+		}
+	case opHDel:
+		for _, field := range rec.fields {
+			if old, ok := it.hash[field]; ok {
+				delete(it.hash, field)
+				it.elemBytes -= int64(len(field) + len(old))
+				m.n++
+			}
+		}
+	case opLPush:
+		list := make([]string, 0, len(rec.fields)+len(it.list))
+		for i := len(rec.fields) - 1; i >= 0; i-- {
+			list = append(list, rec.fields[i])
+		}
+		it.list = append(list, it.list...)
+		it.elemBytes += stringsSize(rec.fields)
+		m.n = len(it.list)
+	case opRPush:
+		it.list = append(it.list, rec.fields...)
+		it.elemBytes += stringsSize(rec.fields)
+		m.n = len(it.list)
+	case opLPop:
+		count := len(rec.fields)
+		if count > len(it.list) {
+			count = len(it.list)
+		}
+		m.popped = rec.fields[:count]
+		it.elemBytes -= stringsSize(it.list[:count])
+		clear(it.list[:count]) // release the popped strings
+		it.list = it.list[count:]
+		m.n = count
+	case opSAdd:
+		if it.set == nil {
+			it.set = make(map[string]struct{}, len(rec.fields))
+		}
+		for _, member := range rec.fields {
+			if _, ok := it.set[member]; !ok {
+				it.set[member] = struct{}{}
+				it.elemBytes += int64(len(member))
+				m.n++
+			}
+		}
+	case opSRem:
+		for _, member := range rec.fields {
+			if _, ok := it.set[member]; ok {
+				delete(it.set, member)
+				it.elemBytes -= int64(len(member))
+				m.n++
+			}
+		}
+	}
+
+	// Additions change the key whenever they carry values; removals only if they removed something.
+	changed := m.n > 0
+	if rec.op == opHSet || rec.op == opLPush || rec.op == opRPush {
+		changed = len(rec.fields) > 0
+	}
+	if !changed {
+		return m, nil
+	}
+	if it.len() == 0 {
+		kv.removeLocked(rec.key)
+		kv.publishRemovalLocked(EventDelete, rec.key)
+		m.version = kv.version
+		return m, nil
+	}
+
+	m.version = rec.version
+	if m.version == 0 {
+		m.version = kv.version + 1
+	}
+	kv.observeVersionLocked(m.version)
+	it.version = m.version
+	kv.putLocked(rec.key, it)
+	kv.events.publish(Event{Type: EventPut, Key: rec.key, Revision: m.version})
+	kv.evictLocked()
+	return m, nil
+}
+
+// collectionType returns the type of collection a write record operates on.
+func collectionType(op byte) ValueType {
+	switch op {
+	case opHSet, opHDel:
+		return TypeHash
+	case opLPush, opRPush, opLPop:
+		return TypeList
+	}
+	return TypeSet
+}
+
+// len returns the number of fields, elements, or members in a collection item.
+func (it item) len() int {
+	switch it.kind {
+	case TypeHash:
+		return len(it.hash)
+	case TypeList:
+		return len(it.list)
+	case TypeSet:
+		return len(it.set)
+	}
+	return 0
+}
+
+// hashFields flattens fields into alternating field and value strings, ordered by field.
+func hashFields(fields map[string]string) []string {
+	names := make([]string, 0, len(fields))
+	for field := range fields {
+		names = append(names, field)
+	}
+	sort.Strings(names)
+	flat := make([]string, 0, 2*len(names))
+	for _, field := range names {
+		flat = append(flat, field, fields[field])
+	}
+	return flat
+}
+
+// stringsSize returns the total length of values.
+func stringsSize(values []string) int64 {
+	var n int64
+	for _, v := range values {
+		n += int64(len(v))
+	}
+	return n
+}
@@ -0,0 +1,236 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestKVStore_Hash(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	if n, err := store.HSet("user:1", map[string]string{"name": "alice", "age": "30"}); err != nil || n != 2 {
+		t.Fatalf("expected 2 new fields, got %d (err=%v)", n, err)
+	}
+	if n, _ := store.HSet("user:1", map[string]string{"age": "31", "city": "paris"}); n != 1 {
+		t.Fatalf("expected 1 new field, got %d", n)
+	}
+	if val, ok, err := store.HGet("user:1", "age"); err != nil || !ok || val != "31" {
+		t.Fatalf("expected age 31, got %q (found=%v, err=%v)", val, ok, err)
+	}
+	if _, ok, _ := store.HGet("user:1", "missing"); ok {
+		t.Fatalf("expected missing field not to be found")
+	}
+	if n, _ := store.HDel("user:1", "city", "missing"); n != 1 {
+		t.Fatalf("expected 1 field removed, got %d", n)
+	}
+	all, _ := store.HGetAll("user:1")
+	if want := map[string]string{"name": "alice", "age": "31"}; !reflect.DeepEqual(all, want) {
+		t.Fatalf("expected %v, got %v", want, all)
+	}
+	if typ, ok := store.Type("user:1"); !ok || typ != TypeHash {
+		t.Fatalf("expected TypeHash, got %v (found=%v)", typ, ok)
+	}
+
+	store.HDel("user:1", "name", "age")
+	if _, ok := store.Type("user:1"); ok {
+		t.Fatalf("expected the key to be deleted once its last field is removed")
+	}
+	if all, err := store.HGetAll("user:1"); err != nil || len(all) != 0 {
+		t.Fatalf("expected an empty hash for a missing key, got %v (err=%v)", all, err)
+	}
+}
+
+func TestKVStore_List(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	store.RPush("queue", "b", "c")
+	if n, err := store.LPush("queue", "a", "z"); err != nil || n != 4 {
+		t.Fatalf("expected length 4, got %d (err=%v)", n, err)
+	}
+	if got, _ := store.LRange("queue", 0, -1); !reflect.DeepEqual(got, []string{"z", "a", "b", "c"}) {
+		t.Fatalf("unexpected list %v", got)
+	}
+	if got, _ := store.LRange("queue", -2, 10); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("expected negative and out-of-range indexes to be clamped, got %v", got)
+	}
+	if got, _ := store.LRange("queue", 3, 1); len(got) != 0 {
+		t.Fatalf("expected an empty range, got %v", got)
+	}
+
+	if got, err := store.LPop("queue", 2); err != nil || !reflect.DeepEqual(got, []string{"z", "a"}) {
+		t.Fatalf("expected to pop [z a], got %v (err=%v)", got, err)
+	}
+	if got, _ := store.LPop("queue", 10); !reflect.DeepEqual(got, []string{"b", "c"}) {
+		t.Fatalf("expected to pop the rest, got %v", got)
+	}
+	if _, ok := store.Type("queue"); ok {
+		t.Fatalf("expected the key to be deleted once its last element is popped")
+	}
+	if got, err := store.LPop("queue", 1); err != nil || len(got) != 0 {
+		t.Fatalf("expected nothing to pop from a missing list, got %v (err=%v)", got, err)
+	}
+}
+
+func TestKVStore_Set(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	if n, err := store.SAdd("tags", "go", "db", "go"); err != nil || n != 2 {
+		t.Fatalf("expected 2 new members, got %d (err=%v)", n, err)
+	}
+	_, version, _ := store.GetWithVersion("tags")
+	if n, _ := store.SAdd("tags", "db"); n != 0 {
+		t.Fatalf("expected no new members, got %d", n)
+	}
+	if _, v, _ := store.GetWithVersion("tags"); v != version {
+		t.Fatalf("expected a write that changed nothing to keep version %d, got %d", version, v)
+	}
+	if got, _ := store.SMembers("tags"); !reflect.DeepEqual(got, []string{"db", "go"}) {
+		t.Fatalf("expected sorted members, got %v", got)
+	}
+	if n, _ := store.SRem("tags", "db", "kv"); n != 1 {
+		t.Fatalf("expected 1 member removed, got %d", n)
+	}
+	store.SRem("tags", "go")
+	if _, ok := store.Type("tags"); ok {
+		t.Fatalf("expected the key to be deleted once its last member is removed")
+	}
+}
+
+func TestKVStore_CollectionTypes(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	store.Set("str", "value")
+	store.SAdd("set", "a")
+
+	if _, err := store.HSet("str", map[string]string{"f": "v"}); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("expected ErrWrongType for HSet on a string, got %v", err)
+	}
+	if _, err := store.LRange("set", 0, -1); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("expected ErrWrongType for LRange on a set, got %v", err)
+	}
+	if _, err := store.IncrBy("set", 1); !errors.Is(err, ErrWrongType) {
+		t.Fatalf("expected ErrWrongType for IncrBy on a set, got %v", err)
+	}
+	if val, ok := store.Get("set"); !ok || val != "" {
+		t.Fatalf("expected a string read of a set to see an empty value, got %q (found=%v)", val, ok)
+	}
+
+	// Set replaces a collection, like any other value.
+	store.Set("set", "now a string")
+	if typ, _ := store.Type("set"); typ != TypeString {
+		t.Fatalf("expected Set to replace the set with a string, got %v", typ)
+	}
+	if stats := store.Stats(); stats.Bytes != entrySize("str", "value")+entrySize("set", "now a string") {
+		t.Fatalf("expected memory accounting to drop the replaced set, got %d bytes", stats.Bytes)
+	}
+}
+
+func TestKVStore_CollectionExpiry(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.RPush("queue", "a")
+	store.Expire("queue", time.Minute)
+	store.RPush("queue", "b")
+	if ttl, _ := store.TTL("queue"); ttl != time.Minute {
+		t.Fatalf("expected a write to keep the list's expiry, got %v", ttl)
+	}
+	clock.Advance(time.Minute)
+	if n, _ := store.RPush("queue", "c"); n != 1 {
+		t.Fatalf("expected an expired list to be replaced by a new one, got length %d", n)
+	}
+}
+
+func TestPersistentKVStore_CollectionsSurviveRestart(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "kv.log")
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now), WithSweepInterval(0)))
+		if err != nil {
+			t.Fatalf("failed to open PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	store.HSet("user", map[string]string{"name": "alice", "age": "30"})
+	store.HDel("user", "age")
+	store.RPush("queue", "a", "b", "c")
+	store.LPop("queue", 1)
+	store.LPush("queue", "z")
+	store.SAdd("tags", "go", "db")
+	store.SRem("tags", "db")
+	store.SAdd("gone", "x")
+	store.SRem("gone", "x")
+	store.SAdd("temp", "x")
+	store.Expire("temp", time.Minute)
+	store.Close()
+
+	check := func(store *PersistentKVStore) {
+		t.Helper()
+		if all, _ := store.HGetAll("user"); !reflect.DeepEqual(all, map[string]string{"name": "alice"}) {
+			t.Fatalf("unexpected hash after restart: %v", all)
+		}
+		if got, _ := store.LRange("queue", 0, -1); !reflect.DeepEqual(got, []string{"z", "b", "c"}) {
+			t.Fatalf("unexpected list after restart: %v", got)
+		}
+		if got, _ := store.SMembers("tags"); !reflect.DeepEqual(got, []string{"go"}) {
+			t.Fatalf("unexpected set after restart: %v", got)
+		}
+		if _, ok := store.Type("gone"); ok {
+			t.Fatalf("expected the emptied set to stay deleted")
+		}
+		if ttl, _ := store.TTL("temp"); ttl != time.Minute {
+			t.Fatalf("expected the set's expiry to survive, got %v", ttl)
+		}
+	}
+
+	store2 := open()
+	check(store2)
+	if err := store2.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if err := store2.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	store2.Close()
+
+	store3 := open()
+	check(store3)
+	store3.Close()
+
+	// The snapshot and the compacted log must each restore the collections on their own.
+	if err := os.Remove(snapshotPath(path)); err != nil {
+		t.Fatalf("failed to remove snapshot: %v", err)
+	}
+	store4 := open()
+	defer store4.Close()
+	check(store4)
+}
+
+func TestShardedKVStore_Collections(t *testing.T) {
+	var store Collections = NewSharded(4)
+	defer store.(Storage).Close()
+
+	store.HSet("h", map[string]string{"f": "v"})
+	store.RPush("l", "a", "b")
+	store.SAdd("s", "m")
+	if val, _, _ := store.HGet("h", "f"); val != "v" {
+		t.Fatalf("expected hash field through the sharded store, got %q", val)
+	}
+	if got, _ := store.LRange("l", 0, -1); !reflect.DeepEqual(got, []string{"a", "b"}) {
+		t.Fatalf("unexpected list through the sharded store: %v", got)
+	}
+	if typ, _ := store.Type("s"); typ != TypeSet {
+		t.Fatalf("expected TypeSet through the sharded store, got %v", typ)
+	}
+}
@@ -0,0 +1,212 @@
+package kvstore
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/metrics"
+)
+
+// DefaultCompactionInterval is how often background compaction checks whether the log should be compacted.
+const DefaultCompactionInterval = 60 * time.Second
+
+// PersistenceStats reports the state of a PersistentKVStore's log and compaction.
+type PersistenceStats struct {
+	LogSize          int64         // total size of all log segments in bytes
+	Segments         int           // number of live log segments
+	Compactions      uint64        // number of successful compactions
+	CompactionErrors uint64        // number of failed compactions
+	LastCompaction   time.Duration // duration of the last successful compaction
+}
+
+// WithCompactionInterval sets how often background compaction runs. The default is DefaultCompactionInterval.
+func WithCompactionInterval(interval time.Duration) PersistentOption {
+	return func(p *PersistentKVStore) {
+		if interval > 0 {
+			p.compactionInterval = interval
+		}
+	}
+}
+
+// WithCompactionRatio makes background compaction skip runs until the log has grown to at least
+// ratio times its size after the previous compaction. With no ratio, every run compacts.
+func WithCompactionRatio(ratio float64) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.compactionRatio = ratio
+	}
+}
+
+// WithErrorHandler sets a function that receives errors from background work such as compaction,
+// snapshots, and fsyncs. Errors are discarded by default.
+func WithErrorHandler(handler func(error)) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.onError = handler
+	}
+}
+
+// PersistenceStats returns the current log size and compaction counters.
+func (p *PersistentKVStore) PersistenceStats() PersistenceStats {
+	p.mu.Lock()
+	size := p.sealedSize + p.size
+	segments := len(p.segments)
+	p.mu.Unlock()
+
+	return PersistenceStats{
+		LogSize:          size,
+		Segments:         segments,
+		Compactions:      p.compactions.Load(),
+		CompactionErrors: p.compactionErrors.Load(),
+		LastCompaction:   time.Duration(p.lastCompaction.Load()),
+	}
+}
+
+// CompactionDurations returns a histogram of the time, in seconds, taken by each successful compaction.
+func (p *PersistentKVStore) CompactionDurations() metrics.HistogramSnapshot {
+	return p.compactionDuration.Snapshot()
+}
+
+// Compact seals the active log segment and merges every sealed segment into a single new segment
+// holding only the current state of each live key. Deleted and expired keys are dropped.
+//
+// Merging works on immutable sealed segments, so writers are only blocked while the active segment is
+// rotated and while the manifest is swapped. The merged segment is fsynced before the manifest, which is
+// replaced atomically along with a directory fsync, so a crash leaves either the old or the new segment
+// set in place. On failure the existing segments remain in use. A failed store is not compacted.
+func (p *PersistentKVStore) Compact() error {
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+
+	start := time.Now()
+	err := p.compactLocked()
+	if err != nil {
+		p.compactionErrors.Add(1)
+		return err
+	}
+	elapsed := time.Since(start)
+	p.compactions.Add(1)
+	p.lastCompaction.Store(int64(elapsed))
+	p.compactionDuration.ObserveDuration(elapsed)
+	return nil
+}
+
+// compactLocked performs a compaction, or returns the error that failed the store. The caller must hold snapMu.
+func (p *PersistentKVStore) compactLocked() error {
+	p.mu.Lock()
+	if err := p.failed; err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	if p.size > int64(walHeaderSize) {
+		if err := p.rotateLocked(); err != nil {
+			p.mu.Unlock()
+			return err
+		}
+	}
+	sealed := append([]string{}, p.segments[:len(p.segments)-1]...)
+	mergedName := segmentName(p.logPath, p.nextSegmentID)
+	p.nextSegmentID++
+	p.mu.Unlock()
+
+	if len(sealed) == 0 {
+		return nil
+	}
+
+	// Replay the sealed segments in order into a scratch store, which folds every change to a key
+	// into its current state. Deleted and expired keys drop out, and the version counter is kept,
+	// so versions of dropped keys are never reused.
+	scratch := New(WithClock(p.memStore.now), WithSweepInterval(0), WithWatchHistory(0))
+	defer scratch.Close()
+	var sealedSize int64
+	for _, name := range sealed {
+		file, size, err := openSegment(p.segmentPath(name), false)
+		if err != nil {
+			return err
+		}
+		valid, err := replayWAL(file, size-int64(walHeaderSize), func(rec record) { scratch.apply(rec) })
+		file.Close()
+		if err != nil {
+			return fmt.Errorf("error reading log segment %s: %w", name, err)
+		}
+		if int64(walHeaderSize)+valid < size {
+			return fmt.Errorf("%w: sealed segment %s is truncated", ErrCorruptLog, name)
+		}
+		sealedSize += size
+	}
+
+	// Write the scratch store's contents. Dropping deletes is safe because the merged segment
+	// replaces every segment before it.
+	mergedPath := p.segmentPath(mergedName)
+	merged, err := createSegment(mergedPath)
+	if err != nil {
+		return err
+	}
+	installed := false
+	defer func() {
+		merged.Close()
+		if !installed {
+			os.Remove(mergedPath)
+		}
+	}()
+
+	writer := bufio.NewWriter(merged)
+	for _, rec := range scratch.dump() {
+		writer.Write(rec.marshal())
+	}
+	if err := writer.Flush(); err != nil {
+		return fmt.Errorf("failed to write merged segment: %w", err)
+	}
+	if err := merged.Sync(); err != nil {
+		return fmt.Errorf("failed to sync merged segment: %w", err)
+	}
+	info, err := merged.Stat()
+	if err != nil {
+		return fmt.Errorf("failed to stat merged segment: %w", err)
+	}
+
+	// Swap the merged segment in. Only rotation changes the segment list meanwhile, and it only
+	// appends, so the sealed segments are still a prefix of it.
+	p.mu.Lock()
+	segments := append([]string{mergedName}, p.segments[len(sealed):]...)
+	if err := writeManifest(manifestPath(p.logPath), segments); err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	installed = true
+	p.segments = segments
+	p.sealedSize += info.Size() - sealedSize
+	p.compactedSize = p.sealedSize + p.size
+	p.mu.Unlock()
+
+	for _, name := range sealed {
+		os.Remove(p.segmentPath(name))
+	}
+	return syncDir(filepath.Dir(p.logPath))
+}
+
+// compactLogs compacts the log if it has grown past the configured ratio since the last compaction.
+func (p *PersistentKVStore) compactLogs() error {
+	if p.compactionRatio > 0 {
+		p.snapMu.Lock()
+		threshold := int64(p.compactionRatio * float64(p.compactedSize))
+		p.snapMu.Unlock()
+
+		p.mu.Lock()
+		size := p.sealedSize + p.size
+		p.mu.Unlock()
+		if size < threshold {
+			return nil
+		}
+	}
+	return p.Compact()
+}
+
+// StartLogCompaction runs a background goroutine that compacts the log every compaction interval.
+// Failures are passed to the error handler; the goroutine stops when the store is closed.
+func (p *PersistentKVStore) StartLogCompaction() {
+	p.every(p.compactionInterval, func() {
+		p.reportError(p.compactLogs())
+	})
+}
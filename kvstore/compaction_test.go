@@ -0,0 +1,126 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPersistentKVStore_CompactWithConcurrentWriters(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set("seed", strconv.Itoa(i))
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				store.Set("w"+strconv.Itoa(w)+"-"+strconv.Itoa(i), "v")
+			}
+		}(w)
+	}
+	for i := 0; i < 3; i++ {
+		if err := store.Compact(); err != nil {
+			t.Fatalf("compaction failed: %v", err)
+		}
+	}
+	wg.Wait()
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("seed"); val != "99" {
+		t.Fatalf("expected latest seed value, got %q", val)
+	}
+	if keys := store2.memStore.Stats().Keys; keys != 201 {
+		t.Fatalf("expected every concurrent write to survive compaction, got %d keys", keys)
+	}
+	if stats := store.PersistenceStats(); stats.Compactions != 3 {
+		t.Fatalf("expected 3 compactions, got %+v", stats)
+	}
+}
+
+func TestPersistentKVStore_CompactionRatio(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithCompactionRatio(2))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+
+	store.Set("foo", "baz") // not yet twice the compacted size
+	store.compactLogs()
+	if n := store.PersistenceStats().Compactions; n != 1 {
+		t.Fatalf("expected compaction to be skipped below the ratio, got %d compactions", n)
+	}
+
+	for i := 0; i < 10; i++ {
+		store.Set("foo", strconv.Itoa(i))
+	}
+	store.compactLogs()
+	if n := store.PersistenceStats().Compactions; n != 2 {
+		t.Fatalf("expected compaction once the log doubled, got %d compactions", n)
+	}
+}
+
+func TestPersistentKVStore_CompactionErrorsAreReported(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "kv.log")
+
+	var mu sync.Mutex
+	var reported []error
+	store, err := NewPersistentKVStore(path, false,
+		WithCompactionInterval(10*time.Millisecond),
+		WithErrorHandler(func(err error) {
+			mu.Lock()
+			reported = append(reported, err)
+			mu.Unlock()
+		}),
+	)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+
+	// A directory in place of the next segment file makes compaction fail.
+	if err := os.Mkdir(store.segmentPath(segmentName(path, store.nextSegmentID)), 0755); err != nil {
+		t.Fatalf("failed to create blocking directory: %v", err)
+	}
+	store.StartLogCompaction()
+	time.Sleep(50 * time.Millisecond)
+
+	// The original log must still be usable.
+	store.Set("baz", "qux")
+	if val, _ := store.Get("baz"); val != "qux" {
+		t.Fatalf("expected store to keep working after failed compaction")
+	}
+	store.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reported) == 0 {
+		t.Fatalf("expected compaction failure to reach the error handler")
+	}
+	if stats := store.PersistenceStats(); stats.CompactionErrors == 0 || stats.Compactions != 0 {
+		t.Fatalf("unexpected compaction stats: %+v", stats)
+	}
+	if errors.Is(reported[0], ErrCorruptLog) {
+		t.Fatalf("unexpected error kind: %v", reported[0])
+	}
+}
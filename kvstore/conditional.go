@@ -0,0 +1,65 @@
+package kvstore
+
+import "time"
+
+// condition decides whether a conditional write may proceed, given the key's current item
+// and whether it exists. A missing or expired key has the zero item.
+type condition func(it item, found bool) bool
+
+// versionIs allows a write only if the key's current version equals version.
+// A version of zero requires the key to be absent.
+func versionIs(version uint64) condition {
+	return func(it item, found bool) bool {
+		if version == 0 {
+			return !found
+		}
+		return found && it.version == version
+	}
+}
+
+// exists allows a write only if the key is present and unexpired.
+func exists(_ item, found bool) bool { return found }
+
+// missing allows a write only if the key is absent or expired.
+func missing(_ item, found bool) bool { return !found }
+
+// CompareAndSwap sets key to value only if its current version equals version, where a version of zero
+// requires the key to be absent. A TTL greater than zero makes the new value expire after ttl.
+// It returns the key's new version and true on success, or its current version (zero if absent) and false.
+func (kv *KVStore) CompareAndSwap(key, value string, version uint64, ttl time.Duration) (uint64, bool) {
+	return kv.setIf(key, value, ttl, time.Time{}, versionIs(version))
+}
+
+// SetIfNotExists sets key to value only if it is absent or expired, like Redis SETNX.
+// It returns the key's new version and true on success, or its current version and false.
+func (kv *KVStore) SetIfNotExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return kv.setIf(key, value, ttl, time.Time{}, missing)
+}
+
+// SetIfExists replaces the value of key only if it is present and unexpired.
+// It returns the key's new version and true on success, or zero and false.
+func (kv *KVStore) SetIfExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return kv.setIf(key, value, ttl, time.Time{}, exists)
+}
+
+// SetIf sets cond's key to value only if cond holds, expiring at expiresAt, or never if it is zero.
+// It returns the key's new version and true on success, or its current version (zero if absent) and false.
+func (kv *KVStore) SetIf(cond Compare, value string, expiresAt time.Time) (uint64, bool) {
+	return kv.setIf(cond.Key, value, 0, expiresAt, cond.holds)
+}
+
+// setIf checks cond and performs the write under a single write lock, so no other write can interleave.
+// The new value expires as set by expiryOf.
+func (kv *KVStore) setIf(key, value string, ttl time.Duration, expiresAt time.Time, cond condition) (uint64, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := kv.now()
+	it, found := kv.getLocked(key, now)
+	if !cond(it, found) {
+		return it.version, false
+	}
+	version := kv.setLocked(key, value, expiryOf(ttl, expiresAt, now), 0)
+	kv.evictLocked()
+	return version, true
+}
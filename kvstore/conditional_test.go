@@ -0,0 +1,154 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testConditional exercises versions and conditional writes on a Storage backend.
+func testConditional(t *testing.T, store Storage) {
+	t.Helper()
+
+	v1, ok := store.SetIfNotExists("lock", "a", 0)
+	if !ok || v1 == 0 {
+		t.Fatalf("expected SetIfNotExists on a missing key to succeed, got version=%d ok=%v", v1, ok)
+	}
+	if current, ok := store.SetIfNotExists("lock", "b", 0); ok || current != v1 {
+		t.Fatalf("expected SetIfNotExists on an existing key to fail with version %d, got %d ok=%v", v1, current, ok)
+	}
+	if _, ok := store.SetIfExists("missing", "x", 0); ok {
+		t.Fatalf("expected SetIfExists on a missing key to fail")
+	}
+
+	v2, ok := store.SetIfExists("lock", "b", 0)
+	if !ok || v2 <= v1 {
+		t.Fatalf("expected SetIfExists to bump the version past %d, got %d ok=%v", v1, v2, ok)
+	}
+	if _, ok := store.CompareAndSwap("lock", "stale", v1, 0); ok {
+		t.Fatalf("expected CompareAndSwap with a stale version to fail")
+	}
+	v3, ok := store.CompareAndSwap("lock", "c", v2, 0)
+	if !ok || v3 <= v2 {
+		t.Fatalf("expected CompareAndSwap with the current version to succeed, got %d ok=%v", v3, ok)
+	}
+	if val, version, ok := store.GetWithVersion("lock"); !ok || val != "c" || version != v3 {
+		t.Fatalf("expected lock=c at version %d, got %q at %d (found=%v)", v3, val, version, ok)
+	}
+
+	// A version of zero only matches a missing key, and a recreated key never reuses a version.
+	if _, ok := store.CompareAndSwap("lock", "d", 0, 0); ok {
+		t.Fatalf("expected CompareAndSwap with version 0 to fail for an existing key")
+	}
+	store.Delete("lock")
+	v4, ok := store.CompareAndSwap("lock", "d", 0, 0)
+	if !ok || v4 <= v3 {
+		t.Fatalf("expected recreated key to get a version past %d, got %d ok=%v", v3, v4, ok)
+	}
+
+	// SetIf checks a compare clause and stores an absolute expiry.
+	expiresAt := time.Now().Add(time.Hour)
+	if _, ok := store.SetIf(Compare{Key: "lease", Target: CompareExists, Exists: true}, "a", expiresAt); ok {
+		t.Fatalf("expected SetIf requiring an existing key to fail for a missing key")
+	}
+	v5, ok := store.SetIf(Compare{Key: "lease", Target: CompareVersion}, "a", expiresAt)
+	if !ok || v5 == 0 {
+		t.Fatalf("expected SetIf on a missing key to succeed, got version=%d ok=%v", v5, ok)
+	}
+	if ttl, ok := store.TTL("lease"); !ok || ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("expected lease to expire within an hour, got %v (found=%v)", ttl, ok)
+	}
+	if current, ok := store.SetIf(Compare{Key: "lease", Target: CompareValue, Value: "b"}, "c", time.Time{}); ok || current != v5 {
+		t.Fatalf("expected SetIf with a mismatched value to fail with version %d, got %d ok=%v", v5, current, ok)
+	}
+}
+
+func TestKVStore_Conditional(t *testing.T) {
+	store := New()
+	defer store.Close()
+	testConditional(t, store)
+}
+
+func TestShardedKVStore_Conditional(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+	testConditional(t, store)
+}
+
+func TestKVStore_SetIfNotExistsAfterExpiry(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	if _, ok := store.SetIfNotExists("lock", "a", time.Minute); !ok {
+		t.Fatalf("expected first SetIfNotExists to succeed")
+	}
+	clock.Advance(time.Minute)
+	if _, ok := store.SetIfNotExists("lock", "b", 0); !ok {
+		t.Fatalf("expected SetIfNotExists to succeed once the key has expired")
+	}
+}
+
+func TestKVStore_CompareAndSwapConcurrent(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	winners := 0
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := store.CompareAndSwap("counter", "taken", 0, 0); ok {
+				mu.Lock()
+				winners++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if winners != 1 {
+		t.Fatalf("expected exactly one CompareAndSwap to win, got %d", winners)
+	}
+}
+
+func TestPersistentKVStore_VersionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	testConditional(t, store)
+	_, version, _ := store.GetWithVersion("lock")
+	store.Set("gone", "x")
+	_, gone, _ := store.GetWithVersion("gone")
+	store.Delete("gone")
+	store.Close()
+
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false)
+		if err != nil {
+			t.Fatalf("failed to recover PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store2 := open()
+	if _, got, ok := store2.GetWithVersion("lock"); !ok || got != version {
+		t.Fatalf("expected version %d after restart, got %d", version, got)
+	}
+	// Compaction drops the deleted key, but its version is never handed out again.
+	if err := store2.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	store2.Close()
+
+	store3 := open()
+	defer store3.Close()
+	if v, ok := store3.SetIfNotExists("gone", "y", 0); !ok || v <= gone {
+		t.Fatalf("expected recreated key to get a version past %d, got %d", gone, v)
+	}
+}
@@ -0,0 +1,110 @@
+package kvstore
+
+import (
+	"errors"
+	"math"
+	"strconv"
+)
+
+var (
+	// ErrNotInteger is returned by IncrBy and DecrBy when the key holds a value that is not a base-10 64-bit integer.
+	ErrNotInteger = errors.New("kvstore: value is not an integer")
+	// ErrNotNumber is returned by IncrByFloat when the key holds a value that is not a finite number,
+	// or the increment itself is not finite.
+	ErrNotNumber = errors.New("kvstore: value is not a number")
+	// ErrOverflow is returned when an increment would overflow a 64-bit integer or produce an infinite float.
+	ErrOverflow = errors.New("kvstore: increment would overflow")
+)
+
+// updateFunc computes a key's new value from its current one. found is false if the key is missing
+// or expired. Returning an error leaves the key unchanged.
+type updateFunc func(value string, found bool) (string, error)
+
+// IncrBy atomically adds delta to the integer stored at key and returns the new value. A missing or
+// expired key counts as zero and is created without an expiry; an existing key keeps its expiry.
+func (kv *KVStore) IncrBy(key string, delta int64) (int64, error) {
+	it, err := kv.update(key, incrInt(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(it.value, 10, 64)
+}
+
+// DecrBy atomically subtracts delta from the integer stored at key and returns the new value.
+// It behaves like IncrBy with the delta negated.
+func (kv *KVStore) DecrBy(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return kv.IncrBy(key, -delta)
+}
+
+// IncrByFloat atomically adds delta to the number stored at key and returns the new value. A missing or
+// expired key counts as zero and is created without an expiry; an existing key keeps its expiry.
+func (kv *KVStore) IncrByFloat(key string, delta float64) (float64, error) {
+	it, err := kv.update(key, incrFloat(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(it.value, 64)
+}
+
+// update replaces the value of key with the result of fn under the write lock, keeping any expiry,
+// and returns the new item. It fails with ErrWrongType if the key holds a hash, list, or set.
+func (kv *KVStore) update(key string, fn updateFunc) (item, error) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	it, found := kv.getLocked(key, kv.now())
+	if found && it.kind != TypeString {
+		return item{}, ErrWrongType
+	}
+	value, err := fn(it.value, found)
+	if err != nil {
+		return item{}, err
+	}
+	it.value = value
+	it.version = kv.setLocked(key, value, it.expiresAt, 0)
+	kv.evictLocked()
+	return it, nil
+}
+
+// incrInt returns an update that adds delta to an integer value, treating a missing value as zero.
+func incrInt(delta int64) updateFunc {
+	return func(value string, found bool) (string, error) {
+		var n int64
+		if found {
+			var err error
+			if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+				return "", ErrNotInteger
+			}
+		}
+		if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+			return "", ErrOverflow
+		}
+		return strconv.FormatInt(n+delta, 10), nil
+	}
+}
+
+// incrFloat returns an update that adds delta to a numeric value, treating a missing value as zero.
+// The result is formatted in the shortest form that parses back to the same value, without an exponent,
+// so integral results can still be incremented with IncrBy.
+func incrFloat(delta float64) updateFunc {
+	return func(value string, found bool) (string, error) {
+		if math.IsNaN(delta) || math.IsInf(delta, 0) {
+			return "", ErrNotNumber
+		}
+		var f float64
+		if found {
+			var err error
+			if f, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+				return "", ErrNotNumber
+			}
+		}
+		sum := f + delta
+		if math.IsInf(sum, 0) {
+			return "", ErrOverflow
+		}
+		return strconv.FormatFloat(sum, 'f', -1, 64), nil
+	}
+}
@@ -0,0 +1,151 @@
+package kvstore
+
+import (
+	"errors"
+	"math"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestKVStore_IncrBy(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	if n, err := store.IncrBy("counter", 5); err != nil || n != 5 {
+		t.Fatalf("expected a missing key to count from zero, got %d (err=%v)", n, err)
+	}
+	if n, err := store.DecrBy("counter", 7); err != nil || n != -2 {
+		t.Fatalf("expected -2, got %d (err=%v)", n, err)
+	}
+	if val, _ := store.Get("counter"); val != "-2" {
+		t.Fatalf("expected the counter to be stored as a decimal string, got %q", val)
+	}
+
+	store.Set("name", "alice")
+	if _, err := store.IncrBy("name", 1); !errors.Is(err, ErrNotInteger) {
+		t.Fatalf("expected ErrNotInteger, got %v", err)
+	}
+	if val, _ := store.Get("name"); val != "alice" {
+		t.Fatalf("expected a failed increment to leave the value unchanged, got %q", val)
+	}
+
+	store.Set("max", "9223372036854775807")
+	if _, err := store.IncrBy("max", 1); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected ErrOverflow, got %v", err)
+	}
+	if _, err := store.DecrBy("counter", math.MinInt64); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected ErrOverflow when negating the minimum delta, got %v", err)
+	}
+}
+
+func TestKVStore_IncrByFloat(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	store.Set("price", "10.5")
+	if f, err := store.IncrByFloat("price", 0.1); err != nil || f != 10.6 {
+		t.Fatalf("expected 10.6, got %v (err=%v)", f, err)
+	}
+	if f, err := store.IncrByFloat("price", -0.6); err != nil || f != 10 {
+		t.Fatalf("expected 10, got %v (err=%v)", f, err)
+	}
+	if val, _ := store.Get("price"); val != "10" {
+		t.Fatalf("expected an integral result without a fraction or exponent, got %q", val)
+	}
+	if n, err := store.IncrBy("price", 1); err != nil || n != 11 {
+		t.Fatalf("expected an integral float to be usable as an integer, got %d (err=%v)", n, err)
+	}
+
+	store.Set("name", "alice")
+	if _, err := store.IncrByFloat("name", 1); !errors.Is(err, ErrNotNumber) {
+		t.Fatalf("expected ErrNotNumber, got %v", err)
+	}
+	if _, err := store.IncrByFloat("price", math.NaN()); !errors.Is(err, ErrNotNumber) {
+		t.Fatalf("expected ErrNotNumber for a NaN delta, got %v", err)
+	}
+	store.Set("huge", "1.7e308")
+	if _, err := store.IncrByFloat("huge", 1.7e308); !errors.Is(err, ErrOverflow) {
+		t.Fatalf("expected ErrOverflow, got %v", err)
+	}
+}
+
+func TestKVStore_IncrByKeepsExpiry(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("window", "0", time.Second)
+	for i := 0; i < 10; i++ {
+		store.IncrBy("window", 1)
+	}
+	if ttl, _ := store.TTL("window"); ttl != time.Second {
+		t.Fatalf("expected increments to keep the expiry, got %v", ttl)
+	}
+	if n := store.expiries.Len(); n != 1 {
+		t.Fatalf("expected the unchanged expiry to be scheduled once, got %d entries", n)
+	}
+
+	clock.Advance(time.Second)
+	if n, _ := store.IncrBy("window", 1); n != 1 {
+		t.Fatalf("expected an expired counter to restart from zero, got %d", n)
+	}
+	if ttl, _ := store.TTL("window"); ttl != 0 {
+		t.Fatalf("expected a restarted counter to have no expiry, got %v", ttl)
+	}
+}
+
+func TestKVStore_IncrByConcurrent(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				store.IncrBy("counter", 1)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if val, _ := store.Get("counter"); val != "5000" {
+		t.Fatalf("expected 5000 after concurrent increments, got %s", val)
+	}
+}
+
+func TestPersistentKVStore_CountersSurviveRestart(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "kv.log")
+	opts := WithStoreOptions(WithClock(clock.Now), WithSweepInterval(0))
+
+	store, err := NewPersistentKVStore(path, false, opts)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.IncrBy("hits", 3)
+	store.DecrBy("hits", 1)
+	store.SetWithTTL("window", "1", time.Minute)
+	store.IncrBy("window", 1)
+	store.IncrByFloat("total", 2.5)
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false, opts)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	defer store2.Close()
+	if val, _ := store2.Get("hits"); val != "2" {
+		t.Fatalf("expected 'hits' to be 2 after restart, got %q", val)
+	}
+	value, _ := store2.Get("window")
+	if ttl, _ := store2.TTL("window"); value != "2" || ttl != time.Minute {
+		t.Fatalf("expected 'window' to be 2 with its expiry after restart, got %q with %v", value, ttl)
+	}
+	if f, err := store2.IncrByFloat("total", 0.25); err != nil || f != 2.75 {
+		t.Fatalf("expected 'total' to continue from 2.5, got %v (err=%v)", f, err)
+	}
+}
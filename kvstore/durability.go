@@ -0,0 +1,117 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/metrics"
+)
+
+// SyncPolicy controls when the persistence log is flushed to stable storage.
+type SyncPolicy int
+
+const (
+	// SyncAlways fsyncs before a write returns. Concurrent writers are grouped into a single fsync.
+	SyncAlways SyncPolicy = iota
+	// SyncInterval fsyncs in the background at a fixed interval; a crash may lose writes from the last interval.
+	SyncInterval
+	// SyncNever leaves flushing to the operating system.
+	SyncNever
+)
+
+// DefaultSyncInterval is the background fsync interval used by SyncInterval when none is configured.
+const DefaultSyncInterval = 100 * time.Millisecond
+
+// WithSyncPolicy sets when the persistence log is fsynced. The default is SyncAlways.
+func WithSyncPolicy(policy SyncPolicy) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.syncPolicy = policy
+	}
+}
+
+// WithSyncInterval selects the SyncInterval policy and fsyncs the log every interval.
+func WithSyncInterval(interval time.Duration) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.syncPolicy = SyncInterval
+		if interval > 0 {
+			p.syncInterval = interval
+		}
+	}
+}
+
+// waitDurable blocks until the record with the given sequence number has been fsynced,
+// if the sync policy requires it. It returns an error if the record could not be made durable.
+//
+// This implements group commit: writers queue on syncMu while an fsync is in flight, and the
+// next writer to get the lock fsyncs every record appended so far, releasing the whole queue.
+func (p *PersistentKVStore) waitDurable(seq uint64) error {
+	if p.syncPolicy != SyncAlways {
+		return nil
+	}
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	if p.synced >= seq {
+		return nil // covered by another writer's fsync
+	}
+	return p.syncLocked()
+}
+
+// syncNow fsyncs every record appended so far, returning the error that failed the store if it cannot.
+func (p *PersistentKVStore) syncNow() error {
+	p.syncMu.Lock()
+	defer p.syncMu.Unlock()
+	return p.syncLocked()
+}
+
+// syncLocked fsyncs the log and marks every record appended so far as durable.
+//
+// A failed fsync may have dropped the unsynced records from the page cache, so retrying it could
+// falsely succeed. Instead the records stay non-durable, the store is marked failed, and every later
+// call returns the same error. The caller must hold syncMu.
+func (p *PersistentKVStore) syncLocked() error {
+	if p.syncErr != nil {
+		return p.syncErr
+	}
+	p.mu.Lock()
+	target := p.written
+	file := p.logFile
+	p.mu.Unlock()
+
+	if p.synced >= target {
+		return nil
+	}
+	start := time.Now()
+	err := file.Sync()
+	p.syncLatency.ObserveDuration(time.Since(start))
+	if errors.Is(err, os.ErrClosed) {
+		// Rotation fsyncs a segment before closing and replacing it, so if the file is no longer the
+		// active segment its records are already durable. Otherwise it was closed for another reason.
+		p.mu.Lock()
+		if p.logFile != file {
+			err = nil
+		}
+		p.mu.Unlock()
+	}
+	if err != nil {
+		p.mu.Lock()
+		p.syncErr = p.failLocked(fmt.Errorf("failed to sync persistence file: %w", err))
+		p.mu.Unlock()
+		p.reportError(p.syncErr)
+		return p.syncErr
+	}
+	p.syncCount++
+	p.synced = target
+	return nil
+}
+
+// SyncLatencies returns a histogram of the time, in seconds, taken by each fsync of the log.
+func (p *PersistentKVStore) SyncLatencies() metrics.HistogramSnapshot {
+	return p.syncLatency.Snapshot()
+}
+
+// startSyncer runs a background goroutine that fsyncs the log every sync interval.
+func (p *PersistentKVStore) startSyncer() {
+	p.every(p.syncInterval, func() { p.syncNow() }) // syncLocked reports failures
+}
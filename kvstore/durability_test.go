@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPersistentKVStore_GroupCommit(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+
+	// Hold the sync lock as if an fsync were in flight, so all writers queue behind it.
+	store.syncMu.Lock()
+	const writers = 20
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			store.Set("key"+strconv.Itoa(i), "v")
+		}(i)
+	}
+	for {
+		store.mu.Lock()
+		written := store.written
+		store.mu.Unlock()
+		if written == writers {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	store.syncMu.Unlock()
+	wg.Wait()
+
+	if store.syncCount != 1 {
+		t.Fatalf("expected queued writers to share a single fsync, got %d", store.syncCount)
+	}
+	if store.synced != writers {
+		t.Fatalf("expected all %d records to be durable, got %d", writers, store.synced)
+	}
+}
+
+func TestPersistentKVStore_SyncNever(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+
+	store.Set("foo", "bar")
+	store.Delete("foo")
+	store.Set("baz", "qux")
+
+	if store.syncCount != 0 {
+		t.Fatalf("expected no fsyncs, got %d", store.syncCount)
+	}
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("baz"); val != "qux" {
+		t.Fatalf("expected write to reach the log, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_SyncInterval(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSyncInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+
+	store.Set("foo", "bar")
+	store.Set("baz", "qux")
+
+	time.Sleep(50 * time.Millisecond)
+
+	store.syncMu.Lock()
+	defer store.syncMu.Unlock()
+	if store.synced != 2 {
+		t.Fatalf("expected background fsync to cover both writes, got %d", store.synced)
+	}
+	if store.syncCount == 0 {
+		t.Fatalf("expected at least one background fsync")
+	}
+}
+
+func TestPersistentKVStore_SyncFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	store.Set("a", "1")
+
+	// Close the active segment underneath the store, so that fsyncing it fails.
+	store.mu.Lock()
+	store.logFile.Close()
+	store.mu.Unlock()
+	store.syncPolicy = SyncAlways
+
+	if err := store.waitDurable(1); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected a failed fsync to return ErrStoreFailed, got %v", err)
+	}
+	if store.synced != 0 {
+		t.Fatalf("expected the record to stay non-durable, got synced=%d", store.synced)
+	}
+	if err := store.waitDurable(1); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected later waits to fail without retrying the fsync, got %v", err)
+	}
+	if !errors.Is(store.Err(), ErrStoreFailed) {
+		t.Fatalf("expected the store to be marked failed, got %v", store.Err())
+	}
+}
+
+func TestPersistentKVStore_SnapshotSyncFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSyncPolicy(SyncNever))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	store.Set("a", "1")
+
+	// Close the active segment underneath the store, so that the snapshot's fsync fails.
+	store.mu.Lock()
+	store.logFile.Close()
+	store.mu.Unlock()
+
+	if err := store.Snapshot(); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected a failed fsync to fail the snapshot, got %v", err)
+	}
+	if _, err := os.Stat(snapshotPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected no snapshot to be written, got %v", err)
+	}
+}
@@ -0,0 +1,200 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+)
+
+// DefaultWatchHistory is the number of recent events a store keeps for watchers resuming from a revision.
+const DefaultWatchHistory = 1024
+
+// watchBuffer is the number of events a watcher may fall behind before it is cancelled.
+const watchBuffer = 256
+
+// ErrRevisionCompacted is returned by Watch when the requested revision is older than the retained history,
+// so events after it may have been lost. The caller should re-read the keys it watches and watch from now.
+var ErrRevisionCompacted = errors.New("kvstore: watch revision has been compacted")
+
+// EventType identifies the kind of change an Event reports.
+type EventType int
+
+const (
+	// EventPut reports that a key was set.
+	EventPut EventType = iota + 1
+	// EventDelete reports that a key was deleted or evicted.
+	EventDelete
+	// EventExpire reports that a key was removed because its TTL passed.
+	EventExpire
+)
+
+// Event is a single change to a key. Revision is the store's version counter after the change,
+// so it equals the key's new version for puts and increases with every event.
+type Event struct {
+	Type     EventType
+	Key      string
+	Value    string // set for EventPut only, and empty for hashes, lists, and sets
+	Revision uint64
+}
+
+// Watchable is implemented by storage backends that can stream changes to their keys.
+type Watchable interface {
+	// Watch streams events for key, or for every key starting with key if prefix is true, until ctx is done.
+	// Events with revisions after afterRevision that are still in the store's history are sent first;
+	// zero means only new events. The channel is closed when ctx is done, when the store is closed, or when
+	// the watcher falls too far behind; in the last two cases the caller may watch again from the last revision.
+	Watch(ctx context.Context, key string, prefix bool, afterRevision uint64) (<-chan Event, error)
+}
+
+// WithWatchHistory sets how many recent events the store keeps for watchers that resume from a revision.
+// The default is DefaultWatchHistory.
+func WithWatchHistory(n int) Option {
+	return func(kv *KVStore) {
+		kv.events.limit = n
+	}
+}
+
+// watcher is a registered Watch call.
+type watcher struct {
+	key    string
+	prefix bool
+	ch     chan Event
+}
+
+// matches reports whether the watcher is interested in key.
+func (w *watcher) matches(key string) bool {
+	if w.prefix {
+		return strings.HasPrefix(key, w.key)
+	}
+	return key == w.key
+}
+
+// eventBus keeps a bounded history of events and fans them out to watchers.
+// Events are published under the store's write lock, so they arrive in revision order.
+type eventBus struct {
+	mu        sync.Mutex
+	history   []Event // ring buffer of the most recent events, oldest at next once full
+	next      int
+	limit     int
+	compacted uint64 // events up to this revision may be missing from history
+	watchers  map[*watcher]struct{}
+	closed    bool
+}
+
+// newEventBus creates an event bus keeping DefaultWatchHistory events.
+func newEventBus() *eventBus {
+	return &eventBus{
+		limit:    DefaultWatchHistory,
+		watchers: make(map[*watcher]struct{}),
+	}
+}
+
+// publish records an event and delivers it to matching watchers without blocking.
+// A watcher whose buffer is full is cancelled rather than holding up writers.
+func (b *eventBus) publish(ev Event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch {
+	case b.limit <= 0:
+		b.compacted = ev.Revision
+	case len(b.history) < b.limit:
+		b.history = append(b.history, ev)
+	default:
+		b.compacted = b.history[b.next].Revision
+		b.history[b.next] = ev
+		b.next = (b.next + 1) % len(b.history)
+	}
+
+	for w := range b.watchers {
+		if !w.matches(ev.Key) {
+			continue
+		}
+		select {
+		case w.ch <- ev:
+		default:
+			b.removeLocked(w)
+		}
+	}
+}
+
+// reset discards the history, marking every revision up to revision as compacted.
+func (b *eventBus) reset(revision uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.history = nil
+	b.next = 0
+	b.compacted = revision
+}
+
+// watch registers a watcher, first queueing the retained events after afterRevision.
+func (b *eventBus) watch(ctx context.Context, key string, prefix bool, afterRevision uint64) (<-chan Event, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	w := &watcher{key: key, prefix: prefix}
+	var backlog []Event
+	if afterRevision > 0 {
+		if afterRevision < b.compacted {
+			return nil, ErrRevisionCompacted
+		}
+		for i := range b.history {
+			ev := b.history[(b.next+i)%len(b.history)]
+			if ev.Revision > afterRevision && w.matches(ev.Key) {
+				backlog = append(backlog, ev)
+			}
+		}
+	}
+	w.ch = make(chan Event, len(backlog)+watchBuffer)
+	for _, ev := range backlog {
+		w.ch <- ev
+	}
+	if b.closed {
+		close(w.ch)
+		return w.ch, nil
+	}
+	b.watchers[w] = struct{}{}
+
+	go func() {
+		<-ctx.Done()
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		b.removeLocked(w)
+	}()
+	return w.ch, nil
+}
+
+// removeLocked unregisters a watcher and closes its channel, if it is still registered.
+// The caller must hold b.mu.
+func (b *eventBus) removeLocked(w *watcher) {
+	if _, ok := b.watchers[w]; ok {
+		delete(b.watchers, w)
+		close(w.ch)
+	}
+}
+
+// close cancels every watcher. Later calls to watch return an already closed channel.
+func (b *eventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.closed = true
+	for w := range b.watchers {
+		b.removeLocked(w)
+	}
+}
+
+// Watch streams changes to key, or to every key with the prefix key, until ctx is done.
+// See Watchable for details.
+func (kv *KVStore) Watch(ctx context.Context, key string, prefix bool, afterRevision uint64) (<-chan Event, error) {
+	return kv.events.watch(ctx, key, prefix, afterRevision)
+}
+
+// publishRemovalLocked advances the version counter for a removal and publishes the event.
+// The caller must hold the write lock.
+func (kv *KVStore) publishRemovalLocked(typ EventType, key string) {
+	kv.version++
+	kv.events.publish(Event{Type: typ, Key: key, Revision: kv.version})
+}
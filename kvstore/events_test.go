@@ -0,0 +1,184 @@
+package kvstore
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// nextEvent receives an event from ch or fails the test after a timeout.
+func nextEvent(t *testing.T, ch <-chan Event) Event {
+	t.Helper()
+	select {
+	case ev, ok := <-ch:
+		if !ok {
+			t.Fatalf("watch channel closed unexpectedly")
+		}
+		return ev
+	case <-time.After(time.Second):
+		t.Fatalf("timed out waiting for event")
+	}
+	return Event{}
+}
+
+func TestKVStore_WatchKeyAndPrefix(t *testing.T) {
+	store := New()
+	defer store.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	keyEvents, err := store.Watch(ctx, "config/a", false, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	prefixEvents, err := store.Watch(ctx, "config/", true, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+
+	store.Set("other", "x")
+	store.Set("config/a", "1")
+	store.Set("config/b", "2")
+	store.Delete("config/a")
+
+	put := nextEvent(t, keyEvents)
+	if put.Type != EventPut || put.Key != "config/a" || put.Value != "1" {
+		t.Fatalf("unexpected event: %+v", put)
+	}
+	if _, version, _ := store.GetWithVersion("config/b"); version <= put.Revision {
+		t.Fatalf("expected revisions to increase, got %d after %d", version, put.Revision)
+	}
+	del := nextEvent(t, keyEvents)
+	if del.Type != EventDelete || del.Revision <= put.Revision {
+		t.Fatalf("unexpected event: %+v", del)
+	}
+
+	var keys []string
+	for i := 0; i < 3; i++ {
+		keys = append(keys, nextEvent(t, prefixEvents).Key)
+	}
+	if keys[0] != "config/a" || keys[1] != "config/b" || keys[2] != "config/a" {
+		t.Fatalf("unexpected prefix events: %v", keys)
+	}
+
+	cancel()
+	if _, ok := <-keyEvents; ok {
+		t.Fatalf("expected channel to close once the context is cancelled")
+	}
+}
+
+func TestKVStore_WatchExpire(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	events, err := store.Watch(context.Background(), "session", false, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	store.SetWithTTL("session", "abc", time.Minute)
+	clock.Advance(time.Minute)
+	store.sweep()
+
+	nextEvent(t, events)
+	if ev := nextEvent(t, events); ev.Type != EventExpire || ev.Key != "session" {
+		t.Fatalf("expected expire event, got %+v", ev)
+	}
+}
+
+func TestKVStore_WatchResume(t *testing.T) {
+	store := New(WithWatchHistory(4))
+	defer store.Close()
+
+	store.Set("a", "1")
+	_, last, _ := store.GetWithVersion("a")
+	store.Set("a", "2")
+	store.Set("b", "3")
+
+	// Resuming replays the missed events before new ones.
+	events, err := store.Watch(context.Background(), "a", false, last)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	if ev := nextEvent(t, events); ev.Value != "2" {
+		t.Fatalf("expected missed event to be replayed, got %+v", ev)
+	}
+	store.Set("a", "4")
+	if ev := nextEvent(t, events); ev.Value != "4" {
+		t.Fatalf("expected new event after replay, got %+v", ev)
+	}
+
+	// Once the history has moved past the revision, resuming is refused.
+	for i := 0; i < 4; i++ {
+		store.Set("c", "x")
+	}
+	if _, err := store.Watch(context.Background(), "a", false, last); !errors.Is(err, ErrRevisionCompacted) {
+		t.Fatalf("expected ErrRevisionCompacted, got %v", err)
+	}
+}
+
+func TestKVStore_WatchCancelledWhenBehindOrClosed(t *testing.T) {
+	store := New()
+
+	slow, err := store.Watch(context.Background(), "k", false, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	for i := 0; i <= watchBuffer; i++ {
+		store.Set("k", "v")
+	}
+	n := 0
+	for range slow {
+		n++
+	}
+	if n != watchBuffer {
+		t.Fatalf("expected a lagging watcher to be cancelled after %d events, got %d", watchBuffer, n)
+	}
+
+	open, err := store.Watch(context.Background(), "k", false, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	store.Close()
+	if _, ok := <-open; ok {
+		t.Fatalf("expected Close to cancel watchers")
+	}
+}
+
+func TestPersistentKVStore_WatchRevisionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	clock := newFakeClock()
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now), WithSweepInterval(0)))
+		if err != nil {
+			t.Fatalf("failed to open PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	events, err := store.Watch(context.Background(), "", true, 0)
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	store.SetWithTTL("session", "abc", time.Minute)
+	clock.Advance(time.Minute)
+	store.sweep()
+	nextEvent(t, events)
+	expired := nextEvent(t, events)
+	// Crash without closing, so that only what the sweep logged survives.
+	store.logFile.Close()
+	store.memStore.Close()
+
+	// The history is gone after a restart, but revisions keep increasing past the last one seen.
+	store2 := open()
+	defer store2.Close()
+	if _, err := store2.Watch(context.Background(), "", true, expired.Revision-1); !errors.Is(err, ErrRevisionCompacted) {
+		t.Fatalf("expected ErrRevisionCompacted after restart, got %v", err)
+	}
+	if version, _ := store2.SetIfNotExists("session", "def", 0); version <= expired.Revision {
+		t.Fatalf("expected a revision past %d after restart, got %d", expired.Revision, version)
+	}
+}
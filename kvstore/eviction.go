@@ -0,0 +1,330 @@
+package kvstore
+
+import (
+	"container/heap"
+	"container/list"
+	"math/rand"
+	"time"
+)
+
+// entryOverhead approximates the per-key bookkeeping cost, in bytes, of the map entry and item struct.
+const entryOverhead = 64
+
+// entrySize estimates the memory used by a single key-value pair.
+func entrySize(key, value string) int64 {
+	return int64(len(key) + len(value) + entryOverhead)
+}
+
+// size estimates the memory used by the item stored at key, including any collection elements.
+func (it item) size(key string) int64 {
+	return entrySize(key, it.value) + it.elemBytes
+}
+
+// EvictionPolicy decides which key to remove when a bounded KVStore exceeds its entry or memory budget.
+// The store serializes all calls, so implementations do not need to be safe for concurrent use.
+type EvictionPolicy interface {
+	// Add records that key was inserted or overwritten with the given expiration time (zero for none).
+	Add(key string, expiresAt time.Time)
+	// Access records a successful read of key.
+	Access(key string)
+	// Remove forgets key after it has been deleted, expired, or evicted.
+	Remove(key string)
+	// Victim returns the next key to evict, or false if the policy has no candidate.
+	Victim() (string, bool)
+}
+
+// lruPolicy evicts the least recently used key.
+type lruPolicy struct {
+	order *list.List // front is most recently used
+	elems map[string]*list.Element
+}
+
+// NewLRUPolicy returns a policy that evicts the least recently written or read key.
+func NewLRUPolicy() EvictionPolicy {
+	return &lruPolicy{
+		order: list.New(),
+		elems: make(map[string]*list.Element),
+	}
+}
+
+func (p *lruPolicy) Add(key string, _ time.Time) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+		return
+	}
+	p.elems[key] = p.order.PushFront(key)
+}
+
+func (p *lruPolicy) Access(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.MoveToFront(e)
+	}
+}
+
+func (p *lruPolicy) Remove(key string) {
+	if e, ok := p.elems[key]; ok {
+		p.order.Remove(e)
+		delete(p.elems, key)
+	}
+}
+
+func (p *lruPolicy) Victim() (string, bool) {
+	e := p.order.Back()
+	if e == nil {
+		return "", false
+	}
+	return e.Value.(string), true
+}
+
+// lfuEntry tracks how often a key has been used.
+type lfuEntry struct {
+	key   string
+	freq  uint64
+	seq   uint64 // insertion order, breaks ties in favour of evicting older keys
+	index int
+}
+
+// lfuHeap is a min-heap of entries ordered by frequency, then age.
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int { return len(h) }
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].freq != h[j].freq {
+		return h[i].freq < h[j].freq
+	}
+	return h[i].seq < h[j].seq
+}
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x interface{}) {
+	e := x.(*lfuEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *lfuHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// lfuPolicy evicts the least frequently used key.
+type lfuPolicy struct {
+	heap    lfuHeap
+	entries map[string]*lfuEntry
+	seq     uint64
+}
+
+// NewLFUPolicy returns a policy that evicts the key with the fewest writes and reads.
+// Ties are broken by evicting the key that was inserted first.
+func NewLFUPolicy() EvictionPolicy {
+	return &lfuPolicy{entries: make(map[string]*lfuEntry)}
+}
+
+func (p *lfuPolicy) Add(key string, _ time.Time) {
+	if _, ok := p.entries[key]; ok {
+		p.Access(key)
+		return
+	}
+	p.seq++
+	e := &lfuEntry{key: key, freq: 1, seq: p.seq}
+	p.entries[key] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *lfuPolicy) Access(key string) {
+	if e, ok := p.entries[key]; ok {
+		e.freq++
+		heap.Fix(&p.heap, e.index)
+	}
+}
+
+func (p *lfuPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *lfuPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+// randomPolicy evicts a uniformly random key.
+type randomPolicy struct {
+	keys  []string
+	index map[string]int
+}
+
+// NewRandomPolicy returns a policy that evicts a random key.
+func NewRandomPolicy() EvictionPolicy {
+	return &randomPolicy{index: make(map[string]int)}
+}
+
+func (p *randomPolicy) Add(key string, _ time.Time) {
+	if _, ok := p.index[key]; ok {
+		return
+	}
+	p.index[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *randomPolicy) Access(string) {}
+
+func (p *randomPolicy) Remove(key string) {
+	i, ok := p.index[key]
+	if !ok {
+		return
+	}
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.index[p.keys[i]] = i
+	p.keys = p.keys[:last]
+	delete(p.index, key)
+}
+
+func (p *randomPolicy) Victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	return p.keys[rand.Intn(len(p.keys))], true
+}
+
+// volatileEntry tracks a key that has an expiration time.
+type volatileEntry struct {
+	key       string
+	expiresAt time.Time
+	index     int
+}
+
+// volatileHeap is a min-heap of entries ordered by expiration time.
+type volatileHeap []*volatileEntry
+
+func (h volatileHeap) Len() int           { return len(h) }
+func (h volatileHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h volatileHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *volatileHeap) Push(x interface{}) {
+	e := x.(*volatileEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *volatileHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// volatileTTLPolicy evicts the key that is closest to expiring.
+type volatileTTLPolicy struct {
+	heap    volatileHeap
+	entries map[string]*volatileEntry
+}
+
+// NewVolatileTTLPolicy returns a policy that evicts the key with the soonest expiration time.
+// Keys without a TTL are never evicted, so a store holding only such keys may exceed its budget.
+func NewVolatileTTLPolicy() EvictionPolicy {
+	return &volatileTTLPolicy{entries: make(map[string]*volatileEntry)}
+}
+
+func (p *volatileTTLPolicy) Add(key string, expiresAt time.Time) {
+	if expiresAt.IsZero() {
+		p.Remove(key)
+		return
+	}
+	if e, ok := p.entries[key]; ok {
+		e.expiresAt = expiresAt
+		heap.Fix(&p.heap, e.index)
+		return
+	}
+	e := &volatileEntry{key: key, expiresAt: expiresAt}
+	p.entries[key] = e
+	heap.Push(&p.heap, e)
+}
+
+func (p *volatileTTLPolicy) Access(string) {}
+
+func (p *volatileTTLPolicy) Remove(key string) {
+	if e, ok := p.entries[key]; ok {
+		heap.Remove(&p.heap, e.index)
+		delete(p.entries, key)
+	}
+}
+
+func (p *volatileTTLPolicy) Victim() (string, bool) {
+	if len(p.heap) == 0 {
+		return "", false
+	}
+	return p.heap[0].key, true
+}
+
+// overBudget reports whether the store holds more keys or bytes than allowed.
+// The caller must hold the write lock.
+func (kv *KVStore) overBudget() bool {
+	return (kv.maxEntries > 0 && len(kv.store) > kv.maxEntries) ||
+		(kv.maxBytes > 0 && kv.bytes > kv.maxBytes)
+}
+
+// evictLocked removes keys chosen by the eviction policy until the store is within budget
+// or the policy has no more candidates. The caller must hold the write lock.
+func (kv *KVStore) evictLocked() {
+	if kv.policy == nil {
+		return
+	}
+	for kv.overBudget() {
+		key, ok := kv.policy.Victim()
+		if !ok {
+			return
+		}
+		_, held := kv.store[key]
+		kv.removeLocked(key)
+		kv.policy.Remove(key) // in case the policy was tracking a key the store no longer holds
+		if held {
+			kv.evicted++
+			kv.publishRemovalLocked(EventDelete, key)
+			if kv.trackEvictions {
+				kv.evictions = append(kv.evictions, key)
+			}
+		}
+	}
+}
+
+// enforceBudget evicts keys until the store is within budget.
+func (kv *KVStore) enforceBudget() {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.evictLocked()
+}
+
+// takeEvictions returns the keys evicted since the last call that the store no longer holds,
+// leaving out keys written again since.
+func (kv *KVStore) takeEvictions() []string {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	var keys []string
+	for _, key := range kv.evictions {
+		if _, ok := kv.store[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	kv.evictions = nil
+	return keys
+}
@@ -0,0 +1,147 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKVStore_EvictsLRUByDefault(t *testing.T) {
+	store := New(WithMaxEntries(2))
+	defer store.Close()
+
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Get("a") // b is now least recently used
+	store.Set("c", "3")
+
+	if _, ok := store.Get("b"); ok {
+		t.Fatalf("expected 'b' to be evicted")
+	}
+	for _, key := range []string{"a", "c"} {
+		if _, ok := store.Get(key); !ok {
+			t.Fatalf("expected '%s' to remain", key)
+		}
+	}
+	if stats := store.Stats(); stats.Evicted != 1 || stats.Keys != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestKVStore_EvictsLFU(t *testing.T) {
+	store := New(WithMaxEntries(2), WithEvictionPolicy(NewLFUPolicy))
+	defer store.Close()
+
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Get("a")
+	store.Get("a")
+	store.Get("b")
+	store.Set("c", "3") // b has fewer uses than a, and c is newest
+
+	if _, ok := store.Get("a"); !ok {
+		t.Fatalf("expected frequently used 'a' to remain")
+	}
+	if stats := store.Stats(); stats.Keys != 2 || stats.Evicted != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestKVStore_EvictsRandom(t *testing.T) {
+	store := New(WithMaxEntries(3), WithEvictionPolicy(NewRandomPolicy))
+	defer store.Close()
+
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		store.Set(key, "v")
+	}
+	if stats := store.Stats(); stats.Keys != 3 || stats.Evicted != 2 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestKVStore_EvictsSoonestExpiring(t *testing.T) {
+	store := New(WithMaxEntries(2), WithEvictionPolicy(NewVolatileTTLPolicy))
+	defer store.Close()
+
+	store.Set("persistent", "1")
+	store.SetWithTTL("late", "2", time.Hour)
+	store.SetWithTTL("soon", "3", time.Minute)
+
+	if _, ok := store.Get("soon"); ok {
+		t.Fatalf("expected soonest expiring key to be evicted")
+	}
+	if _, ok := store.Get("persistent"); !ok {
+		t.Fatalf("expected key without TTL to remain")
+	}
+
+	// With no volatile keys left beyond 'late', only it can be evicted.
+	store.Set("other", "4")
+	if _, ok := store.Get("late"); ok {
+		t.Fatalf("expected 'late' to be evicted")
+	}
+	store.Set("another", "5")
+	if stats := store.Stats(); stats.Keys != 3 {
+		t.Fatalf("expected store to exceed budget when no volatile keys remain, got %+v", stats)
+	}
+}
+
+func TestKVStore_MaxMemory(t *testing.T) {
+	limit := 2 * entrySize("k1", "value")
+	store := New(WithMaxMemory(limit))
+	defer store.Close()
+
+	store.Set("k1", "value")
+	store.Set("k2", "value")
+	store.Set("k3", "value")
+
+	stats := store.Stats()
+	if stats.Bytes > limit {
+		t.Fatalf("expected memory estimate within %d bytes, got %d", limit, stats.Bytes)
+	}
+	if stats.Evicted != 1 {
+		t.Fatalf("expected 1 eviction, got %d", stats.Evicted)
+	}
+	if _, ok := store.Get("k1"); ok {
+		t.Fatalf("expected oldest key to be evicted")
+	}
+}
+
+func TestKVStore_DeleteUpdatesPolicy(t *testing.T) {
+	store := New(WithMaxEntries(2))
+	defer store.Close()
+
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Delete("a")
+	store.Set("c", "3")
+
+	if stats := store.Stats(); stats.Evicted != 0 || stats.Keys != 2 {
+		t.Fatalf("expected no eviction after delete freed space, got %+v", stats)
+	}
+}
+
+// stalePolicy wraps a policy and first offers a victim the store does not hold.
+type stalePolicy struct {
+	EvictionPolicy
+	offered bool
+}
+
+func (p *stalePolicy) Victim() (string, bool) {
+	if !p.offered {
+		p.offered = true
+		return "ghost", true
+	}
+	return p.EvictionPolicy.Victim()
+}
+
+func TestKVStore_StaleVictimNotCounted(t *testing.T) {
+	store := New(WithMaxEntries(1), WithEvictionPolicy(func() EvictionPolicy {
+		return &stalePolicy{EvictionPolicy: NewLRUPolicy()}
+	}))
+	defer store.Close()
+
+	store.Set("a", "1")
+	store.Set("b", "2")
+	if stats := store.Stats(); stats.Evicted != 1 || stats.Keys != 1 {
+		t.Fatalf("expected only the held key to count as evicted, got %+v", stats)
+	}
+}
@@ -0,0 +1,70 @@
+package kvstore
+
+import (
+	"container/heap"
+	"time"
+)
+
+// expiryEntry records when a key is due to expire.
+// Entries are never updated in place; an entry whose expiresAt no longer matches the stored item is stale and skipped.
+type expiryEntry struct {
+	key       string
+	expiresAt time.Time
+}
+
+// expiryHeap is a min-heap of expiry entries ordered by expiresAt.
+type expiryHeap []expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].expiresAt.Before(h[j].expiresAt) }
+func (h expiryHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *expiryHeap) Push(x interface{}) {
+	*h = append(*h, x.(expiryEntry))
+}
+
+func (h *expiryHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	e := old[n-1]
+	*h = old[:n-1]
+	return e
+}
+
+// startReaper runs a background goroutine that removes expired keys every sweep interval until Close is called.
+func (kv *KVStore) startReaper() {
+	ticker := time.NewTicker(kv.sweepInterval)
+	go func() {
+		defer ticker.Stop()
+		for {
+			select {
+			case <-kv.stop:
+				return
+			case <-ticker.C:
+				kv.sweep()
+			}
+		}
+	}()
+}
+
+// sweep removes every key whose expiration time has passed.
+// It returns the number of keys removed.
+func (kv *KVStore) sweep() int {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := kv.now()
+	removed := 0
+	for kv.expiries.Len() > 0 && !kv.expiries[0].expiresAt.After(now) {
+		e := heap.Pop(&kv.expiries).(expiryEntry)
+		it, ok := kv.store[e.key]
+		if !ok || !it.expiresAt.Equal(e.expiresAt) {
+			continue // key was deleted or rewritten since this entry was scheduled
+		}
+		kv.removeLocked(e.key)
+		kv.publishRemovalLocked(EventExpire, e.key)
+		removed++
+	}
+	kv.expired += uint64(removed)
+	return removed
+}
@@ -0,0 +1,60 @@
+package kvstore
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKVStore_ReaperRemovesExpiredKeys(t *testing.T) {
+	store := New(WithSweepInterval(10 * time.Millisecond))
+	defer store.Close()
+
+	store.SetWithTTL("foo", "bar", 20*time.Millisecond)
+	store.Set("keep", "me")
+
+	time.Sleep(100 * time.Millisecond)
+
+	stats := store.Stats()
+	if stats.Keys != 1 {
+		t.Fatalf("expected 1 key after reaping, got %d", stats.Keys)
+	}
+	if stats.Expired != 1 {
+		t.Fatalf("expected 1 expired key, got %d", stats.Expired)
+	}
+}
+
+func TestKVStore_SweepSkipsRewrittenKeys(t *testing.T) {
+	store := New(WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("foo", "old", 10*time.Millisecond)
+	store.Set("foo", "new")
+
+	time.Sleep(20 * time.Millisecond)
+
+	if removed := store.sweep(); removed != 0 {
+		t.Fatalf("expected stale expiry entry to be skipped, removed %d", removed)
+	}
+	val, ok := store.Get("foo")
+	if !ok || val != "new" {
+		t.Fatalf("expected rewritten key to survive, got ok=%v val=%s", ok, val)
+	}
+}
+
+func TestKVStore_SweepDisabled(t *testing.T) {
+	store := New(WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("foo", "bar", 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+
+	if _, ok := store.Get("foo"); ok {
+		t.Fatalf("expected expired key to be hidden from reads")
+	}
+	if stats := store.Stats(); stats.Keys != 1 || stats.Expired != 0 {
+		t.Fatalf("expected key to remain until swept, got %+v", stats)
+	}
+	if removed := store.sweep(); removed != 1 {
+		t.Fatalf("expected manual sweep to remove 1 key, removed %d", removed)
+	}
+}
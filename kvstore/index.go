@@ -0,0 +1,98 @@
+package kvstore
+
+import "math/rand"
+
+// Skip list parameters: each node is promoted to the next level with probability 1/skipP,
+// which keeps searches logarithmic for up to skipP^skipMaxLevel keys.
+const (
+	skipMaxLevel = 16
+	skipP        = 4
+)
+
+// skipNode is a key in the ordered index with its forward pointers, one per level.
+type skipNode struct {
+	key  string
+	next []*skipNode
+}
+
+// skiplist is an ordered set of keys, kept alongside the store's map so keys can be scanned in order.
+// It is not safe for concurrent use; the store guards it with its own lock, and read-only traversals
+// may run concurrently under the read lock.
+type skiplist struct {
+	head  skipNode
+	level int
+	len   int
+}
+
+// newSkiplist returns an empty skip list.
+func newSkiplist() *skiplist {
+	return &skiplist{head: skipNode{next: make([]*skipNode, skipMaxLevel)}, level: 1}
+}
+
+// randomLevel picks the height of a new node.
+func randomLevel() int {
+	level := 1
+	for level < skipMaxLevel && rand.Intn(skipP) == 0 {
+		level++
+	}
+	return level
+}
+
+// search fills update with the rightmost node before key at every level, and returns the first node
+// at or after key on the bottom level.
+func (l *skiplist) search(key string, update []*skipNode) *skipNode {
+	node := &l.head
+	for i := l.level - 1; i >= 0; i-- {
+		for node.next[i] != nil && node.next[i].key < key {
+			node = node.next[i]
+		}
+		if update != nil {
+			update[i] = node
+		}
+	}
+	return node.next[0]
+}
+
+// insert adds key to the list if it is not already present.
+func (l *skiplist) insert(key string) {
+	var update [skipMaxLevel]*skipNode
+	if node := l.search(key, update[:]); node != nil && node.key == key {
+		return
+	}
+
+	level := randomLevel()
+	for i := l.level; i < level; i++ {
+		update[i] = &l.head
+	}
+	if level > l.level {
+		l.level = level
+	}
+	node := &skipNode{key: key, next: make([]*skipNode, level)}
+	for i := 0; i < level; i++ {
+		node.next[i] = update[i].next[i]
+		update[i].next[i] = node
+	}
+	l.len++
+}
+
+// remove deletes key from the list, if present.
+func (l *skiplist) remove(key string) {
+	var update [skipMaxLevel]*skipNode
+	node := l.search(key, update[:])
+	if node == nil || node.key != key {
+		return
+	}
+	for i := 0; i < len(node.next); i++ {
+		update[i].next[i] = node.next[i]
+	}
+	for l.level > 1 && l.head.next[l.level-1] == nil {
+		l.level--
+	}
+	l.len--
+}
+
+// seek returns the first node whose key is at or after key, or nil if there is none.
+// Follow next[0] to visit the remaining keys in order.
+func (l *skiplist) seek(key string) *skipNode {
+	return l.search(key, nil)
+}
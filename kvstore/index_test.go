@@ -0,0 +1,58 @@
+package kvstore
+
+import (
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+func TestSkiplist_MatchesSortedSet(t *testing.T) {
+	list := newSkiplist()
+	set := make(map[string]bool)
+	for i := 0; i < 5000; i++ {
+		key := strconv.Itoa(rand.Intn(1000))
+		if rand.Intn(3) == 0 {
+			list.remove(key)
+			delete(set, key)
+		} else {
+			list.insert(key)
+			set[key] = true
+		}
+	}
+
+	want := make([]string, 0, len(set))
+	for key := range set {
+		want = append(want, key)
+	}
+	sort.Strings(want)
+
+	var got []string
+	for node := list.seek(""); node != nil; node = node.next[0] {
+		got = append(got, node.key)
+	}
+	if len(got) != len(want) || list.len != len(want) {
+		t.Fatalf("expected %d keys, got %d (len %d)", len(want), len(got), list.len)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("key %d: expected %q, got %q", i, want[i], got[i])
+		}
+	}
+}
+
+func TestSkiplist_Seek(t *testing.T) {
+	list := newSkiplist()
+	for _, key := range []string{"b", "d", "f"} {
+		list.insert(key)
+	}
+	cases := map[string]string{"": "b", "b": "b", "c": "d", "f": "f"}
+	for start, want := range cases {
+		if node := list.seek(start); node == nil || node.key != want {
+			t.Fatalf("seek(%q): expected %q, got %v", start, want, node)
+		}
+	}
+	if node := list.seek("g"); node != nil {
+		t.Fatalf("expected no key after 'f', got %q", node.key)
+	}
+}
@@ -1,52 +1,161 @@
 package kvstore
 
 import (
+	"container/heap"
 	"sync"
 	"time"
 )
 
 // item represents a key-value pair with an expiration time.
 // The value is the actual data, and expiresAt is the time when the item should be considered expired.
+// The version is assigned from the store's version counter each time the key is written.
+// A key holding a hash, list, or set has an empty value and keeps its elements in the field for its kind.
 type item struct {
 	value     string
 	expiresAt time.Time
+	version   uint64
+	kind      ValueType
+	hash      map[string]string   // TypeHash only
+	list      []string            // TypeList only
+	set       map[string]struct{} // TypeSet only
+	elemBytes int64               // total length of the collection's elements
+}
+
+// expired reports whether the item has an expiration time that is not after now.
+func (it item) expired(now time.Time) bool {
+	return !it.expiresAt.IsZero() && !now.Before(it.expiresAt)
 }
 
 // KVStore is a simple in-memory key-value store with optional expiration support.
 // It implements the Storage interface, allowing for setting, getting, and deleting key-value pairs.
+// Expired keys are removed by a background reaper; call Close to stop it.
 type KVStore struct {
-	mu    sync.RWMutex
-	store map[string]item
+	mu            sync.RWMutex
+	store         map[string]item
+	index         *skiplist // the keys of store, in order
+	expiries      expiryHeap
+	expired       uint64
+	version       uint64 // last version assigned; every write and delete advances it
+	sweepInterval time.Duration
+	now           func() time.Time
+	stop          chan struct{}
+	closeOnce     sync.Once
+	events        *eventBus
+
+	// Eviction state, used only when maxEntries or maxBytes is set.
+	policy     EvictionPolicy
+	policyMu   sync.Mutex // serializes policy calls made under the read lock
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	evicted    uint64
+
+	trackEvictions bool     // record evicted keys for a PersistentKVStore to log
+	evictions      []string // keys evicted since the last takeEvictions
 }
 
 // New creates a new instance of KVStore.
-// It initializes the store map to hold key-value pairs.
-func New() *KVStore {
-	return &KVStore{
-		store: make(map[string]item),
+// It initializes the store map to hold key-value pairs and starts the expiration reaper.
+func New(opts ...Option) *KVStore {
+	kv := newStore(opts...)
+	if kv.sweepInterval > 0 {
+		kv.startReaper()
 	}
+	return kv
 }
 
-// NewWithSize creates a new instance of KVStore with a specified initial size.
-// It initializes the store map with the given size to optimize memory allocation.
+// newStore creates a KVStore without starting its expiration reaper.
+func newStore(opts ...Option) *KVStore {
+	kv := &KVStore{
+		store:         make(map[string]item),
+		index:         newSkiplist(),
+		sweepInterval: DefaultSweepInterval,
+		now:           time.Now,
+		stop:          make(chan struct{}),
+		events:        newEventBus(),
+	}
+	for _, opt := range opts {
+		opt(kv)
+	}
+	if kv.policy == nil && (kv.maxEntries > 0 || kv.maxBytes > 0) {
+		kv.policy = NewLRUPolicy()
+	}
+	return kv
+}
+
+// Set stores a key-value pair in the store without an expiration time.
+// Any existing value and TTL for the key are replaced.
 func (kv *KVStore) Set(key, value string) {
 	kv.SetWithTTL(key, value, 0)
 }
 
 // SetWithTTL sets a key-value pair in the store with an optional time-to-live (TTL) value.
 // If the TTL is greater than zero, the item will expire after the specified duration.
+// If the store is bounded, keys are evicted according to its policy until it is back within budget.
 func (kv *KVStore) SetWithTTL(key, value string, ttl time.Duration) {
+	kv.setWithExpiry(key, value, expiryOf(ttl, time.Time{}, kv.now()), 0)
+}
+
+// SetWithExpiry stores a key-value pair that expires at an absolute time, or never if it is zero.
+func (kv *KVStore) SetWithExpiry(key, value string, expiresAt time.Time) {
+	kv.setWithExpiry(key, value, expiresAt, 0)
+}
+
+// setWithExpiry stores a key-value pair that expires at an absolute time (zero for never)
+// and returns its version. A version of zero assigns the next version from the counter.
+func (kv *KVStore) setWithExpiry(key, value string, expiresAt time.Time, version uint64) uint64 {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	var expiresAt time.Time
-	if ttl > 0 {
-		expiresAt = time.Now().Add(ttl)
+	version = kv.setLocked(key, value, expiresAt, version)
+	kv.evictLocked()
+	return version
+}
+
+// setLocked stores a key-value pair and schedules its expiry, without enforcing limits, and returns
+// its version. A version of zero assigns the next version; a given version raises the counter to it.
+// The caller must hold the write lock and call evictLocked afterwards.
+func (kv *KVStore) setLocked(key, value string, expiresAt time.Time, version uint64) uint64 {
+	if version == 0 {
+		version = kv.version + 1
 	}
+	kv.observeVersionLocked(version)
 
-	kv.store[key] = item{
+	// An unchanged expiry, as when a counter is incremented, is already scheduled.
+	if old, ok := kv.store[key]; !expiresAt.IsZero() && !(ok && old.expiresAt.Equal(expiresAt)) {
+		heap.Push(&kv.expiries, expiryEntry{key: key, expiresAt: expiresAt})
+	}
+
+	kv.putLocked(key, item{
 		value:     value,
 		expiresAt: expiresAt,
+		version:   version,
+	})
+	kv.events.publish(Event{Type: EventPut, Key: key, Value: value, Revision: version})
+	return version
+}
+
+// currentVersion returns the last version assigned by the store.
+func (kv *KVStore) currentVersion() uint64 {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return kv.version
+}
+
+// observeVersion raises the version counter to at least version.
+func (kv *KVStore) observeVersion(version uint64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.observeVersionLocked(version)
+}
+
+// observeVersionLocked raises the version counter to at least version.
+// The caller must hold the write lock.
+func (kv *KVStore) observeVersionLocked(version uint64) {
+	if version > kv.version {
+		kv.version = version
 	}
 }
 
@@ -56,34 +165,110 @@ func (kv *KVStore) Get(key string) (string, bool) {
 	kv.mu.RLock()
 	defer kv.mu.RUnlock()
 
+	it, ok := kv.getLocked(key, kv.now())
+	return it.value, ok
+}
+
+// GetWithVersion retrieves the value and current version of the given key.
+// If the key does not exist or has expired, it returns an empty string, zero, and false.
+func (kv *KVStore) GetWithVersion(key string) (string, uint64, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	it, ok := kv.getLocked(key, kv.now())
+	return it.value, it.version, ok
+}
+
+// getLocked looks up a live key and records the access with the eviction policy.
+// The caller must hold the read or write lock.
+func (kv *KVStore) getLocked(key string, now time.Time) (item, bool) {
 	it, ok := kv.store[key]
-	if !ok {
-		return "", false
+	if !ok || it.expired(now) {
+		return item{}, false
 	}
-	if !it.expiresAt.IsZero() && time.Now().After(it.expiresAt) {
-		go kv.deleteKeyAsync(key)
-		return "", false
+	if kv.policy != nil {
+		kv.policyMu.Lock()
+		kv.policy.Access(key)
+		kv.policyMu.Unlock()
 	}
-	return it.value, true
+	return it, true
 }
 
 // Delete removes the key-value pair associated with the given key from the store.
-// It returns true if the key was found and deleted, or false if the key did not exist.
+// It returns true if the key was found and deleted, or false if the key did not exist or had already expired.
 func (kv *KVStore) Delete(key string) bool {
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
-	if _, ok := kv.store[key]; ok {
-		delete(kv.store, key)
-		return true
+	return kv.deleteLocked(key, kv.now())
+}
+
+// deleteLocked removes a key, reporting whether it was present and unexpired.
+// Removing the key advances the version counter and publishes a delete event, or an expire
+// event if it had already expired. The caller must hold the write lock.
+func (kv *KVStore) deleteLocked(key string, now time.Time) bool {
+	it, ok := kv.store[key]
+	if !ok {
+		return false
+	}
+	kv.removeLocked(key)
+	if it.expired(now) {
+		kv.publishRemovalLocked(EventExpire, key)
+		return false
 	}
-	return false
+	kv.publishRemovalLocked(EventDelete, key)
+	return true
 }
 
-// deleteKeyAsync is a helper function that deletes a key-value pair asynchronously.
-// It is called when a key has expired and needs to be removed from the store.
-func (kv *KVStore) deleteKeyAsync(key string) {
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
+// putLocked stores an item and updates eviction bookkeeping.
+// The caller must hold the write lock.
+func (kv *KVStore) putLocked(key string, it item) {
+	if old, ok := kv.store[key]; ok {
+		kv.bytes -= old.size(key)
+	} else {
+		kv.index.insert(key)
+	}
+	kv.store[key] = it
+	kv.bytes += it.size(key)
+	if kv.policy != nil {
+		kv.policy.Add(key, it.expiresAt)
+	}
+}
+
+// removeLocked deletes a key and updates eviction bookkeeping.
+// The caller must hold the write lock.
+func (kv *KVStore) removeLocked(key string) {
+	it, ok := kv.store[key]
+	if !ok {
+		return
+	}
 	delete(kv.store, key)
+	kv.index.remove(key)
+	kv.bytes -= it.size(key)
+	if kv.policy != nil {
+		kv.policy.Remove(key)
+	}
+}
+
+// Stats returns the current key count, memory estimate, and expiration and eviction counters.
+func (kv *KVStore) Stats() Stats {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	return Stats{
+		Keys:    len(kv.store),
+		Bytes:   kv.bytes,
+		Expired: kv.expired,
+		Evicted: kv.evicted,
+	}
+}
+
+// Close stops the background expiration reaper and cancels every watcher.
+// The store remains usable afterwards, but expired keys are no longer removed.
+func (kv *KVStore) Close() error {
+	kv.closeOnce.Do(func() {
+		close(kv.stop)
+		kv.events.close()
+	})
+	return nil
 }
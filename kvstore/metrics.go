@@ -0,0 +1,31 @@
+package kvstore
+
+import "github.com/ahmad-masud/KVStore/metrics"
+
+// persistenceMetrics is implemented by stores with a persistence log.
+type persistenceMetrics interface {
+	PersistenceStats() PersistenceStats
+	SyncLatencies() metrics.HistogramSnapshot
+	CompactionDurations() metrics.HistogramSnapshot
+}
+
+// WriteMetrics adds a store's metrics to e, with the given label name, value pairs.
+// It reports what the store exposes through Stats and, for persistent stores, PersistenceStats,
+// SyncLatencies, and CompactionDurations. Other backends add nothing.
+func WriteMetrics(e *metrics.Exposition, storage Storage, labels ...string) {
+	if provider, ok := storage.(StatsProvider); ok {
+		stats := provider.Stats()
+		e.Gauge("kvstore_keys", "Number of keys held, including expired keys not yet reaped.", float64(stats.Keys), labels...)
+		e.Gauge("kvstore_memory_bytes", "Estimated memory used by keys and values.", float64(stats.Bytes), labels...)
+		e.Counter("kvstore_expired_keys_total", "Keys removed by the expiration reaper.", float64(stats.Expired), labels...)
+		e.Counter("kvstore_evicted_keys_total", "Keys removed by the eviction policy.", float64(stats.Evicted), labels...)
+	}
+	if provider, ok := storage.(persistenceMetrics); ok {
+		stats := provider.PersistenceStats()
+		e.Gauge("kvstore_log_size_bytes", "Total size of the persistence log segments.", float64(stats.LogSize), labels...)
+		e.Gauge("kvstore_log_segments", "Number of live persistence log segments.", float64(stats.Segments), labels...)
+		e.Histogram("kvstore_fsync_duration_seconds", "Time taken to fsync the persistence log.", provider.SyncLatencies(), labels...)
+		e.Histogram("kvstore_compaction_duration_seconds", "Time taken by successful log compactions.", provider.CompactionDurations(), labels...)
+		e.Counter("kvstore_compaction_errors_total", "Log compactions that failed.", float64(stats.CompactionErrors), labels...)
+	}
+}
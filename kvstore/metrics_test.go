@@ -0,0 +1,49 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ahmad-masud/KVStore/metrics"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	store, err := NewPersistentKVStore(filepath.Join(t.TempDir(), "kv.log"), false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	store.Set("a", "1")
+	store.Set("b", "2")
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+
+	e := metrics.NewExposition()
+	WriteMetrics(e, store, "namespace", "team-a")
+	var b strings.Builder
+	e.WriteTo(&b)
+	out := b.String()
+
+	for _, want := range []string{
+		`kvstore_keys{namespace="team-a"} 2`,
+		`kvstore_expired_keys_total{namespace="team-a"} 0`,
+		`kvstore_log_segments{namespace="team-a"} 2`,
+		`kvstore_fsync_duration_seconds_count{namespace="team-a"} 2`,
+		`kvstore_compaction_duration_seconds_count{namespace="team-a"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestWriteMetrics_NoStats(t *testing.T) {
+	e := metrics.NewExposition()
+	WriteMetrics(e, Storage(nil))
+	var b strings.Builder
+	if e.WriteTo(&b); b.Len() != 0 {
+		t.Fatalf("expected no metrics for a backend without stats, got:\n%s", b.String())
+	}
+}
@@ -0,0 +1,261 @@
+package kvstore
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+)
+
+var (
+	// ErrNamespaceExists is returned by Namespaces.Create when the name is already in use.
+	ErrNamespaceExists = errors.New("kvstore: namespace already exists")
+	// ErrNamespaceNotFound is returned by Namespaces.Drop when there is no namespace with the name.
+	ErrNamespaceNotFound = errors.New("kvstore: namespace not found")
+	// ErrInvalidNamespace is returned for a name that is empty, too long, or has characters other than
+	// letters, digits, '.', '_', and '-'.
+	ErrInvalidNamespace = errors.New("kvstore: invalid namespace name")
+	// ErrQuotaExceeded is returned by Namespace.Admit for a write that would take a namespace beyond
+	// its key or byte limit.
+	ErrQuotaExceeded = errors.New("kvstore: namespace quota exceeded")
+)
+
+// namespaceName matches valid namespace names. They double as directory names for persistent namespaces.
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-][A-Za-z0-9_.-]{0,63}$`)
+
+// Quota limits a namespace. A zero field means no limit. Namespace.Admit enforces the key and byte
+// limits, and the server enforces the ops/sec limit.
+type Quota struct {
+	MaxKeys         int     `json:"max_keys,omitempty"`
+	MaxBytes        int64   `json:"max_bytes,omitempty"`
+	MaxOpsPerSecond float64 `json:"max_ops_per_second,omitempty"`
+}
+
+// Namespace is an isolated keyspace with its own storage backend.
+type Namespace struct {
+	Name    string
+	Quota   Quota
+	Storage Storage
+
+	mu sync.Mutex // serializes admitted writes
+}
+
+// Write is a key that a write stores a value or collection elements at, and their size in bytes.
+type Write struct {
+	Key  string
+	Size int64
+}
+
+// Admit runs write if the keys and bytes it adds fit within the namespace's key and byte limits, and
+// returns ErrQuotaExceeded otherwise. A key is added if it does not exist yet; the bytes added are the
+// sizes of writes, plus each added key and its overhead, less the string values they overwrite.
+// Admitted writes run one at a time, so concurrent writes cannot together exceed the limits.
+// Writes made directly on Storage are not checked.
+func (ns *Namespace) Admit(writes []Write, write func()) error {
+	provider, ok := ns.Storage.(StatsProvider)
+	if !ok || (ns.Quota.MaxKeys <= 0 && ns.Quota.MaxBytes <= 0) {
+		write()
+		return nil
+	}
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+
+	sizes := make(map[string]int64, len(writes))
+	for _, w := range writes {
+		sizes[w.Key] += w.Size
+	}
+	added, grown := 0, int64(0)
+	for key, size := range sizes {
+		if _, found := ns.Storage.TTL(key); !found {
+			added++
+			grown += entrySize(key, "") + size
+			continue
+		}
+		old, _ := ns.Storage.Get(key)
+		grown += size - int64(len(old))
+	}
+
+	stats := provider.Stats()
+	if ns.Quota.MaxKeys > 0 && added > 0 && stats.Keys+added > ns.Quota.MaxKeys {
+		return fmt.Errorf("%w: namespace %q is at its limit of %d keys", ErrQuotaExceeded, ns.Name, ns.Quota.MaxKeys)
+	}
+	if ns.Quota.MaxBytes > 0 && grown > 0 && stats.Bytes+grown > ns.Quota.MaxBytes {
+		return fmt.Errorf("%w: namespace %q would exceed its limit of %d bytes", ErrQuotaExceeded, ns.Name, ns.Quota.MaxBytes)
+	}
+	write()
+	return nil
+}
+
+// Namespaces holds a set of namespaces, each in its own storage backend, so that keys in one
+// namespace never collide with keys in another. It is safe for concurrent use.
+type Namespaces struct {
+	mu     sync.RWMutex
+	spaces map[string]*Namespace
+
+	open   func(name string) (Storage, error) // creates or reopens a namespace's storage
+	remove func(name string) error            // deletes a dropped namespace's data
+	save   func(quotas map[string]Quota) error
+}
+
+// NewNamespaces creates an in-memory set of namespaces, each a KVStore created with opts.
+func NewNamespaces(opts ...Option) *Namespaces {
+	return &Namespaces{
+		spaces: make(map[string]*Namespace),
+		open: func(string) (Storage, error) {
+			return New(opts...), nil
+		},
+		remove: func(string) error { return nil },
+		save:   func(map[string]Quota) error { return nil },
+	}
+}
+
+// OpenNamespaces opens a set of persistent namespaces in dir, reopening any that already exist.
+// Each namespace is a PersistentKVStore logging to "<dir>/<name>/kv.log", created with compact
+// and opts, and the names and quotas are kept in "<dir>/namespaces.json".
+func OpenNamespaces(dir string, compact bool, opts ...PersistentOption) (*Namespaces, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create namespace directory: %w", err)
+	}
+	manifest := filepath.Join(dir, "namespaces.json")
+	n := &Namespaces{
+		spaces: make(map[string]*Namespace),
+		open: func(name string) (Storage, error) {
+			return NewPersistentKVStore(filepath.Join(dir, name, "kv.log"), compact, opts...)
+		},
+		remove: func(name string) error {
+			return os.RemoveAll(filepath.Join(dir, name))
+		},
+		save: func(quotas map[string]Quota) error {
+			data, err := json.MarshalIndent(quotas, "", "  ")
+			if err != nil {
+				return err
+			}
+			return writeFileAtomic(manifest, data)
+		},
+	}
+
+	data, err := os.ReadFile(manifest)
+	if errors.Is(err, os.ErrNotExist) {
+		return n, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read namespace manifest: %w", err)
+	}
+	var quotas map[string]Quota
+	if err := json.Unmarshal(data, &quotas); err != nil {
+		return nil, fmt.Errorf("failed to parse namespace manifest: %w", err)
+	}
+	// Names become directory names, so check them all before touching the filesystem.
+	for name := range quotas {
+		if !namespaceName.MatchString(name) {
+			return nil, fmt.Errorf("invalid namespace %q in manifest: %w", name, ErrInvalidNamespace)
+		}
+	}
+	for name, quota := range quotas {
+		storage, err := n.open(name)
+		if err != nil {
+			n.Close()
+			return nil, fmt.Errorf("failed to open namespace %q: %w", name, err)
+		}
+		n.spaces[name] = &Namespace{Name: name, Quota: quota, Storage: storage}
+	}
+	return n, nil
+}
+
+// Create adds an empty namespace with the given quota.
+func (n *Namespaces) Create(name string, quota Quota) (*Namespace, error) {
+	if !namespaceName.MatchString(name) {
+		return nil, ErrInvalidNamespace
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if _, ok := n.spaces[name]; ok {
+		return nil, ErrNamespaceExists
+	}
+	// Clear out data left by a drop that was interrupted after the manifest was saved.
+	if err := n.remove(name); err != nil {
+		return nil, err
+	}
+	storage, err := n.open(name)
+	if err != nil {
+		return nil, err
+	}
+	ns := &Namespace{Name: name, Quota: quota, Storage: storage}
+	n.spaces[name] = ns
+	if err := n.saveLocked(); err != nil {
+		delete(n.spaces, name)
+		storage.Close()
+		return nil, err
+	}
+	return ns, nil
+}
+
+// Get returns the namespace with the given name.
+func (n *Namespaces) Get(name string) (*Namespace, bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	ns, ok := n.spaces[name]
+	return ns, ok
+}
+
+// List returns every namespace, ordered by name.
+func (n *Namespaces) List() []*Namespace {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	list := make([]*Namespace, 0, len(n.spaces))
+	for _, ns := range n.spaces {
+		list = append(list, ns)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list
+}
+
+// Drop closes a namespace's storage and deletes its keys. Operations still using the
+// namespace's storage may fail.
+func (n *Namespaces) Drop(name string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ns, ok := n.spaces[name]
+	if !ok {
+		return ErrNamespaceNotFound
+	}
+	delete(n.spaces, name)
+	if err := n.saveLocked(); err != nil {
+		n.spaces[name] = ns
+		return err
+	}
+	if err := ns.Storage.Close(); err != nil {
+		return err
+	}
+	return n.remove(name)
+}
+
+// Close closes the storage of every namespace.
+func (n *Namespaces) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var err error
+	for _, ns := range n.spaces {
+		if closeErr := ns.Storage.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// saveLocked records the current names and quotas. The caller must hold the write lock.
+func (n *Namespaces) saveLocked() error {
+	quotas := make(map[string]Quota, len(n.spaces))
+	for name, ns := range n.spaces {
+		quotas[name] = ns.Quota
+	}
+	return n.save(quotas)
+}
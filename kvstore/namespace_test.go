@@ -0,0 +1,167 @@
+package kvstore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestNamespaces_Isolation(t *testing.T) {
+	namespaces := NewNamespaces()
+	defer namespaces.Close()
+
+	a, err := namespaces.Create("team-a", Quota{MaxKeys: 10})
+	if err != nil {
+		t.Fatalf("failed to create namespace: %v", err)
+	}
+	b, _ := namespaces.Create("team-b", Quota{})
+
+	a.Storage.Set("config", "a")
+	b.Storage.Set("config", "b")
+	if val, _ := a.Storage.Get("config"); val != "a" {
+		t.Fatalf("expected team-a to keep its own value, got %q", val)
+	}
+	if val, _ := b.Storage.Get("config"); val != "b" {
+		t.Fatalf("expected team-b to keep its own value, got %q", val)
+	}
+
+	if _, err := namespaces.Create("team-a", Quota{}); !errors.Is(err, ErrNamespaceExists) {
+		t.Fatalf("expected ErrNamespaceExists, got %v", err)
+	}
+	for _, name := range []string{"", "..", "a/b", ".hidden"} {
+		if _, err := namespaces.Create(name, Quota{}); !errors.Is(err, ErrInvalidNamespace) {
+			t.Fatalf("expected ErrInvalidNamespace for %q, got %v", name, err)
+		}
+	}
+
+	list := namespaces.List()
+	if len(list) != 2 || list[0].Name != "team-a" || list[1].Name != "team-b" || list[0].Quota.MaxKeys != 10 {
+		t.Fatalf("unexpected namespaces: %+v", list)
+	}
+
+	if err := namespaces.Drop("team-a"); err != nil {
+		t.Fatalf("failed to drop namespace: %v", err)
+	}
+	if _, ok := namespaces.Get("team-a"); ok {
+		t.Fatalf("expected the dropped namespace to be gone")
+	}
+	if err := namespaces.Drop("team-a"); !errors.Is(err, ErrNamespaceNotFound) {
+		t.Fatalf("expected ErrNamespaceNotFound, got %v", err)
+	}
+}
+
+func TestNamespaces_Persistent(t *testing.T) {
+	dir := t.TempDir()
+	namespaces, err := OpenNamespaces(dir, false)
+	if err != nil {
+		t.Fatalf("failed to open namespaces: %v", err)
+	}
+	a, _ := namespaces.Create("team-a", Quota{MaxBytes: 1 << 20, MaxOpsPerSecond: 100})
+	a.Storage.Set("config", "a")
+	dropped, _ := namespaces.Create("dropped", Quota{})
+	dropped.Storage.Set("config", "old")
+	if err := namespaces.Drop("dropped"); err != nil {
+		t.Fatalf("failed to drop namespace: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "dropped")); !os.IsNotExist(err) {
+		t.Fatalf("expected the dropped namespace's data to be deleted, got %v", err)
+	}
+	namespaces.Close()
+
+	namespaces, err = OpenNamespaces(dir, false)
+	if err != nil {
+		t.Fatalf("failed to reopen namespaces: %v", err)
+	}
+	defer namespaces.Close()
+
+	a, ok := namespaces.Get("team-a")
+	if !ok {
+		t.Fatalf("expected team-a to survive a restart")
+	}
+	if want := (Quota{MaxBytes: 1 << 20, MaxOpsPerSecond: 100}); a.Quota != want {
+		t.Fatalf("expected quota %+v after restart, got %+v", want, a.Quota)
+	}
+	if val, _ := a.Storage.Get("config"); val != "a" {
+		t.Fatalf("expected team-a's keys to survive a restart, got %q", val)
+	}
+	if _, ok := namespaces.Get("dropped"); ok {
+		t.Fatalf("expected the dropped namespace to stay dropped")
+	}
+
+	// Re-creating a dropped name starts empty.
+	again, _ := namespaces.Create("dropped", Quota{})
+	if _, ok := again.Storage.Get("config"); ok {
+		t.Fatalf("expected a re-created namespace to start empty")
+	}
+}
+
+func TestOpenNamespaces_InvalidManifest(t *testing.T) {
+	dir := t.TempDir()
+	manifest := []byte(`{"team-a": {}, "../outside": {}}`)
+	if err := os.WriteFile(filepath.Join(dir, "namespaces.json"), manifest, 0644); err != nil {
+		t.Fatalf("failed to write manifest: %v", err)
+	}
+	if _, err := OpenNamespaces(dir, false); !errors.Is(err, ErrInvalidNamespace) {
+		t.Fatalf("expected ErrInvalidNamespace for a manifest name outside the directory, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(filepath.Dir(dir), "outside")); !os.IsNotExist(err) {
+		t.Fatalf("expected nothing to be created outside the directory, got %v", err)
+	}
+}
+
+func TestNamespace_Admit(t *testing.T) {
+	namespaces := NewNamespaces()
+	defer namespaces.Close()
+	ns, _ := namespaces.Create("team-a", Quota{MaxKeys: 10, MaxBytes: 1000})
+	set := func(key, value string) error {
+		return ns.Admit([]Write{{Key: key, Size: int64(len(value))}}, func() { ns.Storage.Set(key, value) })
+	}
+
+	if err := set("big", strings.Repeat("x", 1000)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected a value larger than the byte limit to be refused, got %v", err)
+	}
+	if err := set("a", strings.Repeat("x", 800)); err != nil {
+		t.Fatalf("expected a value within the byte limit to fit, got %v", err)
+	}
+	if err := set("a", strings.Repeat("y", 800)); err != nil {
+		t.Fatalf("expected an overwrite of the same size to fit, got %v", err)
+	}
+	if err := set("b", strings.Repeat("x", 100)); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("expected a write that would cross the byte limit to be refused, got %v", err)
+	}
+	if _, ok := ns.Storage.Get("b"); ok {
+		t.Fatalf("expected a refused write not to run")
+	}
+}
+
+func TestNamespace_AdmitConcurrent(t *testing.T) {
+	namespaces := NewNamespaces()
+	defer namespaces.Close()
+	keys, _ := namespaces.Create("keys", Quota{MaxKeys: 20})
+	bytes, _ := namespaces.Create("bytes", Quota{MaxBytes: 2000})
+
+	var wg sync.WaitGroup
+	for _, ns := range []*Namespace{keys, bytes} {
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(ns *Namespace, i int) {
+				defer wg.Done()
+				key, value := fmt.Sprintf("k%03d", i), "0123456789"
+				ns.Admit([]Write{{Key: key, Size: int64(len(value))}}, func() { ns.Storage.Set(key, value) })
+			}(ns, i)
+		}
+	}
+	wg.Wait()
+
+	if stats := keys.Storage.(StatsProvider).Stats(); stats.Keys != 20 {
+		t.Fatalf("expected concurrent writes to fill the key limit exactly, got %d keys", stats.Keys)
+	}
+	stats := bytes.Storage.(StatsProvider).Stats()
+	if want := 2000 / entrySize("k000", "0123456789"); stats.Bytes > 2000 || int64(stats.Keys) != want {
+		t.Fatalf("expected concurrent writes to fill the byte limit without exceeding it, got %d keys and %d bytes", stats.Keys, stats.Bytes)
+	}
+}
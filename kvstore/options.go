@@ -0,0 +1,60 @@
+package kvstore
+
+import "time"
+
+// DefaultSweepInterval is how often the background reaper removes expired keys
+// when no interval is configured.
+const DefaultSweepInterval = time.Second
+
+// Option configures a KVStore.
+type Option func(*KVStore)
+
+// WithSweepInterval sets how often the background reaper removes expired keys.
+// A zero or negative interval disables the reaper; expired keys are then only hidden from reads.
+func WithSweepInterval(interval time.Duration) Option {
+	return func(kv *KVStore) {
+		kv.sweepInterval = interval
+	}
+}
+
+// WithClock sets the function the store uses to read the current time.
+// It is intended for tests that need to control expiration.
+func WithClock(now func() time.Time) Option {
+	return func(kv *KVStore) {
+		kv.now = now
+	}
+}
+
+// WithMaxEntries bounds the number of keys the store holds.
+// When the limit is exceeded, keys are evicted according to the eviction policy (LRU by default).
+func WithMaxEntries(n int) Option {
+	return func(kv *KVStore) {
+		kv.maxEntries = n
+	}
+}
+
+// WithMaxMemory bounds the estimated memory, in bytes, used by keys and values.
+// When the limit is exceeded, keys are evicted according to the eviction policy (LRU by default).
+func WithMaxMemory(bytes int64) Option {
+	return func(kv *KVStore) {
+		kv.maxBytes = bytes
+	}
+}
+
+// WithEvictionPolicy sets the policy used to pick keys to evict when the store is over budget.
+// It takes a constructor such as NewLFUPolicy so that every shard of a ShardedKVStore gets its own policy.
+func WithEvictionPolicy(newPolicy func() EvictionPolicy) Option {
+	return func(kv *KVStore) {
+		kv.policy = newPolicy()
+	}
+}
+
+// PersistentOption configures a PersistentKVStore.
+type PersistentOption func(*PersistentKVStore)
+
+// WithStoreOptions sets the options used to create the in-memory store behind a PersistentKVStore.
+func WithStoreOptions(opts ...Option) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.storeOpts = append(p.storeOpts, opts...)
+	}
+}
@@ -2,52 +2,139 @@ package kvstore
 
 import (
 	"bufio"
+	"bytes"
+	"context"
+	"errors"
 	"fmt"
+	"io"
+	"math"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"github.com/ahmad-masud/KVStore/metrics"
 )
 
 // PersistentKVStore wraps a KVStore and adds disk persistence.
-// It writes every Set and Delete operation to a log file and replays the log on startup.
+// It writes every Set and Delete operation to a segmented, binary write-ahead log and replays the log on startup.
 type PersistentKVStore struct {
-	memStore *KVStore   // in-memory store
-	logFile  *os.File   // append-only log file
-	mu       sync.Mutex // protects logFile writes
+	memStore  *KVStore       // in-memory store
+	logFile   *os.File       // active log segment, opened for appending
+	logPath   string         // base path of the log; segments, manifest, and snapshot live next to it
+	mu        sync.Mutex     // orders memory updates and log writes
+	size      int64          // active segment size, guarded by mu
+	storeOpts []Option       // options for the in-memory store
+	done      chan struct{}  // closed by Close to stop background goroutines
+	wg        sync.WaitGroup // tracks background goroutines
+	closeOnce sync.Once
+
+	// Segment state, guarded by mu; see segment.go.
+	segments      []string // live segment names in replay order; the last is active
+	segmentSize   int64
+	sealedSize    int64 // total size of sealed segments
+	nextSegmentID uint64
+
+	snapMu           sync.Mutex // serializes snapshots and compaction
+	snapshotInterval time.Duration
+	onError          func(error) // reports failures of background work
+
+	// Compaction state; see compaction.go.
+	compactionInterval time.Duration
+	compactionRatio    float64
+	compactedSize      int64 // log size after the last compaction, guarded by snapMu
+	compactions        atomic.Uint64
+	compactionErrors   atomic.Uint64
+	lastCompaction     atomic.Int64 // nanoseconds
+	compactionDuration *metrics.Histogram
+
+	// Durability state; see durability.go.
+	syncPolicy   SyncPolicy
+	syncInterval time.Duration
+	syncMu       sync.Mutex // held while fsyncing, so concurrent writers share one fsync
+	written      uint64     // sequence number of the last appended record, guarded by mu
+	synced       uint64     // sequence number of the last fsynced record, guarded by syncMu
+	syncCount    uint64     // number of fsyncs issued, guarded by syncMu
+	syncErr      error      // set once an fsync fails, guarded by syncMu
+	syncLatency  *metrics.Histogram
+
+	failed error // set once a log write or fsync fails, after which writes are refused; guarded by mu
+
+	loggedVersion uint64 // version counter as of the last logged record, guarded by mu
 }
 
+// ErrStoreFailed is returned once a PersistentKVStore can no longer write its log.
+// The store refuses every later write; reopen it to recover from the log.
+var ErrStoreFailed = errors.New("kvstore: persistence log failed")
+
 // NewPersistentKVStore creates a new PersistentKVStore, replaying any existing log to rebuild the in-memory store.
-// The logPath specifies the file to be used for persistence.
-func NewPersistentKVStore(logPath string, compact bool) (*PersistentKVStore, error) {
+// The logPath specifies the file to be used for persistence; log segments, the manifest, and snapshots are stored next to it.
+// A torn record at the end of the log is truncated, and a log in the legacy text format is migrated to the binary format.
+// Keys whose absolute expiry time has already passed are not restored.
+func NewPersistentKVStore(logPath string, compact bool, opts ...PersistentOption) (*PersistentKVStore, error) {
 	dir := filepath.Dir(logPath)
 	if err := os.MkdirAll(dir, 0755); err != nil {
 		return nil, fmt.Errorf("failed to create directory for persistence: %w", err)
 	}
 
-	file, err := os.OpenFile(logPath, os.O_CREATE|os.O_RDWR|os.O_APPEND, 0644)
-	if err != nil {
-		return nil, fmt.Errorf("failed to open persistence file: %w", err)
-	}
-
-	store := New()
 	p := &PersistentKVStore{
-		memStore: store,
-		logFile:  file,
+		logPath:      logPath,
+		done:         make(chan struct{}),
+		segmentSize:  DefaultSegmentSize,
+		syncPolicy:   SyncAlways,
+		syncInterval: DefaultSyncInterval,
+		onError:      func(error) {},
+
+		compactionInterval: DefaultCompactionInterval,
+		compactionDuration: metrics.NewHistogram(),
+		syncLatency:        metrics.NewHistogram(),
 	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	// The store's expirations are swept by the persistent store, so that they can be logged.
+	store := newStore(p.storeOpts...)
+	p.memStore = store
+
+	// Replay without evicting: the log records evictions as deletes, and the eviction policy has not
+	// seen the reads that chose them.
+	maxEntries, maxBytes := store.maxEntries, store.maxBytes
+	store.maxEntries, store.maxBytes = 0, 0
 
 	// Replay the existing log to rebuild memory state
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		line := scanner.Text()
-		p.replayLine(line)
-	}
-	if err := scanner.Err(); err != nil {
-		return nil, fmt.Errorf("error reading persistence file: %w", err)
+	if err := p.load(); err != nil {
+		if p.logFile != nil {
+			p.logFile.Close()
+		}
+		store.Close()
+		return nil, err
 	}
+	// Replay rebuilt the store without its expirations, so watchers cannot resume from before the restart.
+	store.events.reset(store.currentVersion())
+	p.loggedVersion = store.currentVersion()
+
+	// A log written before evictions were logged, or with a larger budget, may not fit; evict and log
+	// the difference.
+	store.maxEntries, store.maxBytes = maxEntries, maxBytes
+	store.trackEvictions = true
+	store.enforceBudget()
+	p.mu.Lock()
+	p.logVersionLocked()
+	p.mu.Unlock()
 
+	if store.sweepInterval > 0 {
+		p.every(store.sweepInterval, p.sweep)
+	}
+	if p.syncPolicy == SyncInterval {
+		p.startSyncer()
+	}
+	if p.snapshotInterval > 0 {
+		p.startSnapshots()
+	}
+	p.compactedSize = p.sealedSize + p.size
 	if compact {
 		p.StartLogCompaction()
 	}
@@ -55,113 +142,357 @@ func NewPersistentKVStore(logPath string, compact bool) (*PersistentKVStore, err
 	return p, nil
 }
 
-// Compacts the log file by deleting unnecessary entries and keeping only the newest entry for each key.
-func (p *PersistentKVStore) compactLogs() {
-	p.mu.Lock()
-	defer p.mu.Unlock()
+// load replays the log segments into the in-memory store, starting from the latest valid snapshot if there is one.
+// A log without a manifest is adopted as the first segment, after migrating it from the legacy text format if needed.
+// A torn final record in the active segment is truncated.
+func (p *PersistentKVStore) load() error {
+	segments, err := readManifest(manifestPath(p.logPath))
+	if os.IsNotExist(err) {
+		if err := p.initLog(); err != nil {
+			return err
+		}
+		segments = []string{filepath.Base(p.logPath)}
+		if err := writeManifest(manifestPath(p.logPath), segments); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return fmt.Errorf("error reading log manifest: %w", err)
+	}
+	p.segments = segments
+	for _, name := range segments {
+		if id, ok := segmentID(p.logPath, name); ok && id >= p.nextSegmentID {
+			p.nextSegmentID = id + 1
+		}
+	}
+	p.removeOrphanSegments()
+
+	first, start := 0, int64(walHeaderSize)
+	if i, offset, ok := p.loadSnapshot(); ok {
+		first, start = i, offset
+	}
 
-	p.logFile.Sync()
-	p.logFile.Seek(0, 0) // rewind to start
+	for i, name := range segments {
+		path := p.segmentPath(name)
+		active := i == len(segments)-1
+		if i < first {
+			info, err := os.Stat(path)
+			if err != nil {
+				return fmt.Errorf("failed to open log segment: %w", err)
+			}
+			p.sealedSize += info.Size()
+			continue
+		}
 
-	scanner := bufio.NewScanner(p.logFile)
-	latestOps := make(map[string]string)
+		file, size, err := openSegment(path, active)
+		if err != nil {
+			return err
+		}
+		from := int64(walHeaderSize)
+		if i == first {
+			from = start
+		}
+		if _, err := file.Seek(from, io.SeekStart); err != nil {
+			file.Close()
+			return fmt.Errorf("error reading log segment: %w", err)
+		}
+		valid, err := replayWAL(file, size-from, func(rec record) { p.memStore.apply(rec) })
+		if err != nil {
+			file.Close()
+			return fmt.Errorf("error reading log segment %s: %w", name, err)
+		}
+		end := from + valid
 
-	// Read all operations, remember only latest per key
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.SplitN(line, " ", 4)
-		if len(parts) < 2 {
+		if !active {
+			file.Close()
+			if end < size {
+				return fmt.Errorf("%w: sealed segment %s is truncated", ErrCorruptLog, name)
+			}
+			p.sealedSize += size
 			continue
 		}
-		key := parts[1]
-		latestOps[key] = line
+
+		p.logFile = file
+		p.size = end
+		if end < size {
+			if err := file.Truncate(end); err != nil {
+				return fmt.Errorf("failed to truncate torn log record: %w", err)
+			}
+			if err := file.Sync(); err != nil {
+				return fmt.Errorf("failed to sync persistence file: %w", err)
+			}
+		}
 	}
+	return nil
+}
 
-	if err := scanner.Err(); err != nil {
-		return
+// initLog prepares the file at logPath to become the first log segment.
+// It creates the file with a header if it is new, and migrates a log written in the legacy text format.
+func (p *PersistentKVStore) initLog() error {
+	file, err := os.OpenFile(p.logPath, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open persistence file: %w", err)
 	}
+	defer file.Close()
 
-	// Write to a temporary file (different path)
-	oldPath := p.logFile.Name()
-	tempPath := oldPath + ".tmp"
+	info, err := file.Stat()
+	if err != nil {
+		return fmt.Errorf("error reading persistence file: %w", err)
+	}
+	header := make([]byte, walHeaderSize)
+	n, err := io.ReadFull(file, header)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return fmt.Errorf("error reading persistence file: %w", err)
+	}
+	header = header[:n]
+
+	switch {
+	case info.Size() < int64(walHeaderSize) && bytes.HasPrefix(walHeader(), header):
+		// New file, or a crash while writing the header
+		return writeSegmentHeader(file)
+	case !bytes.HasPrefix(header, []byte(walMagic)):
+		return p.migrateTextLog(file)
+	}
+	return nil
+}
+
+// migrateTextLog converts a log written in the legacy "SET key value" text format
+// and atomically replaces it with an equivalent binary log.
+func (p *PersistentKVStore) migrateTextLog(file *os.File) error {
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return fmt.Errorf("error reading persistence file: %w", err)
+	}
 
+	oldPath := p.logPath
+	tempPath := oldPath + ".tmp"
 	tempFile, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
 	if err != nil {
-		return
+		return fmt.Errorf("failed to create migrated log: %w", err)
 	}
+	defer os.Remove(tempPath) // no-op once renamed
+
 	writer := bufio.NewWriter(tempFile)
-	for _, line := range latestOps {
-		writer.WriteString(line + "\n")
+	writer.Write(walHeader())
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		rec, ok := parseTextLine(scanner.Text())
+		if !ok {
+			continue
+		}
+		writer.Write(p.memStore.absolute(rec).marshal())
+	}
+	if err := scanner.Err(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("error reading persistence file: %w", err)
+	}
+	if err := writer.Flush(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to write migrated log: %w", err)
+	}
+	if err := tempFile.Sync(); err != nil {
+		tempFile.Close()
+		return fmt.Errorf("failed to sync migrated log: %w", err)
 	}
-	writer.Flush()
-	tempFile.Sync()
 	tempFile.Close()
 
-	// Atomically replace old file with new one
-	p.logFile.Close()
-	err = os.Rename(tempPath, oldPath)
-	if err != nil {
-		return
+	if err := os.Rename(tempPath, oldPath); err != nil {
+		return fmt.Errorf("failed to replace legacy log: %w", err)
 	}
-
-	// Reopen the (now compacted) log file
-	p.logFile, _ = os.OpenFile(oldPath, os.O_RDWR|os.O_APPEND, 0644)
+	return syncDir(filepath.Dir(oldPath))
 }
 
-// Runs a background goroutine to compact the log file periodically.
-func (p *PersistentKVStore) StartLogCompaction() {
+// every runs fn in a background goroutine once per interval until the store is closed.
+func (p *PersistentKVStore) every(interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	p.wg.Add(1)
 	go func() {
+		defer p.wg.Done()
+		defer ticker.Stop()
 		for {
-			time.Sleep(60 * time.Second)
-			p.compactLogs()
+			select {
+			case <-p.done:
+				return
+			case <-ticker.C:
+				fn()
+			}
 		}
 	}()
 }
 
-// replayLine processes a single log line and applies it to the in-memory store.
-func (p *PersistentKVStore) replayLine(line string) {
+// Close stops background fsyncs, snapshots, and compaction, waiting for any in progress to finish,
+// then flushes the active log segment to disk and closes it.
+// The store must not be used after Close; calling Close again has no effect.
+func (p *PersistentKVStore) Close() error {
+	var err error
+	p.closeOnce.Do(func() {
+		close(p.done)
+		p.wg.Wait()
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.logVersionLocked()
+		if syncErr := p.logFile.Sync(); syncErr != nil {
+			err = fmt.Errorf("failed to sync persistence file: %w", syncErr)
+		}
+		if closeErr := p.logFile.Close(); closeErr != nil && err == nil {
+			err = fmt.Errorf("failed to close persistence file: %w", closeErr)
+		}
+		p.memStore.Close()
+	})
+	return err
+}
+
+// Err returns the error that failed the store, wrapping ErrStoreFailed, or nil if it has not failed.
+// A write that fails to reach the log, or to be fsynced, may already be visible in memory, so callers of methods that do not
+// return an error should check Err before treating a write as persisted.
+func (p *PersistentKVStore) Err() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.failed
+}
+
+// lockForWrite locks p.mu for a write, or returns the error that failed the store without locking it.
+func (p *PersistentKVStore) lockForWrite() error {
+	p.mu.Lock()
+	if err := p.failed; err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// failLocked marks the store failed because of err and returns the error that failed the store.
+// The caller must hold p.mu.
+func (p *PersistentKVStore) failLocked(err error) error {
+	if p.failed == nil {
+		p.failed = fmt.Errorf("%w: %w", ErrStoreFailed, err)
+	}
+	return p.failed
+}
+
+// reportError passes a failure from background work to the configured error handler.
+func (p *PersistentKVStore) reportError(err error) {
+	if err != nil {
+		p.onError(err)
+	}
+}
+
+// syncDir flushes a directory entry to disk so that a preceding rename survives a crash.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return fmt.Errorf("failed to open directory for sync: %w", err)
+	}
+	defer d.Close()
+	if err := d.Sync(); err != nil {
+		return fmt.Errorf("failed to sync directory: %w", err)
+	}
+	return nil
+}
+
+// apply replays a single logged operation against the store and returns the version assigned to a set
+// or collection write, or zero. A set whose expiry has already passed removes any earlier value for the key instead of
+// restoring it.
+func (kv *KVStore) apply(rec record) uint64 {
+	switch rec.op {
+	case opSet:
+		return kv.setWithExpiry(rec.key, rec.value, time.Time{}, rec.version)
+	case opSetTTL, opSetExpiry:
+		rec = kv.absolute(rec)
+		if !rec.expiresAt.After(kv.now()) {
+			kv.Delete(rec.key)
+			kv.observeVersion(rec.version)
+			return 0
+		}
+		return kv.setWithExpiry(rec.key, rec.value, rec.expiresAt, rec.version)
+	case opDelete:
+		if rec.version == 0 {
+			kv.Delete(rec.key) // written before deletes were logged with a version
+			return 0
+		}
+		kv.removeAt(rec.key, rec.version)
+	case opExpire:
+		if !rec.expiresAt.IsZero() && !rec.expiresAt.After(kv.now()) {
+			kv.Delete(rec.key)
+			return 0
+		}
+		kv.expireAt(rec.key, rec.expiresAt)
+	case opHSet, opHDel, opLPush, opRPush, opLPop, opSAdd, opSRem:
+		m, _ := kv.mutate(rec)
+		return m.version
+	case opVersion:
+		kv.observeVersion(rec.version)
+	case opTxn:
+		for _, nested := range rec.records {
+			kv.apply(nested)
+		}
+	}
+	return 0
+}
+
+// removeAt replays a delete logged with version. It raises the version counter to version instead of
+// advancing it, since a write logs the keys it evicts after its own records.
+func (kv *KVStore) removeAt(key string, version uint64) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	kv.removeLocked(key)
+	kv.observeVersionLocked(version)
+}
+
+// absolute converts a legacy relative-TTL record into one with an absolute expiry, measured from now.
+// The original write time of such records is unknown, so this is the closest safe approximation.
+func (kv *KVStore) absolute(rec record) record {
+	if rec.op != opSetTTL {
+		return rec
+	}
+	return record{op: opSetExpiry, key: rec.key, value: rec.value, expiresAt: kv.now().Add(rec.ttl), version: rec.version}
+}
+
+// parseTextLine converts a line of the legacy text log format into a record.
+// Values containing spaces were truncated by the legacy format and cannot be recovered.
+func parseTextLine(line string) (record, bool) {
 	parts := strings.SplitN(line, " ", 4)
 	if len(parts) < 2 {
-		return
+		return record{}, false
 	}
 
 	switch parts[0] {
 	case "SET":
 		if len(parts) < 3 {
-			return
+			return record{}, false
 		}
-		key, value := parts[1], parts[2]
-		p.memStore.Set(key, value)
+		return record{op: opSet, key: parts[1], value: parts[2]}, true
 	case "SETTTL":
 		if len(parts) < 4 {
-			return
+			return record{}, false
 		}
-		key, value := parts[1], parts[2]
 		ttlMillis, err := strconv.ParseInt(parts[3], 10, 64)
 		if err != nil {
-			return
+			return record{}, false
 		}
 		ttl := time.Duration(ttlMillis) * time.Millisecond
-		p.memStore.SetWithTTL(key, value, ttl)
+		return record{op: opSetTTL, key: parts[1], value: parts[2], ttl: ttl}, true
 	case "DEL":
-		if len(parts) < 2 {
-			return
-		}
-		key := parts[1]
-		p.memStore.Delete(key)
+		return record{op: opDelete, key: parts[1]}, true
 	}
+	return record{}, false
 }
 
 // Set stores a key-value pair in the in-memory store and appends the operation to the log file.
 func (p *PersistentKVStore) Set(key, value string) {
-	p.memStore.Set(key, value)
-	p.appendLog(fmt.Sprintf("SET %s %s\n", key, value))
+	p.write(record{op: opSet, key: key, value: value})
 }
 
 // SetWithTTL stores a key-value pair with a TTL and appends the operation to the log file.
+// The log records the absolute expiry time, so the key expires at the same moment across restarts.
 func (p *PersistentKVStore) SetWithTTL(key, value string, ttl time.Duration) {
-	p.memStore.SetWithTTL(key, value, ttl)
-	p.appendLog(fmt.Sprintf("SETTTL %s %s %d\n", key, value, ttl.Milliseconds()))
+	p.SetWithExpiry(key, value, expiryOf(ttl, time.Time{}, p.memStore.now()))
+}
+
+// SetWithExpiry stores a key-value pair that expires at an absolute time, or never if it is zero,
+// and appends the operation to the log file.
+func (p *PersistentKVStore) SetWithExpiry(key, value string, expiresAt time.Time) {
+	p.write(record{key: key, value: value}.withExpiry(expiresAt))
 }
 
 // Get retrieves the value associated with the key from the in-memory store.
@@ -169,19 +500,469 @@ func (p *PersistentKVStore) Get(key string) (string, bool) {
 	return p.memStore.Get(key)
 }
 
+// Watch streams changes to key, or to every key with the prefix key, until ctx is done.
+// The event history starts empty after a restart. See Watchable for details.
+func (p *PersistentKVStore) Watch(ctx context.Context, key string, prefix bool, afterRevision uint64) (<-chan Event, error) {
+	return p.memStore.Watch(ctx, key, prefix, afterRevision)
+}
+
+// GetWithVersion retrieves the value and current version of the key from the in-memory store.
+func (p *PersistentKVStore) GetWithVersion(key string) (string, uint64, bool) {
+	return p.memStore.GetWithVersion(key)
+}
+
+// CompareAndSwap sets key to value only if its current version equals version, where a version of zero
+// requires the key to be absent, and logs the write with its new version.
+// It returns the key's new version and true on success, or its current version and false.
+func (p *PersistentKVStore) CompareAndSwap(key, value string, version uint64, ttl time.Duration) (uint64, bool) {
+	return p.setIf(key, value, ttl, time.Time{}, versionIs(version))
+}
+
+// SetIfNotExists sets key to value only if it is absent or expired, and logs the write.
+// It returns the key's new version and true on success, or its current version and false.
+func (p *PersistentKVStore) SetIfNotExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return p.setIf(key, value, ttl, time.Time{}, missing)
+}
+
+// SetIfExists replaces the value of key only if it is present and unexpired, and logs the write.
+// It returns the key's new version and true on success, or zero and false.
+func (p *PersistentKVStore) SetIfExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return p.setIf(key, value, ttl, time.Time{}, exists)
+}
+
+// SetIf sets cond's key to value only if cond holds, expiring at expiresAt, or never if it is zero,
+// and logs the write. It returns the key's new version and true on success, or its current version and false.
+func (p *PersistentKVStore) SetIf(cond Compare, value string, expiresAt time.Time) (uint64, bool) {
+	return p.setIf(cond.Key, value, 0, expiresAt, cond.holds)
+}
+
+// setIf checks cond and writes the key under the log lock, which serializes all writes to the store,
+// so no other write can interleave between the check and the write. The new value expires as set by expiryOf.
+func (p *PersistentKVStore) setIf(key, value string, ttl time.Duration, expiresAt time.Time, cond condition) (uint64, bool) {
+	if p.lockForWrite() != nil {
+		return 0, false
+	}
+	current, version, found := p.memStore.GetWithVersion(key)
+	if !cond(item{value: current, version: version}, found) {
+		p.mu.Unlock()
+		return version, false
+	}
+	rec := record{key: key, value: value}.withExpiry(expiryOf(ttl, expiresAt, p.memStore.now()))
+	rec.version = p.memStore.apply(rec)
+	seq, err := p.appendLocked(rec)
+	p.mu.Unlock()
+	if err != nil || p.waitDurable(seq) != nil {
+		return 0, false
+	}
+	return rec.version, true
+}
+
+// Scan returns the live keys in the range [start, end) in ascending order from the in-memory store.
+// An empty end means no upper bound, and a limit of zero or less means no limit.
+func (p *PersistentKVStore) Scan(start, end string, limit int) []KeyValue {
+	return p.memStore.Scan(start, end, limit)
+}
+
+// ScanPrefix returns up to limit live keys starting with prefix in ascending order from the in-memory store.
+func (p *PersistentKVStore) ScanPrefix(prefix string, limit int) []KeyValue {
+	return p.memStore.ScanPrefix(prefix, limit)
+}
+
+// Txn runs a transaction atomically against the in-memory store and appends every change it makes
+// to the log as a single record, so a crash never leaves part of a transaction applied.
+func (p *PersistentKVStore) Txn(txn Txn) TxnResponse {
+	if p.lockForWrite() != nil {
+		return TxnResponse{}
+	}
+	resp, records := p.memStore.txn(txn)
+	var seq uint64
+	var err error
+	if len(records) > 0 {
+		seq, err = p.appendLocked(record{op: opTxn, records: records})
+	} else {
+		p.logVersionLocked()
+	}
+	p.mu.Unlock()
+	if err != nil || (len(records) > 0 && p.waitDurable(seq) != nil) {
+		return TxnResponse{}
+	}
+	return resp
+}
+
+// Expire sets key to expire after ttl, or removes its expiry if ttl is zero or less, and logs the new
+// absolute expiry. The value and version are unchanged. It reports whether the key exists.
+func (p *PersistentKVStore) Expire(key string, ttl time.Duration) bool {
+	_, ok := p.updateExpiry(key, func() (item, bool) {
+		return p.memStore.expire(key, ttl, false)
+	})
+	return ok
+}
+
+// Persist removes the expiry of key and logs the change.
+// It reports whether the key exists and had an expiry.
+func (p *PersistentKVStore) Persist(key string) bool {
+	_, ok := p.updateExpiry(key, func() (item, bool) {
+		return item{}, p.memStore.Persist(key)
+	})
+	return ok
+}
+
+// TTL returns the remaining lifetime of key from the in-memory store and whether it exists.
+// The lifetime is zero for a key that never expires.
+func (p *PersistentKVStore) TTL(key string) (time.Duration, bool) {
+	return p.memStore.TTL(key)
+}
+
+// GetAndTouch retrieves the value of key and resets its expiry to ttl from now, logging the new expiry.
+// A ttl of zero or less removes the expiry. If the key does not exist or has expired, it returns false.
+func (p *PersistentKVStore) GetAndTouch(key string, ttl time.Duration) (string, bool) {
+	it, ok := p.updateExpiry(key, func() (item, bool) {
+		return p.memStore.expire(key, ttl, true)
+	})
+	return it.value, ok
+}
+
+// IncrBy atomically adds delta to the integer stored at key, logs the new value, and returns it.
+// A missing or expired key counts as zero; an existing key keeps its expiry.
+func (p *PersistentKVStore) IncrBy(key string, delta int64) (int64, error) {
+	it, err := p.update(key, incrInt(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(it.value, 10, 64)
+}
+
+// DecrBy atomically subtracts delta from the integer stored at key, logs the new value, and returns it.
+func (p *PersistentKVStore) DecrBy(key string, delta int64) (int64, error) {
+	if delta == math.MinInt64 {
+		return 0, ErrOverflow
+	}
+	return p.IncrBy(key, -delta)
+}
+
+// IncrByFloat atomically adds delta to the number stored at key, logs the new value, and returns it.
+// A missing or expired key counts as zero; an existing key keeps its expiry.
+func (p *PersistentKVStore) IncrByFloat(key string, delta float64) (float64, error) {
+	it, err := p.update(key, incrFloat(delta))
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseFloat(it.value, 64)
+}
+
+// update applies fn to key in the in-memory store under the log lock and logs the new value with its
+// version and expiry, waiting for it to become durable.
+func (p *PersistentKVStore) update(key string, fn updateFunc) (item, error) {
+	if err := p.lockForWrite(); err != nil {
+		return item{}, err
+	}
+	it, err := p.memStore.update(key, fn)
+	if err != nil {
+		p.mu.Unlock()
+		return item{}, err
+	}
+	seq, err := p.appendLocked(record{key: key, value: it.value, version: it.version}.withExpiry(it.expiresAt))
+	p.mu.Unlock()
+	if err == nil {
+		err = p.waitDurable(seq)
+	}
+	if err != nil {
+		return item{}, err
+	}
+	return it, nil
+}
+
+// Type returns the type of the value stored at key from the in-memory store.
+func (p *PersistentKVStore) Type(key string) (ValueType, bool) {
+	return p.memStore.Type(key)
+}
+
+// HSet sets fields of the hash at key, logs the write, and returns the number of fields that were added.
+func (p *PersistentKVStore) HSet(key string, fields map[string]string) (int, error) {
+	m, err := p.mutate(record{op: opHSet, key: key, fields: hashFields(fields)})
+	return m.n, err
+}
+
+// HGet returns the value of a field of the hash at key from the in-memory store.
+func (p *PersistentKVStore) HGet(key, field string) (string, bool, error) {
+	return p.memStore.HGet(key, field)
+}
+
+// HDel removes fields from the hash at key, logs the removal, and returns the number that were removed.
+func (p *PersistentKVStore) HDel(key string, fields ...string) (int, error) {
+	m, err := p.mutate(record{op: opHDel, key: key, fields: fields})
+	return m.n, err
+}
+
+// HGetAll returns every field of the hash at key from the in-memory store.
+func (p *PersistentKVStore) HGetAll(key string) (map[string]string, error) {
+	return p.memStore.HGetAll(key)
+}
+
+// LPush inserts values at the head of the list at key, logs the write, and returns the new length.
+func (p *PersistentKVStore) LPush(key string, values ...string) (int, error) {
+	m, err := p.mutate(record{op: opLPush, key: key, fields: values})
+	return m.n, err
+}
+
+// RPush appends values to the tail of the list at key, logs the write, and returns the new length.
+func (p *PersistentKVStore) RPush(key string, values ...string) (int, error) {
+	m, err := p.mutate(record{op: opRPush, key: key, fields: values})
+	return m.n, err
+}
+
+// LPop removes up to count elements from the head of the list at key, logs the removal, and returns them.
+func (p *PersistentKVStore) LPop(key string, count int) ([]string, error) {
+	m, err := p.logMutation(record{op: opLPop, key: key}, func() (mutation, error) {
+		return p.memStore.lpop(key, count)
+	})
+	return m.popped, err
+}
+
+// LRange returns the elements of the list at key from start to stop inclusive from the in-memory store.
+func (p *PersistentKVStore) LRange(key string, start, stop int) ([]string, error) {
+	return p.memStore.LRange(key, start, stop)
+}
+
+// SAdd adds members to the set at key, logs the write, and returns the number that were not already present.
+func (p *PersistentKVStore) SAdd(key string, members ...string) (int, error) {
+	m, err := p.mutate(record{op: opSAdd, key: key, fields: members})
+	return m.n, err
+}
+
+// SRem removes members from the set at key, logs the removal, and returns the number that were removed.
+func (p *PersistentKVStore) SRem(key string, members ...string) (int, error) {
+	m, err := p.mutate(record{op: opSRem, key: key, fields: members})
+	return m.n, err
+}
+
+// SMembers returns the members of the set at key in ascending order from the in-memory store.
+func (p *PersistentKVStore) SMembers(key string) ([]string, error) {
+	return p.memStore.SMembers(key)
+}
+
+// mutate applies a collection write record to the in-memory store and logs it.
+func (p *PersistentKVStore) mutate(rec record) (mutation, error) {
+	return p.logMutation(rec, func() (mutation, error) {
+		return p.memStore.mutate(rec)
+	})
+}
+
+// logMutation runs a collection write under the log lock and, if it changed the key, logs rec with the
+// key's new version and waits for it to become durable. An opLPop is logged with the elements it removed,
+// so replay removes the same number.
+func (p *PersistentKVStore) logMutation(rec record, write func() (mutation, error)) (mutation, error) {
+	if err := p.lockForWrite(); err != nil {
+		return mutation{}, err
+	}
+	m, err := write()
+	if err != nil || m.version == 0 {
+		p.mu.Unlock()
+		return m, err
+	}
+	rec.version = m.version
+	if rec.op == opLPop {
+		rec.fields = m.popped
+	}
+	seq, err := p.appendLocked(rec)
+	p.mu.Unlock()
+	if err == nil {
+		err = p.waitDurable(seq)
+	}
+	if err != nil {
+		return mutation{}, err
+	}
+	return m, nil
+}
+
+// updateExpiry runs change under the log lock and, if it reports a change, logs the key's new absolute
+// expiry and waits for it to become durable. It returns what change returned.
+func (p *PersistentKVStore) updateExpiry(key string, change func() (item, bool)) (item, bool) {
+	if p.lockForWrite() != nil {
+		return item{}, false
+	}
+	it, ok := change()
+	var seq uint64
+	var err error
+	if ok {
+		seq, err = p.appendLocked(record{op: opExpire, key: key, expiresAt: it.expiresAt})
+	}
+	p.mu.Unlock()
+	if err != nil || (ok && p.waitDurable(seq) != nil) {
+		return item{}, false
+	}
+	return it, ok
+}
+
 // Delete removes the key-value pair from the in-memory store and appends the operation to the log file.
 func (p *PersistentKVStore) Delete(key string) bool {
+	if p.lockForWrite() != nil {
+		return false
+	}
 	ok := p.memStore.Delete(key)
+	var seq uint64
+	var err error
 	if ok {
-		p.appendLog(fmt.Sprintf("DEL %s\n", key))
+		seq, err = p.appendLocked(record{op: opDelete, key: key})
+	} else {
+		p.logVersionLocked() // removing an expired key uses up a revision
+	}
+	p.mu.Unlock()
+	if err != nil || (ok && p.waitDurable(seq) != nil) {
+		return false
 	}
 	return ok
 }
 
-// appendLog safely appends an operation to the log file and ensures it is flushed to disk.
-func (p *PersistentKVStore) appendLog(entry string) {
+// MSet stores every entry and appends them to the log as a single write,
+// waiting for one fsync for the whole batch.
+func (p *PersistentKVStore) MSet(entries []Entry) {
+	if len(entries) == 0 {
+		return
+	}
+	records := make([]record, len(entries))
+	now := p.memStore.now()
+	for i, e := range entries {
+		records[i] = record{key: e.Key, value: e.Value}.withExpiry(e.expiry(now))
+	}
+	p.write(records...)
+}
+
+// MGet looks up every key in the in-memory store. The results are in the same order as keys.
+func (p *PersistentKVStore) MGet(keys []string) []Result {
+	return p.memStore.MGet(keys)
+}
+
+// MDelete removes every key from the in-memory store and appends the deletions of keys that existed
+// to the log as a single write, waiting for one fsync for the whole batch.
+func (p *PersistentKVStore) MDelete(keys []string) []bool {
+	if p.lockForWrite() != nil {
+		return make([]bool, len(keys))
+	}
+	deleted := p.memStore.MDelete(keys)
+	var records []record
+	for i, ok := range deleted {
+		if ok {
+			records = append(records, record{op: opDelete, key: keys[i]})
+		}
+	}
+	var seq uint64
+	var err error
+	if len(records) > 0 {
+		seq, err = p.appendLocked(records...)
+	} else {
+		p.logVersionLocked()
+	}
+	p.mu.Unlock()
+	if err != nil || (len(records) > 0 && p.waitDurable(seq) != nil) {
+		return make([]bool, len(keys))
+	}
+	return deleted
+}
+
+// write applies records to the in-memory store and appends them to the log under one lock,
+// so memory and log observe writes in the same order, then waits for them to become durable.
+// Each set is logged with the version the in-memory store assigned to it. Nothing is written once
+// the store has failed.
+func (p *PersistentKVStore) write(records ...record) {
+	if p.lockForWrite() != nil {
+		return
+	}
+	for i := range records {
+		records[i].version = p.memStore.apply(records[i])
+	}
+	seq, err := p.appendLocked(records...)
+	p.mu.Unlock()
+	if err == nil {
+		p.waitDurable(seq)
+	}
+}
+
+// appendLocked writes records to the active log segment in a single write and returns the sequence
+// number of the write, rotating to a new segment once the active one reaches the segment size.
+// If the write fails, any partial record is truncated away and the store is marked failed.
+// The caller must hold p.mu. The records are not necessarily durable until synced.
+func (p *PersistentKVStore) appendLocked(records ...record) (uint64, error) {
+	if p.failed != nil {
+		return 0, p.failed
+	}
+	// Log the keys evicted by the write as deletes, so that replay does not bring them back.
+	for _, key := range p.memStore.takeEvictions() {
+		records = append(records, record{op: opDelete, key: key})
+	}
+	// Deletes, evictions, and expirations use up revisions that replaying the records alone would not
+	// restore, so log the version counter too, and a restart never reuses a revision watchers have seen.
+	version := p.memStore.currentVersion()
+	stampDeletes(records, version)
+	if version > p.loggedVersion && version > maxVersion(records) {
+		records = append(records, record{op: opVersion, version: version})
+	}
+	var buf []byte
+	for _, rec := range records {
+		buf = append(buf, rec.marshal()...)
+	}
+	n, err := p.logFile.Write(buf)
+	if err != nil {
+		// Keep the segment ending on a record boundary, so that size and snapshot offsets stay valid.
+		p.logFile.Truncate(p.size)
+		err = p.failLocked(fmt.Errorf("failed to write persistence file: %w", err))
+		p.reportError(err)
+		return 0, err
+	}
+	p.size += int64(n)
+	p.written++
+	p.loggedVersion = version
+	if p.size >= p.segmentSize {
+		p.reportError(p.rotateLocked())
+	}
+	return p.written, nil
+}
+
+// logVersionLocked logs the version counter if it has advanced since the last logged record.
+// The caller must hold p.mu.
+func (p *PersistentKVStore) logVersionLocked() {
+	if p.memStore.currentVersion() > p.loggedVersion {
+		p.appendLocked()
+	}
+}
+
+// sweep removes expired keys from the in-memory store and logs the revisions their removal used up.
+func (p *PersistentKVStore) sweep() {
 	p.mu.Lock()
 	defer p.mu.Unlock()
-	p.logFile.WriteString(entry)
-	p.logFile.Sync() // ensure durability
+
+	if p.memStore.sweep() > 0 {
+		p.logVersionLocked()
+	}
+}
+
+// stampDeletes sets the version of every delete in records, including those in transactions, to version.
+func stampDeletes(records []record, version uint64) {
+	for i := range records {
+		switch records[i].op {
+		case opDelete:
+			records[i].version = version
+		case opTxn:
+			stampDeletes(records[i].records, version)
+		}
+	}
+}
+
+// maxVersion returns the highest version in records, including those in transactions.
+func maxVersion(records []record) uint64 {
+	var max uint64
+	for _, rec := range records {
+		if rec.version > max {
+			max = rec.version
+		}
+		if v := maxVersion(rec.records); v > max {
+			max = v
+		}
+	}
+	return max
+}
+
+// Stats returns counters for the in-memory store.
+func (p *PersistentKVStore) Stats() Stats {
+	return p.memStore.Stats()
 }
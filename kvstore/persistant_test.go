@@ -1,20 +1,21 @@
 package kvstore
 
 import (
+	"bytes"
+	"errors"
 	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
 	"testing"
 	"time"
 )
 
 func TestPersistentKVStore_SetGetDelete(t *testing.T) {
 	// Setup temp file for testing
-	tmpfile, err := os.CreateTemp("", "kvstore_test_log")
-	if err != nil {
-		t.Fatalf("failed to create temp file: %v", err)
-	}
-	defer os.Remove(tmpfile.Name())
+	logPath := filepath.Join(t.TempDir(), "kvstore_test_log")
 
-	store, err := NewPersistentKVStore(tmpfile.Name(), true)
+	store, err := NewPersistentKVStore(logPath, true)
 	if err != nil {
 		t.Fatalf("failed to create PersistentKVStore: %v", err)
 	}
@@ -38,14 +39,10 @@ func TestPersistentKVStore_SetGetDelete(t *testing.T) {
 }
 
 func TestPersistentKVStore_Recovery(t *testing.T) {
-	tmpfile, err := os.CreateTemp("", "kvstore_test_log")
-	if err != nil {
-		t.Fatalf("failed to create temp file: %v", err)
-	}
-	defer os.Remove(tmpfile.Name())
+	logPath := filepath.Join(t.TempDir(), "kvstore_test_log")
 
 	// First instance: write data
-	store, err := NewPersistentKVStore(tmpfile.Name(), true)
+	store, err := NewPersistentKVStore(logPath, true)
 	if err != nil {
 		t.Fatalf("failed to create PersistentKVStore: %v", err)
 	}
@@ -53,9 +50,9 @@ func TestPersistentKVStore_Recovery(t *testing.T) {
 	store.SetWithTTL("baz", "qux", 2*time.Second)
 
 	// Simulate server restart
-	store.logFile.Close()
+	store.Close()
 
-	store2, err := NewPersistentKVStore(tmpfile.Name(), false)
+	store2, err := NewPersistentKVStore(logPath, false)
 	if err != nil {
 		t.Fatalf("failed to recover PersistentKVStore: %v", err)
 	}
@@ -70,3 +67,296 @@ func TestPersistentKVStore_Recovery(t *testing.T) {
 		t.Fatalf("expected to recover key 'baz', got found=%v val=%s", found, val)
 	}
 }
+
+func TestPersistentKVStore_CompactLogs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for i := 0; i < 10; i++ {
+		store.Set("foo", "v"+strconv.Itoa(i))
+	}
+	store.Set("gone", "x")
+	store.Delete("gone")
+
+	before := store.PersistenceStats().LogSize
+	store.compactLogs()
+	after := store.PersistenceStats().LogSize
+	if after >= before {
+		t.Fatalf("expected compaction to shrink the log, before=%d after=%d", before, after)
+	}
+
+	store.Set("bar", "baz")
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("foo"); val != "v9" {
+		t.Fatalf("expected latest value 'v9', got %q", val)
+	}
+	if val, _ := store2.Get("bar"); val != "baz" {
+		t.Fatalf("expected write after compaction to survive, got %q", val)
+	}
+	if _, ok := store2.Get("gone"); ok {
+		t.Fatalf("expected deleted key to stay deleted")
+	}
+}
+
+// fakeClock is a manually advanced clock for simulating the passage of time across restarts.
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestPersistentKVStore_AbsoluteExpiryAcrossRestarts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	clock := newFakeClock()
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now)))
+		if err != nil {
+			t.Fatalf("failed to open PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	store.SetWithTTL("session", "abc", time.Hour)
+	store.Close()
+
+	// Restart 40 minutes later: the key has 20 minutes left, not a fresh hour.
+	clock.Advance(40 * time.Minute)
+	store = open()
+	if _, ok := store.Get("session"); !ok {
+		t.Fatalf("expected key to survive restart before expiry")
+	}
+	store.Close()
+
+	clock.Advance(30 * time.Minute)
+	store = open()
+	if _, ok := store.Get("session"); ok {
+		t.Fatalf("expected key to expire at its original deadline across restarts")
+	}
+	if keys := store.memStore.Stats().Keys; keys != 0 {
+		t.Fatalf("expected expired record to be skipped on replay, got %d keys", keys)
+	}
+	store.Close()
+}
+
+func TestPersistentKVStore_ExpiredWriteShadowsOlderValue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	clock := newFakeClock()
+
+	store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now)))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "forever")
+	store.SetWithTTL("foo", "brief", time.Minute)
+	store.Close()
+
+	clock.Advance(time.Hour)
+	store2, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now)))
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, ok := store2.Get("foo"); ok {
+		t.Fatalf("expected expired write to hide the older value, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_CompactionDropsExpiredKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	clock := newFakeClock()
+
+	store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now)))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.SetWithTTL("short", "x", time.Minute)
+	store.SetWithTTL("long", "y", 2*time.Hour)
+
+	clock.Advance(time.Hour)
+	store.compactLogs()
+	store.Close()
+
+	var keys []string
+	for _, segment := range store.Segments() {
+		data, _ := os.ReadFile(segment)
+		replayWAL(bytes.NewReader(data[walHeaderSize:]), int64(len(data)-walHeaderSize), func(rec record) {
+			if rec.op != opVersion {
+				keys = append(keys, rec.key)
+			}
+		})
+	}
+	if len(keys) != 1 || keys[0] != "long" {
+		t.Fatalf("expected only the unexpired key to remain in the log, got %v", keys)
+	}
+
+	clock.Advance(2 * time.Hour)
+	store2, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now)))
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if _, ok := store2.Get("long"); ok {
+		t.Fatalf("expected compacted key to keep its original expiry")
+	}
+}
+
+func TestPersistentKVStore_EvictionsSurviveRestart(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithMaxEntries(2)))
+		if err != nil {
+			t.Fatalf("failed to open PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	store.Set("a", "1")
+	store.Set("b", "2")
+	store.Get("a")
+	store.Set("c", "3") // evicts b, the least recently used
+	store.MSet([]Entry{{Key: "d", Value: "4"}, {Key: "a", Value: "5"}, {Key: "d", Value: "6"}})
+	version := store.memStore.currentVersion()
+	if stats := store.Stats(); stats.Evicted != 3 {
+		t.Fatalf("expected 3 evictions, got %d", stats.Evicted)
+	}
+	// Crash without closing, so that only what the writes logged survives.
+	store.logFile.Close()
+	store.memStore.Close()
+
+	store2 := open()
+	defer store2.Close()
+	if stats := store2.Stats(); stats.Keys != 2 || stats.Evicted != 0 {
+		t.Fatalf("expected 2 keys and no evictions on replay, got %+v", stats)
+	}
+	for key, want := range map[string]string{"a": "5", "d": "6"} {
+		if val, _ := store2.Get(key); val != want {
+			t.Fatalf("expected %s=%q after restart, got %q", key, want, val)
+		}
+	}
+	for _, key := range []string{"b", "c"} {
+		if _, ok := store2.Get(key); ok {
+			t.Fatalf("expected evicted key %s to stay evicted after restart", key)
+		}
+	}
+	if got := store2.memStore.currentVersion(); got != version {
+		t.Fatalf("expected the version counter to survive as %d, got %d", version, got)
+	}
+}
+
+func TestPersistentKVStore_Close(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, true,
+		WithSyncPolicy(SyncNever),
+		WithSnapshotInterval(time.Millisecond),
+		WithCompactionInterval(time.Millisecond),
+	)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	time.Sleep(10 * time.Millisecond)
+
+	if err := store.Close(); err != nil {
+		t.Fatalf("Close failed: %v", err)
+	}
+	if err := store.Close(); err != nil {
+		t.Fatalf("expected second Close to be a no-op, got %v", err)
+	}
+
+	// Background work has stopped, so the files are no longer changing.
+	before := store.PersistenceStats()
+	time.Sleep(10 * time.Millisecond)
+	if after := store.PersistenceStats(); after != before {
+		t.Fatalf("expected background work to stop, before=%+v after=%+v", before, after)
+	}
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	defer store2.Close()
+	if val, _ := store2.Get("foo"); val != "bar" {
+		t.Fatalf("expected write to survive Close, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_WriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	var reported []error
+	store, err := NewPersistentKVStore(path, false, WithErrorHandler(func(err error) { reported = append(reported, err) }))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("a", "1")
+
+	// Swap in a log file that cannot be written.
+	readOnly, err := os.Open(store.segmentPath(store.segments[len(store.segments)-1]))
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	store.mu.Lock()
+	writable := store.logFile
+	store.logFile = readOnly
+	store.mu.Unlock()
+	defer writable.Close()
+
+	store.Set("b", "2")
+	if err := store.Err(); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected ErrStoreFailed after a failed write, got %v", err)
+	}
+	if len(reported) != 1 || !errors.Is(reported[0], ErrStoreFailed) {
+		t.Fatalf("expected the failure to be reported once, got %v", reported)
+	}
+
+	// Later writes are refused.
+	store.Set("c", "3")
+	if _, ok := store.Get("c"); ok {
+		t.Fatalf("expected a write to a failed store to be refused")
+	}
+	if store.Delete("a") {
+		t.Fatalf("expected a delete from a failed store to be refused")
+	}
+	if _, err := store.IncrBy("n", 1); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected IncrBy to return ErrStoreFailed, got %v", err)
+	}
+	if _, ok := store.SetIfNotExists("d", "4", 0); ok {
+		t.Fatalf("expected a conditional write to a failed store to be refused")
+	}
+	store.Close()
+
+	store, err = NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to reopen PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("a"); val != "1" {
+		t.Fatalf("expected the logged write to survive, got %q", val)
+	}
+	if _, ok := store.Get("b"); ok {
+		t.Fatalf("expected the write that failed to be absent after reopening")
+	}
+}
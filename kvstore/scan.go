@@ -0,0 +1,53 @@
+package kvstore
+
+// KeyValue is a live key returned by a scan, with its value and current version.
+type KeyValue struct {
+	Key     string
+	Value   string
+	Version uint64
+}
+
+// Scan returns the live keys in the range [start, end) in ascending order, with their values.
+// An empty end means no upper bound, and a limit of zero or less means no limit.
+// Scans do not count as accesses for the eviction policy.
+func (kv *KVStore) Scan(start, end string, limit int) []KeyValue {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	now := kv.now()
+	var results []KeyValue
+	for node := kv.index.seek(start); node != nil; node = node.next[0] {
+		if end != "" && node.key >= end {
+			break
+		}
+		it := kv.store[node.key]
+		if it.expired(now) {
+			continue
+		}
+		results = append(results, KeyValue{Key: node.key, Value: it.value, Version: it.version})
+		if limit > 0 && len(results) == limit {
+			break
+		}
+	}
+	return results
+}
+
+// ScanPrefix returns up to limit live keys starting with prefix in ascending order, with their values.
+// A limit of zero or less means no limit.
+func (kv *KVStore) ScanPrefix(prefix string, limit int) []KeyValue {
+	return kv.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// PrefixEnd returns the smallest key greater than every key starting with prefix, for use as the end
+// of a Scan. It returns "" (no upper bound) if there is no such key, as for an empty prefix or one made
+// only of 0xff bytes.
+func PrefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
+}
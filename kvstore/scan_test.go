@@ -0,0 +1,100 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// scanKeys returns the keys of a scan result.
+func scanKeys(items []KeyValue) []string {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+	return keys
+}
+
+// testScan exercises ordered scans on a Storage backend.
+func testScan(t *testing.T, store Storage) {
+	t.Helper()
+
+	for _, key := range []string{"tenant/b/2", "tenant/a/1", "other", "tenant/a/2", "tenant/c"} {
+		store.Set(key, "v-"+key)
+	}
+	store.Delete("tenant/a/2")
+
+	check := func(name string, got []KeyValue, want ...string) {
+		t.Helper()
+		keys := scanKeys(got)
+		if len(keys) != len(want) {
+			t.Fatalf("%s: expected %v, got %v", name, want, keys)
+		}
+		for i := range want {
+			if keys[i] != want[i] {
+				t.Fatalf("%s: expected %v, got %v", name, want, keys)
+			}
+		}
+	}
+
+	check("all", store.Scan("", "", 0), "other", "tenant/a/1", "tenant/b/2", "tenant/c")
+	check("range", store.Scan("tenant/a", "tenant/c", 0), "tenant/a/1", "tenant/b/2")
+	check("limit", store.Scan("", "", 2), "other", "tenant/a/1")
+	check("prefix", store.ScanPrefix("tenant/", 0), "tenant/a/1", "tenant/b/2", "tenant/c")
+	check("prefix limit", store.ScanPrefix("tenant/", 1), "tenant/a/1")
+
+	items := store.ScanPrefix("tenant/a/", 0)
+	if items[0].Value != "v-tenant/a/1" || items[0].Version == 0 {
+		t.Fatalf("expected scan to return values and versions, got %+v", items[0])
+	}
+}
+
+func TestKVStore_Scan(t *testing.T) {
+	store := New()
+	defer store.Close()
+	testScan(t, store)
+}
+
+func TestShardedKVStore_Scan(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+	testScan(t, store)
+}
+
+func TestPersistentKVStore_Scan(t *testing.T) {
+	store, err := NewPersistentKVStore(filepath.Join(t.TempDir(), "kv.log"), false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	testScan(t, store)
+}
+
+func TestKVStore_ScanSkipsExpiredKeys(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("a", "1", time.Minute)
+	store.Set("b", "2")
+	clock.Advance(time.Minute)
+
+	if keys := scanKeys(store.Scan("", "", 0)); len(keys) != 1 || keys[0] != "b" {
+		t.Fatalf("expected only the unexpired key, got %v", keys)
+	}
+}
+
+func TestPrefixEnd(t *testing.T) {
+	cases := map[string]string{
+		"":         "",
+		"a":        "b",
+		"tenant/":  "tenant0",
+		"a\xff":    "b",
+		"\xff\xff": "",
+	}
+	for prefix, want := range cases {
+		if got := PrefixEnd(prefix); got != want {
+			t.Fatalf("PrefixEnd(%q): expected %q, got %q", prefix, want, got)
+		}
+	}
+}
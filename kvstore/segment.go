@@ -0,0 +1,276 @@
+package kvstore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// The log is split into segment files that live next to logPath. Only the last segment is written to;
+// once it reaches the segment size it is fsynced, sealed, and a new segment is started. Sealed segments
+// are immutable until compaction merges them, so they can be copied for backup at any time.
+//
+// A manifest, "<log>.manifest", lists the live segments in replay order:
+//
+//	magic "KVMF" | version (1 byte) | count (uvarint) | name length (uvarint) | name ... | CRC-32C of all preceding bytes (uint32, big endian)
+//
+// The first segment of a store created before segmentation is the original log file itself.
+const (
+	manifestMagic   = "KVMF"
+	manifestVersion = 1
+)
+
+// DefaultSegmentSize is the size at which the active log segment is sealed and a new one started.
+const DefaultSegmentSize = 64 << 20
+
+// WithSegmentSize sets the size, in bytes, at which the active log segment is rotated.
+func WithSegmentSize(size int64) PersistentOption {
+	return func(p *PersistentKVStore) {
+		if size > 0 {
+			p.segmentSize = size
+		}
+	}
+}
+
+// manifestPath returns the manifest file path for a log file path.
+func manifestPath(logPath string) string {
+	return logPath + ".manifest"
+}
+
+// segmentName returns the file name of the segment with the given id.
+func segmentName(logPath string, id uint64) string {
+	return fmt.Sprintf("%s.%06d", filepath.Base(logPath), id)
+}
+
+// segmentID parses the id from a segment file name. The original log file has id 0.
+func segmentID(logPath, name string) (uint64, bool) {
+	base := filepath.Base(logPath)
+	if name == base {
+		return 0, true
+	}
+	suffix, ok := strings.CutPrefix(name, base+".")
+	if !ok || len(suffix) < 6 {
+		return 0, false
+	}
+	id, err := strconv.ParseUint(suffix, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	return id, true
+}
+
+// segmentPath returns the full path of a segment file.
+func (p *PersistentKVStore) segmentPath(name string) string {
+	return filepath.Join(filepath.Dir(p.logPath), name)
+}
+
+// Segments returns the paths of the live log segments in replay order.
+// All but the last are sealed and will not change until compaction replaces them.
+func (p *PersistentKVStore) Segments() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	paths := make([]string, len(p.segments))
+	for i, name := range p.segments {
+		paths[i] = p.segmentPath(name)
+	}
+	return paths
+}
+
+// writeManifest atomically replaces the manifest with the given segment list.
+func writeManifest(path string, segments []string) error {
+	buf := []byte(manifestMagic)
+	buf = append(buf, manifestVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(segments)))
+	for _, name := range segments {
+		buf = binary.AppendUvarint(buf, uint64(len(name)))
+		buf = append(buf, name...)
+	}
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, crcTable))
+
+	return writeFileAtomic(path, buf)
+}
+
+// writeFileAtomic replaces the file at path with data, so that a crash leaves either the old or
+// the new contents in place.
+func writeFileAtomic(path string, data []byte) error {
+	name := filepath.Base(path)
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create %s: %w", name, err)
+	}
+	defer os.Remove(tempPath) // no-op once renamed
+
+	if _, err := file.Write(data); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync %s: %w", name, err)
+	}
+	file.Close()
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to install %s: %w", name, err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readManifest reads and verifies the manifest, returning the live segment names in replay order.
+// A missing file returns an error satisfying os.IsNotExist.
+func readManifest(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < len(manifestMagic)+1+4 || string(data[:len(manifestMagic)]) != manifestMagic {
+		return nil, fmt.Errorf("%w: invalid manifest header", ErrCorruptLog)
+	}
+	if v := data[len(manifestMagic)]; v != manifestVersion {
+		return nil, fmt.Errorf("kvstore: unsupported manifest version %d", v)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return nil, fmt.Errorf("%w: manifest checksum mismatch", ErrCorruptLog)
+	}
+
+	rest := body[len(manifestMagic)+1:]
+	count, n := binary.Uvarint(rest)
+	if n <= 0 {
+		return nil, fmt.Errorf("%w: invalid manifest", ErrCorruptLog)
+	}
+	rest = rest[n:]
+	var segments []string
+	for i := uint64(0); i < count; i++ {
+		name, remaining, ok := readBytes(rest)
+		if !ok {
+			return nil, fmt.Errorf("%w: invalid manifest", ErrCorruptLog)
+		}
+		segments = append(segments, string(name))
+		rest = remaining
+	}
+	if len(segments) == 0 {
+		return nil, fmt.Errorf("%w: manifest lists no segments", ErrCorruptLog)
+	}
+	return segments, nil
+}
+
+// openSegment opens a segment file for replay and verifies its header.
+// The active segment is opened for appending; a missing or partial header on it is rewritten.
+func openSegment(path string, active bool) (*os.File, int64, error) {
+	flag := os.O_RDONLY
+	if active {
+		flag = os.O_RDWR | os.O_APPEND
+	}
+	file, err := os.OpenFile(path, flag, 0644)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to open log segment: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("failed to open log segment: %w", err)
+	}
+	size := info.Size()
+
+	header := make([]byte, walHeaderSize)
+	n, _ := io.ReadFull(file, header)
+	if active && size < int64(walHeaderSize) && bytes.HasPrefix(walHeader(), header[:n]) {
+		// A crash while the segment was being created
+		if err := writeSegmentHeader(file); err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, int64(walHeaderSize), nil
+	}
+	if err := checkWALHeader(header[:n]); err != nil {
+		file.Close()
+		return nil, 0, fmt.Errorf("log segment %s: %w", filepath.Base(path), err)
+	}
+	return file, size, nil
+}
+
+// createSegment creates an empty, synced segment file ready for appending.
+func createSegment(path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR|os.O_TRUNC|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create log segment: %w", err)
+	}
+	if err := writeSegmentHeader(file); err != nil {
+		file.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return file, nil
+}
+
+// writeSegmentHeader truncates a segment file and writes a synced log header.
+func writeSegmentHeader(file *os.File) error {
+	if err := file.Truncate(0); err != nil {
+		return fmt.Errorf("failed to initialize log segment: %w", err)
+	}
+	if _, err := file.Write(walHeader()); err != nil {
+		return fmt.Errorf("failed to initialize log segment: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("failed to sync log segment: %w", err)
+	}
+	return nil
+}
+
+// rotateLocked seals the active segment and starts a new one. The caller must hold p.mu.
+// The sealed segment is fsynced before the manifest lists its successor, so only the
+// active segment can ever hold a torn record.
+func (p *PersistentKVStore) rotateLocked() error {
+	if err := p.logFile.Sync(); err != nil {
+		// As in syncLocked, the segment's records can no longer be trusted to reach the disk.
+		return p.failLocked(fmt.Errorf("failed to seal log segment: %w", err))
+	}
+
+	name := segmentName(p.logPath, p.nextSegmentID)
+	file, err := createSegment(p.segmentPath(name))
+	if err != nil {
+		return err
+	}
+	segments := append(append([]string{}, p.segments...), name)
+	if err := writeManifest(manifestPath(p.logPath), segments); err != nil {
+		file.Close()
+		os.Remove(p.segmentPath(name))
+		return err
+	}
+
+	p.nextSegmentID++
+	p.logFile.Close()
+	p.logFile = file
+	p.segments = segments
+	p.sealedSize += p.size
+	p.size = int64(walHeaderSize)
+	return nil
+}
+
+// removeOrphanSegments deletes segment files that are not listed in the manifest,
+// left behind by a crash during rotation or compaction.
+func (p *PersistentKVStore) removeOrphanSegments() {
+	live := make(map[string]bool, len(p.segments))
+	for _, name := range p.segments {
+		live[name] = true
+	}
+	entries, err := os.ReadDir(filepath.Dir(p.logPath))
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if _, ok := segmentID(p.logPath, name); ok && !live[name] && !entry.IsDir() {
+			os.Remove(p.segmentPath(name))
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func TestPersistentKVStore_RotatesSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set("key"+strconv.Itoa(i), "value")
+	}
+
+	segments := store.Segments()
+	if len(segments) < 5 {
+		t.Fatalf("expected the log to rotate into several segments, got %d", len(segments))
+	}
+	if segments[0] != path {
+		t.Fatalf("expected the original log file to be the first segment, got %s", segments[0])
+	}
+	names, err := readManifest(manifestPath(path))
+	if err != nil {
+		t.Fatalf("failed to read manifest: %v", err)
+	}
+	if len(names) != len(segments) {
+		t.Fatalf("expected manifest to list %d segments, got %d", len(segments), len(names))
+	}
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if keys := store2.memStore.Stats().Keys; keys != 100 {
+		t.Fatalf("expected 100 keys across segments, got %d", keys)
+	}
+	if stats := store2.PersistenceStats(); stats.Segments != len(segments) {
+		t.Fatalf("expected %d segments after restart, got %d", len(segments), stats.Segments)
+	}
+}
+
+func TestPersistentKVStore_CompactionMergesSealedSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for i := 0; i < 100; i++ {
+		store.Set("key"+strconv.Itoa(i%10), strconv.Itoa(i))
+	}
+	store.Delete("key0")
+	old := store.Segments()
+
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	segments := store.Segments()
+	if len(segments) != 2 {
+		t.Fatalf("expected one merged segment and one active segment, got %v", segments)
+	}
+	for _, segment := range old {
+		if _, err := os.Stat(segment); !os.IsNotExist(err) {
+			t.Fatalf("expected merged segment %s to be removed", segment)
+		}
+	}
+
+	store.Set("after", "compaction")
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if keys := store2.memStore.Stats().Keys; keys != 10 {
+		t.Fatalf("expected 10 keys after merge, got %d", keys)
+	}
+	if val, _ := store2.Get("key9"); val != "99" {
+		t.Fatalf("expected newest value for key9, got %q", val)
+	}
+	if _, ok := store2.Get("key0"); ok {
+		t.Fatalf("expected deleted key to stay deleted")
+	}
+}
+
+func TestPersistentKVStore_RemovesOrphanSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	store.Close()
+
+	// A segment created by a rotation that crashed before updating the manifest.
+	orphan := store.segmentPath(segmentName(path, 7))
+	if err := os.WriteFile(orphan, walHeader(), 0644); err != nil {
+		t.Fatalf("failed to write orphan segment: %v", err)
+	}
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if _, err := os.Stat(orphan); !os.IsNotExist(err) {
+		t.Fatalf("expected orphan segment to be removed")
+	}
+	if val, _ := store2.Get("foo"); val != "bar" {
+		t.Fatalf("expected 'foo' to be recovered, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_CorruptManifest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Close()
+
+	data, _ := os.ReadFile(manifestPath(path))
+	data[len(data)-1] ^= 0xff
+	os.WriteFile(manifestPath(path), data, 0644)
+
+	if _, err := NewPersistentKVStore(path, false); err == nil {
+		t.Fatalf("expected a corrupt manifest to be reported")
+	}
+}
+
+func TestPersistentKVStore_SnapshotSkipsEarlierSegments(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	for i := 0; i < 50; i++ {
+		store.Set("key"+strconv.Itoa(i), "v")
+	}
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	store.Set("tail", "x")
+	store.Close()
+
+	// Earlier segments are not needed once the snapshot covers them.
+	first := store.Segments()[0]
+	os.WriteFile(first, []byte("garbage"), 0644)
+
+	store2, err := NewPersistentKVStore(path, false, WithSegmentSize(256))
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if keys := store2.memStore.Stats().Keys; keys != 51 {
+		t.Fatalf("expected 51 keys from snapshot and tail, got %d", keys)
+	}
+}
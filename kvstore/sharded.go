@@ -0,0 +1,332 @@
+package kvstore
+
+import (
+	"runtime"
+	"sort"
+	"time"
+)
+
+// ShardedKVStore spreads keys across several independently locked KVStore shards selected by key hash,
+// so writers to different keys rarely contend on the same lock.
+// It implements the Storage interface, but not Watchable: each shard numbers its versions independently,
+// so there is no single revision to order events by or resume a watch from.
+type ShardedKVStore struct {
+	shards []*KVStore
+}
+
+// NewSharded creates a ShardedKVStore with the given number of shards.
+// If shards is zero or negative, four shards per available CPU are used.
+// Options are applied to every shard; entry and memory limits are divided evenly between shards.
+func NewSharded(shards int, opts ...Option) *ShardedKVStore {
+	if shards <= 0 {
+		shards = 4 * runtime.GOMAXPROCS(0)
+	}
+	shardOpts := append(opts[:len(opts):len(opts)], splitLimits(shards))
+	s := &ShardedKVStore{shards: make([]*KVStore, shards)}
+	for i := range s.shards {
+		s.shards[i] = New(shardOpts...)
+	}
+	return s
+}
+
+// splitLimits divides a store's entry and memory limits by n, rounding up.
+func splitLimits(n int) Option {
+	return func(kv *KVStore) {
+		if kv.maxEntries > 0 {
+			kv.maxEntries = (kv.maxEntries + n - 1) / n
+		}
+		if kv.maxBytes > 0 {
+			kv.maxBytes = (kv.maxBytes + int64(n) - 1) / int64(n)
+		}
+	}
+}
+
+// shardFor returns the shard responsible for key, using the FNV-1a hash.
+func (s *ShardedKVStore) shardFor(key string) *KVStore {
+	return s.shards[s.shardIndex(key)]
+}
+
+// shardIndex returns the index of the shard responsible for key, using the FNV-1a hash.
+func (s *ShardedKVStore) shardIndex(key string) int {
+	const (
+		offset32 = 2166136261
+		prime32  = 16777619
+	)
+	h := uint32(offset32)
+	for i := 0; i < len(key); i++ {
+		h ^= uint32(key[i])
+		h *= prime32
+	}
+	return int(h % uint32(len(s.shards)))
+}
+
+// groupByShard returns, for each shard with at least one of the n keys, the positions of those keys.
+func (s *ShardedKVStore) groupByShard(n int, key func(i int) string) map[int][]int {
+	groups := make(map[int][]int)
+	for i := 0; i < n; i++ {
+		shard := s.shardIndex(key(i))
+		groups[shard] = append(groups[shard], i)
+	}
+	return groups
+}
+
+// Set stores a key-value pair in the key's shard without an expiration time.
+func (s *ShardedKVStore) Set(key, value string) {
+	s.shardFor(key).Set(key, value)
+}
+
+// SetWithTTL stores a key-value pair in the key's shard with an optional time-to-live (TTL) value.
+func (s *ShardedKVStore) SetWithTTL(key, value string, ttl time.Duration) {
+	s.shardFor(key).SetWithTTL(key, value, ttl)
+}
+
+// SetWithExpiry stores a key-value pair in the key's shard that expires at an absolute time, or never if it is zero.
+func (s *ShardedKVStore) SetWithExpiry(key, value string, expiresAt time.Time) {
+	s.shardFor(key).SetWithExpiry(key, value, expiresAt)
+}
+
+// Get retrieves the value associated with the key from its shard.
+func (s *ShardedKVStore) Get(key string) (string, bool) {
+	return s.shardFor(key).Get(key)
+}
+
+// GetWithVersion retrieves the value and current version of the key from its shard.
+// Versions are assigned per shard, so they only order writes to the same key.
+func (s *ShardedKVStore) GetWithVersion(key string) (string, uint64, bool) {
+	return s.shardFor(key).GetWithVersion(key)
+}
+
+// CompareAndSwap sets the key in its shard only if its current version equals version.
+func (s *ShardedKVStore) CompareAndSwap(key, value string, version uint64, ttl time.Duration) (uint64, bool) {
+	return s.shardFor(key).CompareAndSwap(key, value, version, ttl)
+}
+
+// SetIfNotExists sets the key in its shard only if it is absent or expired.
+func (s *ShardedKVStore) SetIfNotExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return s.shardFor(key).SetIfNotExists(key, value, ttl)
+}
+
+// SetIfExists replaces the key in its shard only if it is present and unexpired.
+func (s *ShardedKVStore) SetIfExists(key, value string, ttl time.Duration) (uint64, bool) {
+	return s.shardFor(key).SetIfExists(key, value, ttl)
+}
+
+// SetIf sets cond's key in its shard only if cond holds, expiring at expiresAt, or never if it is zero.
+func (s *ShardedKVStore) SetIf(cond Compare, value string, expiresAt time.Time) (uint64, bool) {
+	return s.shardFor(cond.Key).SetIf(cond, value, expiresAt)
+}
+
+// Expire sets the expiry of the key in its shard.
+func (s *ShardedKVStore) Expire(key string, ttl time.Duration) bool {
+	return s.shardFor(key).Expire(key, ttl)
+}
+
+// Persist removes the expiry of the key in its shard.
+func (s *ShardedKVStore) Persist(key string) bool {
+	return s.shardFor(key).Persist(key)
+}
+
+// TTL returns the remaining lifetime of the key from its shard.
+func (s *ShardedKVStore) TTL(key string) (time.Duration, bool) {
+	return s.shardFor(key).TTL(key)
+}
+
+// GetAndTouch retrieves the key from its shard and resets its expiry.
+func (s *ShardedKVStore) GetAndTouch(key string, ttl time.Duration) (string, bool) {
+	return s.shardFor(key).GetAndTouch(key, ttl)
+}
+
+// IncrBy atomically adds delta to the integer stored at the key in its shard.
+func (s *ShardedKVStore) IncrBy(key string, delta int64) (int64, error) {
+	return s.shardFor(key).IncrBy(key, delta)
+}
+
+// DecrBy atomically subtracts delta from the integer stored at the key in its shard.
+func (s *ShardedKVStore) DecrBy(key string, delta int64) (int64, error) {
+	return s.shardFor(key).DecrBy(key, delta)
+}
+
+// IncrByFloat atomically adds delta to the number stored at the key in its shard.
+func (s *ShardedKVStore) IncrByFloat(key string, delta float64) (float64, error) {
+	return s.shardFor(key).IncrByFloat(key, delta)
+}
+
+// Type returns the type of the value stored at the key in its shard.
+func (s *ShardedKVStore) Type(key string) (ValueType, bool) {
+	return s.shardFor(key).Type(key)
+}
+
+// HSet sets fields of the hash at the key in its shard.
+func (s *ShardedKVStore) HSet(key string, fields map[string]string) (int, error) {
+	return s.shardFor(key).HSet(key, fields)
+}
+
+// HGet returns a field of the hash at the key in its shard.
+func (s *ShardedKVStore) HGet(key, field string) (string, bool, error) {
+	return s.shardFor(key).HGet(key, field)
+}
+
+// HDel removes fields from the hash at the key in its shard.
+func (s *ShardedKVStore) HDel(key string, fields ...string) (int, error) {
+	return s.shardFor(key).HDel(key, fields...)
+}
+
+// HGetAll returns every field of the hash at the key in its shard.
+func (s *ShardedKVStore) HGetAll(key string) (map[string]string, error) {
+	return s.shardFor(key).HGetAll(key)
+}
+
+// LPush inserts values at the head of the list at the key in its shard.
+func (s *ShardedKVStore) LPush(key string, values ...string) (int, error) {
+	return s.shardFor(key).LPush(key, values...)
+}
+
+// RPush appends values to the list at the key in its shard.
+func (s *ShardedKVStore) RPush(key string, values ...string) (int, error) {
+	return s.shardFor(key).RPush(key, values...)
+}
+
+// LPop removes elements from the head of the list at the key in its shard.
+func (s *ShardedKVStore) LPop(key string, count int) ([]string, error) {
+	return s.shardFor(key).LPop(key, count)
+}
+
+// LRange returns a range of the list at the key in its shard.
+func (s *ShardedKVStore) LRange(key string, start, stop int) ([]string, error) {
+	return s.shardFor(key).LRange(key, start, stop)
+}
+
+// SAdd adds members to the set at the key in its shard.
+func (s *ShardedKVStore) SAdd(key string, members ...string) (int, error) {
+	return s.shardFor(key).SAdd(key, members...)
+}
+
+// SRem removes members from the set at the key in its shard.
+func (s *ShardedKVStore) SRem(key string, members ...string) (int, error) {
+	return s.shardFor(key).SRem(key, members...)
+}
+
+// SMembers returns the members of the set at the key in its shard.
+func (s *ShardedKVStore) SMembers(key string) ([]string, error) {
+	return s.shardFor(key).SMembers(key)
+}
+
+// Delete removes the key from its shard.
+func (s *ShardedKVStore) Delete(key string) bool {
+	return s.shardFor(key).Delete(key)
+}
+
+// MSet stores every entry, locking each shard once for the entries it owns.
+func (s *ShardedKVStore) MSet(entries []Entry) {
+	for shard, positions := range s.groupByShard(len(entries), func(i int) string { return entries[i].Key }) {
+		batch := make([]Entry, len(positions))
+		for j, i := range positions {
+			batch[j] = entries[i]
+		}
+		s.shards[shard].MSet(batch)
+	}
+}
+
+// MGet looks up every key, locking each shard once. The results are in the same order as keys.
+func (s *ShardedKVStore) MGet(keys []string) []Result {
+	results := make([]Result, len(keys))
+	for shard, positions := range s.groupByShard(len(keys), func(i int) string { return keys[i] }) {
+		for j, res := range s.shards[shard].MGet(pick(keys, positions)) {
+			results[positions[j]] = res
+		}
+	}
+	return results
+}
+
+// MDelete removes every key, locking each shard once.
+// Each result reports whether the corresponding key was found and deleted.
+func (s *ShardedKVStore) MDelete(keys []string) []bool {
+	deleted := make([]bool, len(keys))
+	for shard, positions := range s.groupByShard(len(keys), func(i int) string { return keys[i] }) {
+		for j, ok := range s.shards[shard].MDelete(pick(keys, positions)) {
+			deleted[positions[j]] = ok
+		}
+	}
+	return deleted
+}
+
+// pick returns the keys at the given positions.
+func pick(keys []string, positions []int) []string {
+	picked := make([]string, len(positions))
+	for j, i := range positions {
+		picked[j] = keys[i]
+	}
+	return picked
+}
+
+// Txn runs a transaction atomically across shards by write-locking every shard it touches,
+// always in shard order so that concurrent transactions cannot deadlock.
+func (s *ShardedKVStore) Txn(txn Txn) TxnResponse {
+	touched := make([]bool, len(s.shards))
+	for _, c := range txn.If {
+		touched[s.shardIndex(c.Key)] = true
+	}
+	for _, ops := range [][]Op{txn.Then, txn.Else} {
+		for _, op := range ops {
+			touched[s.shardIndex(op.Key)] = true
+		}
+	}
+	var locked []*KVStore
+	for i, ok := range touched {
+		if ok {
+			s.shards[i].mu.Lock()
+			locked = append(locked, s.shards[i])
+		}
+	}
+	defer func() {
+		for _, shard := range locked {
+			shard.mu.Unlock()
+		}
+	}()
+
+	resp, _ := runTxnLocked(txn, s.shards[0].now(), s.shardFor)
+	for _, shard := range locked {
+		shard.evictLocked()
+	}
+	return resp
+}
+
+// Scan returns the live keys in the range [start, end) across all shards in ascending order.
+// An empty end means no upper bound, and a limit of zero or less means no limit.
+func (s *ShardedKVStore) Scan(start, end string, limit int) []KeyValue {
+	var results []KeyValue
+	for _, shard := range s.shards {
+		results = append(results, shard.Scan(start, end, limit)...)
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i].Key < results[j].Key })
+	if limit > 0 && len(results) > limit {
+		results = results[:limit]
+	}
+	return results
+}
+
+// ScanPrefix returns up to limit live keys starting with prefix across all shards in ascending order.
+func (s *ShardedKVStore) ScanPrefix(prefix string, limit int) []KeyValue {
+	return s.Scan(prefix, PrefixEnd(prefix), limit)
+}
+
+// Stats returns the counters summed across all shards.
+func (s *ShardedKVStore) Stats() Stats {
+	var total Stats
+	for _, shard := range s.shards {
+		st := shard.Stats()
+		total.Keys += st.Keys
+		total.Bytes += st.Bytes
+		total.Expired += st.Expired
+		total.Evicted += st.Evicted
+	}
+	return total
+}
+
+// Close stops the expiration reaper of every shard.
+func (s *ShardedKVStore) Close() error {
+	for _, shard := range s.shards {
+		shard.Close()
+	}
+	return nil
+}
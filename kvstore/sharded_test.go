@@ -0,0 +1,152 @@
+package kvstore
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShardedKVStore_SetGetDelete(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+
+	for i := 0; i < 100; i++ {
+		store.Set("key"+strconv.Itoa(i), strconv.Itoa(i))
+	}
+	for i := 0; i < 100; i++ {
+		val, ok := store.Get("key" + strconv.Itoa(i))
+		if !ok || val != strconv.Itoa(i) {
+			t.Fatalf("expected key%d=%d, got ok=%v val=%s", i, i, ok, val)
+		}
+	}
+
+	if !store.Delete("key7") {
+		t.Fatalf("expected delete to succeed")
+	}
+	if _, ok := store.Get("key7"); ok {
+		t.Fatalf("expected key to be deleted")
+	}
+	if keys := store.Stats().Keys; keys != 99 {
+		t.Fatalf("expected 99 keys, got %d", keys)
+	}
+}
+
+func TestShardedKVStore_NotWatchable(t *testing.T) {
+	store := NewSharded(2)
+	defer store.Close()
+
+	if _, ok := Storage(store).(Watchable); ok {
+		t.Fatalf("expected the sharded store not to support Watch, since its shards have separate revisions")
+	}
+}
+
+func TestShardedKVStore_SetWithTTL(t *testing.T) {
+	store := NewSharded(4)
+	defer store.Close()
+
+	store.SetWithTTL("foo", "bar", 50*time.Millisecond)
+	if _, ok := store.Get("foo"); !ok {
+		t.Fatalf("expected key to exist immediately")
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, ok := store.Get("foo"); ok {
+		t.Fatalf("expected key to expire")
+	}
+}
+
+func TestShardedKVStore_SplitsLimits(t *testing.T) {
+	store := NewSharded(4, WithMaxEntries(10))
+	defer store.Close()
+
+	for _, shard := range store.shards {
+		if shard.maxEntries != 3 {
+			t.Fatalf("expected per-shard limit of 3, got %d", shard.maxEntries)
+		}
+		if shard.policy == nil {
+			t.Fatalf("expected each shard to have an eviction policy")
+		}
+	}
+	if store.shards[0].policy == store.shards[1].policy {
+		t.Fatalf("expected shards not to share an eviction policy")
+	}
+}
+
+func TestShardedKVStore_ConcurrentAccess(t *testing.T) {
+	store := NewSharded(0)
+	defer store.Close()
+
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := strconv.Itoa(w) + "-" + strconv.Itoa(i)
+				store.Set(key, "v")
+				store.Get(key)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	if keys := store.Stats().Keys; keys != 8000 {
+		t.Fatalf("expected 8000 keys, got %d", keys)
+	}
+}
+
+// Run with `go test -bench . -cpu 1,2,4,8,16,32 ./kvstore` to compare how each store scales with GOMAXPROCS.
+
+func benchmarkParallelSet(b *testing.B, store Storage) {
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			store.Set("key"+strconv.Itoa(i%10000), "value")
+			i++
+		}
+	})
+}
+
+func benchmarkParallelMixed(b *testing.B, store Storage) {
+	for i := 0; i < 10000; i++ {
+		store.Set("key"+strconv.Itoa(i), "value")
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := "key" + strconv.Itoa(i%10000)
+			if i%4 == 0 {
+				store.Set(key, "value")
+			} else {
+				store.Get(key)
+			}
+			i++
+		}
+	})
+}
+
+func BenchmarkKVStore_ParallelSet(b *testing.B) {
+	store := New()
+	defer store.Close()
+	benchmarkParallelSet(b, store)
+}
+
+func BenchmarkShardedKVStore_ParallelSet(b *testing.B) {
+	store := NewSharded(0)
+	defer store.Close()
+	benchmarkParallelSet(b, store)
+}
+
+func BenchmarkKVStore_ParallelMixed(b *testing.B) {
+	store := New()
+	defer store.Close()
+	benchmarkParallelMixed(b, store)
+}
+
+func BenchmarkShardedKVStore_ParallelMixed(b *testing.B) {
+	store := NewSharded(0)
+	defer store.Close()
+	benchmarkParallelMixed(b, store)
+}
@@ -0,0 +1,232 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// A snapshot is a point-in-time image of the in-memory store, written next to the log as "<log>.snap":
+//
+//	magic "KVSN" | version (1 byte) | offset covered (uint64, big endian) | segment name length (uvarint) | segment name |
+//	records... | CRC-32C of all preceding bytes (uint32, big endian)
+//
+// Records use the same framing as the log. On startup the snapshot is loaded and only the log after the
+// covered offset of the named segment is replayed. If compaction has since merged that segment away, the
+// snapshot is ignored and the whole log is replayed. Version 1 snapshots, written before the log was
+// segmented, have no segment name and refer to the original log file.
+const (
+	snapshotMagic   = "KVSN"
+	snapshotVersion = 2
+)
+
+// snapshotPath returns the snapshot file path for a log file path.
+func snapshotPath(logPath string) string {
+	return logPath + ".snap"
+}
+
+// dump returns the records that recreate every live key in the store, ordered by key, preceded by a
+// record holding the version counter so that versions of deleted keys are never reused.
+func (kv *KVStore) dump() []record {
+	kv.mu.RLock()
+	now := kv.now()
+	records := make([]record, 0, len(kv.store)+1)
+	records = append(records, record{op: opVersion, version: kv.version})
+	for node := kv.index.seek(""); node != nil; node = node.next[0] {
+		key, it := node.key, kv.store[node.key]
+		if it.expired(now) {
+			continue
+		}
+		switch {
+		case it.kind != TypeString:
+			records = append(records, it.collectionRecord(key))
+			if !it.expiresAt.IsZero() {
+				records = append(records, record{op: opExpire, key: key, expiresAt: it.expiresAt})
+			}
+		case it.expiresAt.IsZero():
+			records = append(records, record{op: opSet, key: key, value: it.value, version: it.version})
+		default:
+			records = append(records, record{op: opSetExpiry, key: key, value: it.value, expiresAt: it.expiresAt, version: it.version})
+		}
+	}
+	kv.mu.RUnlock()
+	return records
+}
+
+// collectionRecord returns a write record that recreates the collection held by it at key.
+func (it item) collectionRecord(key string) record {
+	rec := record{key: key, version: it.version}
+	switch it.kind {
+	case TypeHash:
+		rec.op, rec.fields = opHSet, hashFields(it.hash)
+	case TypeList:
+		rec.op, rec.fields = opRPush, append([]string(nil), it.list...)
+	case TypeSet:
+		rec.op = opSAdd
+		for member := range it.set {
+			rec.fields = append(rec.fields, member)
+		}
+		sort.Strings(rec.fields)
+	}
+	return rec
+}
+
+// writeSnapshot atomically writes a snapshot of records covering the log up to offset in segment.
+func writeSnapshot(path, segment string, offset int64, records []record) error {
+	tempPath := path + ".tmp"
+	file, err := os.OpenFile(tempPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to create snapshot: %w", err)
+	}
+	defer os.Remove(tempPath) // no-op once renamed
+
+	crc := crc32.New(crcTable)
+	writer := bufio.NewWriter(io.MultiWriter(file, crc))
+
+	header := append([]byte(snapshotMagic), snapshotVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(offset))
+	header = binary.AppendUvarint(header, uint64(len(segment)))
+	header = append(header, segment...)
+	writer.Write(header)
+	for _, rec := range records {
+		writer.Write(rec.marshal())
+	}
+	if err := writer.Flush(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := binary.Write(file, binary.BigEndian, crc.Sum32()); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("failed to sync snapshot: %w", err)
+	}
+	file.Close()
+
+	if err := os.Rename(tempPath, path); err != nil {
+		return fmt.Errorf("failed to install snapshot: %w", err)
+	}
+	return syncDir(filepath.Dir(path))
+}
+
+// readSnapshot reads and verifies a snapshot, returning the segment and offset it covers and its records.
+// An empty segment name means the original log file. A missing file returns an error satisfying
+// os.IsNotExist; any damage returns ErrCorruptLog.
+func readSnapshot(path string) (string, int64, []record, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	if len(data) < len(snapshotMagic)+1+8+4 || string(data[:len(snapshotMagic)]) != snapshotMagic {
+		return "", 0, nil, fmt.Errorf("%w: invalid snapshot header", ErrCorruptLog)
+	}
+	version := data[len(snapshotMagic)]
+	if version != 1 && version != snapshotVersion {
+		return "", 0, nil, fmt.Errorf("kvstore: unsupported snapshot version %d", version)
+	}
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, crcTable) != sum {
+		return "", 0, nil, fmt.Errorf("%w: snapshot checksum mismatch", ErrCorruptLog)
+	}
+
+	rest := body[len(snapshotMagic)+1:]
+	offset := int64(binary.BigEndian.Uint64(rest))
+	rest = rest[8:]
+	var segment string
+	if version >= 2 {
+		name, remaining, ok := readBytes(rest)
+		if !ok {
+			return "", 0, nil, fmt.Errorf("%w: invalid snapshot header", ErrCorruptLog)
+		}
+		segment, rest = string(name), remaining
+	}
+
+	var records []record
+	valid, err := replayWAL(bytes.NewReader(rest), int64(len(rest)), func(rec record) {
+		records = append(records, rec)
+	})
+	if err != nil || valid != int64(len(rest)) {
+		return "", 0, nil, fmt.Errorf("%w: invalid snapshot record", ErrCorruptLog)
+	}
+	return segment, offset, records, nil
+}
+
+// Snapshot writes a point-in-time image of the store to disk, so that the next startup
+// only needs to replay the log written after it. It returns the error that failed the store,
+// without writing a snapshot, once the store has failed: memory may then hold writes the log refused.
+func (p *PersistentKVStore) Snapshot() error {
+	p.snapMu.Lock()
+	defer p.snapMu.Unlock()
+
+	p.mu.Lock()
+	if err := p.failed; err != nil {
+		p.mu.Unlock()
+		return err
+	}
+	segment := p.segments[len(p.segments)-1]
+	offset := p.size
+	records := p.memStore.dump()
+	p.mu.Unlock()
+
+	// The covered offset must be durable, or a crash could leave the snapshot ahead of the log.
+	if err := p.syncNow(); err != nil {
+		return err
+	}
+
+	return writeSnapshot(snapshotPath(p.logPath), segment, offset, records)
+}
+
+// loadSnapshot restores the in-memory store from the snapshot, if a valid one covers a live segment.
+// It returns the index of that segment and the offset to resume replay from, or false if the whole
+// log must be replayed.
+func (p *PersistentKVStore) loadSnapshot() (int, int64, bool) {
+	segment, offset, records, err := readSnapshot(snapshotPath(p.logPath))
+	if err != nil {
+		return 0, 0, false
+	}
+	if segment == "" {
+		segment = filepath.Base(p.logPath)
+	}
+	index := -1
+	for i, name := range p.segments {
+		if name == segment {
+			index = i
+		}
+	}
+	if index < 0 || offset < int64(walHeaderSize) {
+		return 0, 0, false
+	}
+	info, err := os.Stat(p.segmentPath(segment))
+	if err != nil || offset > info.Size() {
+		return 0, 0, false
+	}
+
+	for _, rec := range records {
+		p.memStore.apply(rec)
+	}
+	return index, offset, true
+}
+
+// startSnapshots runs a background goroutine that writes a snapshot every snapshot interval.
+func (p *PersistentKVStore) startSnapshots() {
+	p.every(p.snapshotInterval, func() {
+		p.reportError(p.Snapshot())
+	})
+}
+
+// WithSnapshotInterval writes a snapshot of the store every interval, bounding how much of the log
+// must be replayed on startup. Snapshots are disabled by default.
+func WithSnapshotInterval(interval time.Duration) PersistentOption {
+	return func(p *PersistentKVStore) {
+		p.snapshotInterval = interval
+	}
+}
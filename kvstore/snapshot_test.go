@@ -0,0 +1,181 @@
+package kvstore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestPersistentKVStore_SnapshotAndTail(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	store.SetWithTTL("baz", "qux", time.Hour)
+	store.Set("gone", "x")
+	store.Delete("gone")
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+
+	// Writes after the snapshot must come from the log tail.
+	store.Set("foo", "updated")
+	store.Set("tail", "only")
+	store.Delete("baz")
+	store.Close()
+
+	_, offset, records, err := readSnapshot(snapshotPath(path))
+	if err != nil {
+		t.Fatalf("failed to read snapshot: %v", err)
+	}
+	if len(records) != 3 || records[0].op != opVersion {
+		t.Fatalf("expected the version counter and 2 live keys in snapshot, got %d records", len(records))
+	}
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("foo"); val != "updated" {
+		t.Fatalf("expected tail write to override snapshot, got %q", val)
+	}
+	if val, _ := store2.Get("tail"); val != "only" {
+		t.Fatalf("expected tail-only key, got %q", val)
+	}
+	if _, ok := store2.Get("baz"); ok {
+		t.Fatalf("expected tail delete to apply on top of snapshot")
+	}
+	if _, ok := store2.Get("gone"); ok {
+		t.Fatalf("expected deleted key to stay deleted")
+	}
+	if store2.size <= offset {
+		t.Fatalf("expected log to extend past the snapshot offset")
+	}
+}
+
+func TestPersistentKVStore_CorruptSnapshotFallsBackToLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	store.Close()
+
+	data, _ := os.ReadFile(snapshotPath(path))
+	data[len(data)-5] ^= 0xff
+	os.WriteFile(snapshotPath(path), data, 0644)
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("foo"); val != "bar" {
+		t.Fatalf("expected full log replay after corrupt snapshot, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_SnapshotOfMergedSegmentIsIgnored(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "1")
+	store.Set("foo", "2")
+	if err := store.Snapshot(); err != nil {
+		t.Fatalf("snapshot failed: %v", err)
+	}
+	if err := store.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	store.Set("bar", "baz")
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if _, _, ok := store2.loadSnapshot(); ok {
+		t.Fatalf("expected snapshot of a merged segment to be ignored")
+	}
+	if val, _ := store2.Get("foo"); val != "2" {
+		t.Fatalf("expected 'foo'='2', got %q", val)
+	}
+	if val, _ := store2.Get("bar"); val != "baz" {
+		t.Fatalf("expected 'bar'='baz', got %q", val)
+	}
+}
+
+func TestPersistentKVStore_PeriodicSnapshots(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false, WithSnapshotInterval(10*time.Millisecond))
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	store.Set("foo", "bar")
+
+	time.Sleep(50 * time.Millisecond)
+
+	store.snapMu.Lock()
+	defer store.snapMu.Unlock()
+	if _, _, _, err := readSnapshot(snapshotPath(path)); err != nil {
+		t.Fatalf("expected a periodic snapshot to be written: %v", err)
+	}
+}
+
+func TestPersistentKVStore_SnapshotAfterWriteFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("a", "1")
+
+	// Swap in a log file that cannot be written, so the next write is refused.
+	readOnly, err := os.Open(store.segmentPath(store.segments[len(store.segments)-1]))
+	if err != nil {
+		t.Fatalf("failed to open segment: %v", err)
+	}
+	store.mu.Lock()
+	writable := store.logFile
+	store.logFile = readOnly
+	store.mu.Unlock()
+	defer writable.Close()
+
+	store.Set("b", "2")
+	if err := store.Snapshot(); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected Snapshot to return ErrStoreFailed, got %v", err)
+	}
+	if err := store.Compact(); !errors.Is(err, ErrStoreFailed) {
+		t.Fatalf("expected Compact to return ErrStoreFailed, got %v", err)
+	}
+	if _, err := os.Stat(snapshotPath(path)); !os.IsNotExist(err) {
+		t.Fatalf("expected no snapshot to be written, got %v", err)
+	}
+	store.Close()
+
+	store, err = NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to reopen PersistentKVStore: %v", err)
+	}
+	defer store.Close()
+	if val, _ := store.Get("a"); val != "1" {
+		t.Fatalf("expected the logged write to survive, got %q", val)
+	}
+	if _, ok := store.Get("b"); ok {
+		t.Fatalf("expected the refused write to be absent after reopening")
+	}
+}
@@ -0,0 +1,14 @@
+package kvstore
+
+// Stats is a point-in-time view of a store's counters.
+type Stats struct {
+	Keys    int    // number of keys currently held, including expired keys not yet reaped
+	Bytes   int64  // estimated memory used by keys and values
+	Expired uint64 // number of keys removed by the expiration reaper
+	Evicted uint64 // number of keys removed by the eviction policy
+}
+
+// StatsProvider is implemented by storage backends that expose counters.
+type StatsProvider interface {
+	Stats() Stats
+}
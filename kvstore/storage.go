@@ -1,14 +1,75 @@
 package kvstore
 
-import "time"
+import (
+	"io"
+	"time"
+)
 
-// Storage is an interface that defines the methods for a key-value store.
-// It allows setting, getting, and deleting key-value pairs, as well as setting a value with a time-to-live (TTL).
-// The interface is designed to be implemented by different storage backends, such as in-memory, Redis, or any other key-value store.
-// The methods are designed to be simple and efficient, allowing for easy integration with various storage solutions.
+// Storage is the interface implemented by key-value store backends, such as KVStore, PersistentKVStore,
+// and ShardedKVStore. Every write to a key's value gives the key a new, higher version, while Expire,
+// Persist, and GetAndTouch change only its expiry and keep the version.
 type Storage interface {
+	// Close releases the backend's resources, stopping background work and flushing any buffered writes.
+	io.Closer
+
+	// Set stores value under key without an expiry, replacing any existing value and TTL.
 	Set(key, value string)
+	// SetWithTTL stores value under key, expiring after ttl if it is greater than zero.
 	SetWithTTL(key, value string, ttl time.Duration)
+	// SetWithExpiry stores value under key, expiring at expiresAt, or never if it is zero.
+	SetWithExpiry(key, value string, expiresAt time.Time)
+	// Get returns the value of key, or false if it does not exist or has expired.
 	Get(key string) (string, bool)
+	// Delete removes key, reporting whether it existed and had not expired.
 	Delete(key string) bool
+
+	// Expire sets key to expire after ttl, or removes its expiry if ttl is zero or less, without changing
+	// its value or version. It reports whether the key exists.
+	Expire(key string, ttl time.Duration) bool
+	// Persist removes the expiry of key, reporting whether it exists and had one.
+	Persist(key string) bool
+	// TTL returns the remaining lifetime of key, zero if it never expires, and whether it exists.
+	TTL(key string) (time.Duration, bool)
+	// GetAndTouch returns the value of key and resets its expiry to ttl from now, for sliding expiration.
+	GetAndTouch(key string, ttl time.Duration) (string, bool)
+
+	// IncrBy atomically adds delta to the integer stored at key and returns the new value. A missing key
+	// counts as zero; a value that is not an integer fails with ErrNotInteger.
+	IncrBy(key string, delta int64) (int64, error)
+	// DecrBy atomically subtracts delta from the integer stored at key, like IncrBy with delta negated.
+	DecrBy(key string, delta int64) (int64, error)
+	// IncrByFloat atomically adds delta to the number stored at key and returns the new value. A missing
+	// key counts as zero; a value that is not a number fails with ErrNotNumber.
+	IncrByFloat(key string, delta float64) (float64, error)
+
+	// GetWithVersion returns the value and current version of key, or false if it does not exist.
+	GetWithVersion(key string) (string, uint64, bool)
+	// CompareAndSwap sets key to value only if its version equals version, where zero requires the key to be
+	// absent. It returns the new version and true, or the current version and false.
+	CompareAndSwap(key, value string, version uint64, ttl time.Duration) (uint64, bool)
+	// SetIfNotExists sets key to value only if it is absent or expired, returning the new version and true,
+	// or the current version and false.
+	SetIfNotExists(key, value string, ttl time.Duration) (uint64, bool)
+	// SetIfExists replaces the value of key only if it exists, returning the new version and true,
+	// or zero and false.
+	SetIfExists(key, value string, ttl time.Duration) (uint64, bool)
+	// SetIf sets the key of cond to value only if cond holds, expiring at expiresAt, or never if it is zero.
+	// It returns the new version and true, or the current version and false.
+	SetIf(cond Compare, value string, expiresAt time.Time) (uint64, bool)
+
+	// Scan returns up to limit live keys in [start, end) in ascending order, with their values.
+	// An empty end means no upper bound, and a limit of zero or less means no limit.
+	Scan(start, end string, limit int) []KeyValue
+	// ScanPrefix returns up to limit live keys starting with prefix in ascending order, with their values.
+	ScanPrefix(prefix string, limit int) []KeyValue
+
+	// Txn runs a transaction atomically: no other operation observes or interleaves with it.
+	Txn(txn Txn) TxnResponse
+
+	// MSet stores every entry, as one write where the backend can batch locking and I/O.
+	MSet(entries []Entry)
+	// MGet looks up every key, returning the results in the same order as keys.
+	MGet(keys []string) []Result
+	// MDelete removes every key, reporting for each whether it was found and deleted, as with Delete.
+	MDelete(keys []string) []bool
 }
@@ -0,0 +1,101 @@
+package kvstore
+
+import (
+	"container/heap"
+	"time"
+)
+
+// Expire sets key to expire after ttl, or removes its expiry if ttl is zero or less.
+// The value and version are unchanged. It reports whether the key exists.
+func (kv *KVStore) Expire(key string, ttl time.Duration) bool {
+	_, ok := kv.expire(key, ttl, false)
+	return ok
+}
+
+// Persist removes the expiry of key, so it no longer expires.
+// It reports whether the key exists and had an expiry.
+func (kv *KVStore) Persist(key string) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	it, ok := kv.liveLocked(key, kv.now())
+	if !ok || it.expiresAt.IsZero() {
+		return false
+	}
+	kv.expireLocked(key, it, time.Time{})
+	return true
+}
+
+// TTL returns the remaining lifetime of key and whether it exists.
+// The lifetime is zero for a key that never expires.
+func (kv *KVStore) TTL(key string) (time.Duration, bool) {
+	kv.mu.RLock()
+	defer kv.mu.RUnlock()
+
+	now := kv.now()
+	it, ok := kv.liveLocked(key, now)
+	if !ok || it.expiresAt.IsZero() {
+		return 0, ok
+	}
+	return it.expiresAt.Sub(now), true
+}
+
+// GetAndTouch retrieves the value of key and resets its expiry to ttl from now, for sliding expiration.
+// A ttl of zero or less removes the expiry. If the key does not exist or has expired, it returns false.
+func (kv *KVStore) GetAndTouch(key string, ttl time.Duration) (string, bool) {
+	it, ok := kv.expire(key, ttl, true)
+	return it.value, ok
+}
+
+// expire sets the expiry of a live key to ttl from now and returns the updated item.
+// If access is true the lookup counts as an access for the eviction policy.
+func (kv *KVStore) expire(key string, ttl time.Duration, access bool) (item, bool) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	now := kv.now()
+	var it item
+	var ok bool
+	if access {
+		it, ok = kv.getLocked(key, now)
+	} else {
+		it, ok = kv.liveLocked(key, now)
+	}
+	if !ok {
+		return item{}, false
+	}
+	return kv.expireLocked(key, it, expiryOf(ttl, time.Time{}, now)), true
+}
+
+// expireAt sets the expiry of a live key to an absolute time (zero for never), reporting whether it exists.
+func (kv *KVStore) expireAt(key string, expiresAt time.Time) bool {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	it, ok := kv.liveLocked(key, kv.now())
+	if ok {
+		kv.expireLocked(key, it, expiresAt)
+	}
+	return ok
+}
+
+// liveLocked looks up a key that is present and unexpired, without recording an access.
+// The caller must hold the read or write lock.
+func (kv *KVStore) liveLocked(key string, now time.Time) (item, bool) {
+	it, ok := kv.store[key]
+	if !ok || it.expired(now) {
+		return item{}, false
+	}
+	return it, true
+}
+
+// expireLocked replaces the expiry of it, the current item for key, and reschedules the reaper.
+// The entry for the old expiry becomes stale and is skipped. The caller must hold the write lock.
+func (kv *KVStore) expireLocked(key string, it item, expiresAt time.Time) item {
+	it.expiresAt = expiresAt
+	if !expiresAt.IsZero() {
+		heap.Push(&kv.expiries, expiryEntry{key: key, expiresAt: expiresAt})
+	}
+	kv.putLocked(key, it)
+	return it
+}
@@ -0,0 +1,164 @@
+package kvstore
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestKVStore_ExpireAndTTL(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.Set("session", "data")
+	_, version, _ := store.GetWithVersion("session")
+	if ttl, ok := store.TTL("session"); !ok || ttl != 0 {
+		t.Fatalf("expected key without expiry to report zero TTL, got %v (found=%v)", ttl, ok)
+	}
+
+	if !store.Expire("session", time.Minute) {
+		t.Fatalf("expected Expire to find the key")
+	}
+	clock.Advance(20 * time.Second)
+	if ttl, _ := store.TTL("session"); ttl != 40*time.Second {
+		t.Fatalf("expected 40s remaining, got %v", ttl)
+	}
+	if _, v, _ := store.GetWithVersion("session"); v != version {
+		t.Fatalf("expected Expire to keep version %d, got %d", version, v)
+	}
+
+	if store.Expire("missing", time.Minute) {
+		t.Fatalf("expected Expire on a missing key to fail")
+	}
+	if _, ok := store.TTL("missing"); ok {
+		t.Fatalf("expected TTL on a missing key to report not found")
+	}
+
+	clock.Advance(40 * time.Second)
+	if _, ok := store.Get("session"); ok {
+		t.Fatalf("expected key to expire at its new expiry")
+	}
+	if store.Expire("session", time.Minute) {
+		t.Fatalf("expected Expire on an expired key to fail")
+	}
+}
+
+func TestKVStore_SetWithExpiry(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithExpiry("session", "data", clock.Now().Add(time.Minute))
+	if ttl, ok := store.TTL("session"); !ok || ttl != time.Minute {
+		t.Fatalf("expected 1m remaining, got %v (found=%v)", ttl, ok)
+	}
+	clock.Advance(time.Minute)
+	if _, ok := store.Get("session"); ok {
+		t.Fatalf("expected key to expire at its absolute expiry")
+	}
+
+	store.SetWithExpiry("forever", "data", time.Time{})
+	if ttl, ok := store.TTL("forever"); !ok || ttl != 0 {
+		t.Fatalf("expected a zero expiry to mean no expiry, got %v (found=%v)", ttl, ok)
+	}
+}
+
+func TestKVStore_Persist(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("session", "data", time.Minute)
+	if !store.Persist("session") {
+		t.Fatalf("expected Persist to remove the expiry")
+	}
+	if store.Persist("session") {
+		t.Fatalf("expected Persist on a key without expiry to report false")
+	}
+	clock.Advance(time.Hour)
+	if n := store.sweep(); n != 0 {
+		t.Fatalf("expected the stale expiry to be skipped, removed %d keys", n)
+	}
+	if _, ok := store.Get("session"); !ok {
+		t.Fatalf("expected persisted key to survive past its old expiry")
+	}
+}
+
+func TestKVStore_GetAndTouch(t *testing.T) {
+	clock := newFakeClock()
+	store := New(WithClock(clock.Now), WithSweepInterval(0))
+	defer store.Close()
+
+	store.SetWithTTL("session", "data", time.Minute)
+	for i := 0; i < 3; i++ {
+		clock.Advance(50 * time.Second)
+		if val, ok := store.GetAndTouch("session", time.Minute); !ok || val != "data" {
+			t.Fatalf("expected touch %d to find the key, got %q (found=%v)", i, val, ok)
+		}
+	}
+	if ttl, _ := store.TTL("session"); ttl != time.Minute {
+		t.Fatalf("expected touch to reset the TTL to 1m, got %v", ttl)
+	}
+
+	clock.Advance(time.Minute)
+	if store.sweep() != 1 {
+		t.Fatalf("expected the key to expire once it is no longer touched")
+	}
+	if _, ok := store.GetAndTouch("session", time.Minute); ok {
+		t.Fatalf("expected touch on an expired key to fail")
+	}
+}
+
+func TestPersistentKVStore_ExpiryChangesSurviveRestart(t *testing.T) {
+	clock := newFakeClock()
+	path := filepath.Join(t.TempDir(), "kv.log")
+	open := func() *PersistentKVStore {
+		store, err := NewPersistentKVStore(path, false, WithStoreOptions(WithClock(clock.Now), WithSweepInterval(0)))
+		if err != nil {
+			t.Fatalf("failed to open PersistentKVStore: %v", err)
+		}
+		return store
+	}
+
+	store := open()
+	store.Set("extended", "a")
+	store.Expire("extended", time.Hour)
+	store.SetWithTTL("persisted", "b", time.Minute)
+	store.Persist("persisted")
+	store.SetWithTTL("touched", "c", time.Minute)
+	clock.Advance(30 * time.Second)
+	store.GetAndTouch("touched", time.Minute)
+	store.SetWithTTL("shortened", "d", time.Hour)
+	store.Expire("shortened", time.Second)
+	store.Close()
+
+	check := func(store *PersistentKVStore) {
+		t.Helper()
+		if ttl, _ := store.TTL("extended"); ttl != time.Hour-40*time.Second {
+			t.Fatalf("expected 'extended' to keep its expiry, got %v", ttl)
+		}
+		if ttl, ok := store.TTL("persisted"); !ok || ttl != 0 {
+			t.Fatalf("expected 'persisted' to have no expiry, got %v (found=%v)", ttl, ok)
+		}
+		if ttl, _ := store.TTL("touched"); ttl != 50*time.Second {
+			t.Fatalf("expected 'touched' to keep its touched expiry, got %v", ttl)
+		}
+		if _, ok := store.Get("shortened"); ok {
+			t.Fatalf("expected 'shortened' to expire at its shortened expiry")
+		}
+	}
+
+	clock.Advance(10 * time.Second)
+	store2 := open()
+	check(store2)
+
+	// Compaction folds the expiry changes into the surviving writes.
+	if err := store2.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	store2.Close()
+	store3 := open()
+	defer store3.Close()
+	check(store3)
+}
@@ -0,0 +1,150 @@
+package kvstore
+
+import "time"
+
+// CompareTarget selects what a Compare clause checks.
+type CompareTarget int
+
+const (
+	// CompareValue checks that the key exists and holds Value.
+	CompareValue CompareTarget = iota + 1
+	// CompareVersion checks that the key's version equals Version; zero matches a missing key.
+	CompareVersion
+	// CompareExists checks that the key's existence matches Exists.
+	CompareExists
+)
+
+// Compare is a condition on a single key, evaluated when a transaction runs.
+// Expired keys count as missing.
+type Compare struct {
+	Key     string
+	Target  CompareTarget
+	Value   string
+	Version uint64
+	Exists  bool
+}
+
+// OpType identifies the kind of operation in a transaction.
+type OpType int
+
+const (
+	// OpPut sets Key to Value, expiring at ExpiresAt if it is set, or after TTL if it is greater than zero.
+	OpPut OpType = iota + 1
+	// OpDelete deletes Key.
+	OpDelete
+	// OpGet reads Key, seeing the writes of earlier operations in the same transaction.
+	OpGet
+)
+
+// Op is a single operation in a transaction.
+type Op struct {
+	Type      OpType
+	Key       string
+	Value     string
+	TTL       time.Duration
+	ExpiresAt time.Time
+}
+
+// OpResult is the outcome of one operation in a transaction. Found reports whether a get found the key
+// or a delete removed it, and is always true for a put. Version is the key's version after a put or get.
+type OpResult struct {
+	Key     string
+	Value   string
+	Version uint64
+	Found   bool
+}
+
+// Txn is an etcd-style transaction: if every If clause holds, the Then operations run, otherwise the
+// Else operations run. An empty If always holds.
+type Txn struct {
+	If   []Compare
+	Then []Op
+	Else []Op
+}
+
+// TxnResponse reports which branch of a transaction ran and the result of each of its operations.
+type TxnResponse struct {
+	Succeeded bool
+	Results   []OpResult
+}
+
+// Txn runs a transaction atomically: no other operation observes or interleaves with it.
+func (kv *KVStore) Txn(txn Txn) TxnResponse {
+	resp, _ := kv.txn(txn)
+	return resp
+}
+
+// txn runs a transaction under the write lock and returns its response along with the log records
+// for the changes it made.
+func (kv *KVStore) txn(txn Txn) (TxnResponse, []record) {
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
+
+	resp, records := runTxnLocked(txn, kv.now(), func(string) *KVStore { return kv })
+	kv.evictLocked()
+	return resp, records
+}
+
+// runTxnLocked evaluates a transaction against the stores returned by storeFor, whose write locks the
+// caller must hold for every key the transaction names. The caller must call evictLocked on each store
+// afterwards. It returns the response and the log records for the changes made.
+func runTxnLocked(txn Txn, now time.Time, storeFor func(key string) *KVStore) (TxnResponse, []record) {
+	succeeded := true
+	for _, c := range txn.If {
+		if !storeFor(c.Key).compareLocked(c, now) {
+			succeeded = false
+			break
+		}
+	}
+	ops := txn.Then
+	if !succeeded {
+		ops = txn.Else
+	}
+
+	resp := TxnResponse{Succeeded: succeeded, Results: make([]OpResult, len(ops))}
+	var records []record
+	for i, op := range ops {
+		kv := storeFor(op.Key)
+		result := OpResult{Key: op.Key}
+		switch op.Type {
+		case OpPut:
+			rec := record{key: op.Key, value: op.Value}.withExpiry(expiryOf(op.TTL, op.ExpiresAt, now))
+			rec.version = kv.setLocked(op.Key, op.Value, rec.expiresAt, 0)
+			records = append(records, rec)
+			result.Value, result.Version, result.Found = op.Value, rec.version, true
+		case OpDelete:
+			if kv.deleteLocked(op.Key, now) {
+				records = append(records, record{op: opDelete, key: op.Key})
+				result.Found = true
+			}
+		case OpGet:
+			it, ok := kv.getLocked(op.Key, now)
+			result.Value, result.Version, result.Found = it.value, it.version, ok
+		}
+		resp.Results[i] = result
+	}
+	return resp, records
+}
+
+// compareLocked reports whether a compare clause holds. The caller must hold the read or write lock.
+func (kv *KVStore) compareLocked(c Compare, now time.Time) bool {
+	it, found := kv.store[c.Key]
+	if found && it.expired(now) {
+		it, found = item{}, false
+	}
+	return c.holds(it, found)
+}
+
+// holds reports whether the clause holds for it, the current item for c.Key, where found is false
+// if the key is missing or expired.
+func (c Compare) holds(it item, found bool) bool {
+	switch c.Target {
+	case CompareValue:
+		return found && it.value == c.Value
+	case CompareVersion:
+		return it.version == c.Version
+	case CompareExists:
+		return found == c.Exists
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package kvstore
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testTxn exercises transactions on a Storage backend.
+func testTxn(t *testing.T, store Storage) {
+	t.Helper()
+
+	store.Set("from", "100")
+	_, version, _ := store.GetWithVersion("from")
+
+	resp := store.Txn(Txn{
+		If: []Compare{
+			{Key: "from", Target: CompareVersion, Version: version},
+			{Key: "to", Target: CompareExists, Exists: false},
+		},
+		Then: []Op{
+			{Type: OpPut, Key: "from", Value: "60"},
+			{Type: OpPut, Key: "to", Value: "40", TTL: time.Hour},
+			{Type: OpGet, Key: "to"},
+		},
+		Else: []Op{{Type: OpGet, Key: "from"}},
+	})
+	if !resp.Succeeded || len(resp.Results) != 3 {
+		t.Fatalf("expected the then branch to run, got %+v", resp)
+	}
+	if get := resp.Results[2]; !get.Found || get.Value != "40" || get.Version != resp.Results[1].Version {
+		t.Fatalf("expected a get to see earlier writes in the transaction, got %+v", get)
+	}
+
+	// The version has moved on, so the same transaction now takes the else branch and changes nothing.
+	resp = store.Txn(Txn{
+		If:   []Compare{{Key: "from", Target: CompareVersion, Version: version}},
+		Then: []Op{{Type: OpDelete, Key: "from"}},
+		Else: []Op{{Type: OpGet, Key: "from"}},
+	})
+	if resp.Succeeded || len(resp.Results) != 1 || resp.Results[0].Value != "60" {
+		t.Fatalf("expected the else branch to run, got %+v", resp)
+	}
+
+	resp = store.Txn(Txn{
+		If:   []Compare{{Key: "to", Target: CompareValue, Value: "40"}},
+		Then: []Op{{Type: OpDelete, Key: "to"}, {Type: OpDelete, Key: "missing"}},
+	})
+	if !resp.Succeeded || !resp.Results[0].Found || resp.Results[1].Found {
+		t.Fatalf("unexpected delete results: %+v", resp)
+	}
+	if _, ok := store.Get("to"); ok {
+		t.Fatalf("expected 'to' to be deleted")
+	}
+}
+
+func TestKVStore_Txn(t *testing.T) {
+	store := New()
+	defer store.Close()
+	testTxn(t, store)
+}
+
+func TestShardedKVStore_Txn(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+	testTxn(t, store)
+}
+
+func TestShardedKVStore_TxnIsAtomic(t *testing.T) {
+	store := NewSharded(8)
+	defer store.Close()
+
+	// Concurrent transfers between two keys, likely on different shards, must conserve the total.
+	store.Set("x", "a")
+	store.Set("y", "b")
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				store.Txn(Txn{
+					If:   []Compare{{Key: "x", Target: CompareValue, Value: "a"}},
+					Then: []Op{{Type: OpPut, Key: "x", Value: "b"}, {Type: OpPut, Key: "y", Value: "a"}},
+					Else: []Op{{Type: OpPut, Key: "x", Value: "a"}, {Type: OpPut, Key: "y", Value: "b"}},
+				})
+			}
+		}()
+	}
+	for i := 0; i < 1000; i++ {
+		resp := store.Txn(Txn{Then: []Op{{Type: OpGet, Key: "x"}, {Type: OpGet, Key: "y"}}})
+		if resp.Results[0].Value == resp.Results[1].Value {
+			t.Fatalf("observed a partial transaction: %+v", resp.Results)
+		}
+	}
+	wg.Wait()
+}
+
+func TestPersistentKVStore_TxnIsOneRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	testTxn(t, store)
+	before := store.PersistenceStats().LogSize
+	store.Txn(Txn{Then: []Op{{Type: OpPut, Key: "a", Value: "1"}, {Type: OpPut, Key: "b", Value: "2"}}})
+	store.Close()
+
+	// Tear the final transaction record: neither of its writes may be replayed.
+	segments := store.Segments()
+	active := segments[len(segments)-1]
+	if err := os.Truncate(active, before+10); err != nil {
+		t.Fatalf("failed to truncate log: %v", err)
+	}
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("from"); val != "60" {
+		t.Fatalf("expected committed transaction to survive, got %q", val)
+	}
+	if _, ok := store2.Get("a"); ok {
+		t.Fatalf("expected a torn transaction to be dropped entirely")
+	}
+	if _, ok := store2.Get("b"); ok {
+		t.Fatalf("expected a torn transaction to be dropped entirely")
+	}
+
+	// Compaction splits transactions into plain records without losing them.
+	if err := store2.Compact(); err != nil {
+		t.Fatalf("compaction failed: %v", err)
+	}
+	store2.Close()
+
+	store3, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	defer store3.Close()
+	if val, _ := store3.Get("from"); val != "60" {
+		t.Fatalf("expected transaction writes to survive compaction, got %q", val)
+	}
+}
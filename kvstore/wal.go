@@ -0,0 +1,261 @@
+package kvstore
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+)
+
+// The persistence log is a versioned header followed by a sequence of framed records:
+//
+//	header: magic "KVWL" | version (1 byte)
+//	record: payload length (uint32, big endian) | CRC-32C of payload (uint32, big endian) | payload
+//	payload: op (1 byte) | key length (uvarint) | key | value length (uvarint) | value | time (varint) | version (uvarint)
+//
+// Keys and values are length-prefixed, so they may contain any bytes, including spaces and newlines.
+// The time is an absolute expiry in Unix milliseconds for opSetExpiry and opExpire, where zero means
+// no expiry, and a relative TTL in milliseconds for the older opSetTTL, which is still replayed but no
+// longer written. An opExpire record changes only the expiry of an existing key and has no value.
+// The version is the key's version after a set, or the store's version counter after the write for
+// opDelete and opVersion. Records written before versions were introduced end after the time and are
+// read with version zero.
+// An opTxn record holds the records of one transaction, framed as in the log, as its value, so that a
+// transaction is replayed either completely or not at all. Hash, list, and set records hold their fields,
+// elements, or members as a sequence of length-prefixed (uvarint) strings in the value; opHSet alternates
+// fields and values, and opLPop holds the elements it removed.
+const (
+	walMagic         = "KVWL"
+	walVersion       = 1
+	walHeaderSize    = len(walMagic) + 1
+	recordHeaderSize = 8
+)
+
+// Record operations.
+const (
+	opSet       byte = 1
+	opSetTTL    byte = 2 // relative TTL; superseded by opSetExpiry
+	opDelete    byte = 3
+	opSetExpiry byte = 4
+	opVersion   byte = 5 // raises the version counter without touching any key
+	opTxn       byte = 6 // the records of one transaction
+	opExpire    byte = 7 // changes the expiry of an existing key
+	opHSet      byte = 8
+	opHDel      byte = 9
+	opLPush     byte = 10
+	opRPush     byte = 11
+	opLPop      byte = 12
+	opSAdd      byte = 13
+	opSRem      byte = 14
+)
+
+// isCollectionOp reports whether op is a hash, list, or set write, whose value holds its fields.
+func isCollectionOp(op byte) bool {
+	return op >= opHSet && op <= opSRem
+}
+
+// ErrCorruptLog is returned when a persistence log contains a damaged record that is not the final one,
+// meaning data after it cannot be trusted or recovered automatically.
+var ErrCorruptLog = errors.New("kvstore: corrupt persistence log")
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// record is a single logged mutation.
+type record struct {
+	op        byte
+	key       string
+	value     string
+	ttl       time.Duration // opSetTTL only
+	expiresAt time.Time     // opSetExpiry and opExpire only
+	version   uint64        // zero if unknown
+	records   []record      // opTxn only
+	fields    []string      // hash, list, and set writes only
+}
+
+// walHeader returns the file header for the current log version.
+func walHeader() []byte {
+	return append([]byte(walMagic), walVersion)
+}
+
+// marshal encodes the record as a framed, checksummed entry ready to append to the log.
+func (r record) marshal() []byte {
+	if r.op == opTxn {
+		var nested []byte
+		for _, rec := range r.records {
+			nested = append(nested, rec.marshal()...)
+		}
+		r.value = string(nested)
+	}
+	if isCollectionOp(r.op) {
+		var encoded []byte
+		for _, field := range r.fields {
+			encoded = binary.AppendUvarint(encoded, uint64(len(field)))
+			encoded = append(encoded, field...)
+		}
+		r.value = string(encoded)
+	}
+	payload := make([]byte, 0, 1+4*binary.MaxVarintLen64+len(r.key)+len(r.value))
+	payload = append(payload, r.op)
+	payload = binary.AppendUvarint(payload, uint64(len(r.key)))
+	payload = append(payload, r.key...)
+	payload = binary.AppendUvarint(payload, uint64(len(r.value)))
+	payload = append(payload, r.value...)
+	switch r.op {
+	case opSetExpiry:
+		payload = binary.AppendVarint(payload, r.expiresAt.UnixMilli())
+	case opExpire:
+		var millis int64
+		if !r.expiresAt.IsZero() {
+			millis = r.expiresAt.UnixMilli()
+		}
+		payload = binary.AppendVarint(payload, millis)
+	default:
+		payload = binary.AppendVarint(payload, r.ttl.Milliseconds())
+	}
+	payload = binary.AppendUvarint(payload, r.version)
+
+	buf := make([]byte, recordHeaderSize, recordHeaderSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint32(buf[4:8], crc32.Checksum(payload, crcTable))
+	return append(buf, payload...)
+}
+
+// withExpiry returns a set record with its expiry replaced by expiresAt, where zero means no expiry.
+func (r record) withExpiry(expiresAt time.Time) record {
+	r.op, r.ttl, r.expiresAt = opSet, 0, expiresAt
+	if !expiresAt.IsZero() {
+		r.op = opSetExpiry
+	}
+	return r
+}
+
+// unmarshalRecord decodes a record payload whose checksum has already been verified.
+func unmarshalRecord(payload []byte) (record, error) {
+	var r record
+	if len(payload) == 0 {
+		return r, ErrCorruptLog
+	}
+	r.op = payload[0]
+	rest := payload[1:]
+
+	key, rest, ok := readBytes(rest)
+	if !ok {
+		return r, ErrCorruptLog
+	}
+	value, rest, ok := readBytes(rest)
+	if !ok {
+		return r, ErrCorruptLog
+	}
+	millis, n := binary.Varint(rest)
+	if n <= 0 {
+		return r, ErrCorruptLog
+	}
+	if rest = rest[n:]; len(rest) > 0 {
+		if r.version, n = binary.Uvarint(rest); n <= 0 {
+			return r, ErrCorruptLog
+		}
+	}
+
+	r.key = string(key)
+	r.value = string(value)
+	if r.op == opTxn {
+		valid, err := replayWAL(bytes.NewReader(value), int64(len(value)), func(rec record) {
+			r.records = append(r.records, rec)
+		})
+		if err != nil || valid != int64(len(value)) {
+			return r, ErrCorruptLog
+		}
+		r.value = ""
+	}
+	if isCollectionOp(r.op) {
+		for rest := value; len(rest) > 0; {
+			var field []byte
+			if field, rest, ok = readBytes(rest); !ok {
+				return r, ErrCorruptLog
+			}
+			r.fields = append(r.fields, string(field))
+		}
+		r.value = ""
+	}
+	switch r.op {
+	case opSetExpiry:
+		r.expiresAt = time.UnixMilli(millis)
+	case opExpire:
+		if millis != 0 {
+			r.expiresAt = time.UnixMilli(millis)
+		}
+	default:
+		r.ttl = time.Duration(millis) * time.Millisecond
+	}
+	return r, nil
+}
+
+// readBytes reads a uvarint length-prefixed byte string from buf and returns it with the remaining bytes.
+func readBytes(buf []byte) ([]byte, []byte, bool) {
+	n, size := binary.Uvarint(buf)
+	if size <= 0 || n > uint64(len(buf)-size) {
+		return nil, nil, false
+	}
+	buf = buf[size:]
+	return buf[:n], buf[n:], true
+}
+
+// checkWALHeader verifies that header holds a supported log header.
+func checkWALHeader(header []byte) error {
+	if len(header) < walHeaderSize || string(header[:len(walMagic)]) != walMagic {
+		return fmt.Errorf("%w: missing file header", ErrCorruptLog)
+	}
+	if v := header[len(walMagic)]; v != walVersion {
+		return fmt.Errorf("kvstore: unsupported persistence log version %d", v)
+	}
+	return nil
+}
+
+// replayWAL reads framed records from r, which must be positioned just after the file header,
+// and calls apply for each valid record in order. size is the number of bytes remaining in r.
+//
+// It returns the number of bytes holding complete, valid records. A torn or damaged final record
+// stops the replay without error, so the caller can truncate the log to the returned length.
+// A damaged record followed by more data returns ErrCorruptLog.
+func replayWAL(r io.Reader, size int64, apply func(record)) (int64, error) {
+	br := bufio.NewReader(r)
+	var offset int64
+	header := make([]byte, recordHeaderSize)
+	for {
+		if _, err := io.ReadFull(br, header); err != nil {
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				return offset, nil // clean end, or a torn record header
+			}
+			return offset, err
+		}
+		length := binary.BigEndian.Uint32(header[0:4])
+		sum := binary.BigEndian.Uint32(header[4:8])
+		end := offset + recordHeaderSize + int64(length)
+		if end > size {
+			return offset, nil // torn final record
+		}
+
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(br, payload); err != nil {
+			return offset, err
+		}
+		var rec record
+		err := ErrCorruptLog
+		if crc32.Checksum(payload, crcTable) == sum {
+			rec, err = unmarshalRecord(payload)
+		}
+		if err != nil {
+			if end == size {
+				return offset, nil // damaged final record, most likely a partial write
+			}
+			return offset, fmt.Errorf("%w: bad record at offset %d", ErrCorruptLog, offset)
+		}
+
+		apply(rec)
+		offset = end
+	}
+}
@@ -0,0 +1,179 @@
+package kvstore
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRecord_MarshalRoundTrip(t *testing.T) {
+	want := record{op: opSetTTL, key: "a key\nwith newline", value: "a value with spaces", ttl: 1500 * time.Millisecond}
+
+	var got []record
+	data := want.marshal()
+	n, err := replayWAL(bytes.NewReader(data), int64(len(data)), func(rec record) {
+		got = append(got, rec)
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if n != int64(len(data)) {
+		t.Fatalf("expected %d valid bytes, got %d", len(data), n)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestRecord_TxnRoundTrip(t *testing.T) {
+	want := record{op: opTxn, records: []record{
+		{op: opSet, key: "a", value: "1", version: 7},
+		{op: opDelete, key: "b"},
+	}}
+
+	var got []record
+	data := want.marshal()
+	if _, err := replayWAL(bytes.NewReader(data), int64(len(data)), func(rec record) {
+		got = append(got, rec)
+	}); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(got) != 1 || !reflect.DeepEqual(got[0], want) {
+		t.Fatalf("expected %+v, got %+v", want, got)
+	}
+}
+
+func TestReplayWAL_TornFinalRecord(t *testing.T) {
+	first := record{op: opSet, key: "foo", value: "bar"}.marshal()
+	second := record{op: opSet, key: "baz", value: "qux"}.marshal()
+	data := append(append([]byte{}, first...), second[:len(second)-3]...)
+
+	count := 0
+	n, err := replayWAL(bytes.NewReader(data), int64(len(data)), func(record) { count++ })
+	if err != nil {
+		t.Fatalf("expected torn record to be tolerated, got: %v", err)
+	}
+	if count != 1 || n != int64(len(first)) {
+		t.Fatalf("expected 1 record and %d valid bytes, got %d records and %d bytes", len(first), count, n)
+	}
+}
+
+func TestReplayWAL_CorruptMiddleRecord(t *testing.T) {
+	first := record{op: opSet, key: "foo", value: "bar"}.marshal()
+	second := record{op: opSet, key: "baz", value: "qux"}.marshal()
+	first[len(first)-2] ^= 0xff
+	data := append(append([]byte{}, first...), second...)
+
+	_, err := replayWAL(bytes.NewReader(data), int64(len(data)), func(record) {})
+	if !errors.Is(err, ErrCorruptLog) {
+		t.Fatalf("expected ErrCorruptLog, got: %v", err)
+	}
+}
+
+func TestPersistentKVStore_BinarySafeValues(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("greeting", "hello world\nsecond line")
+	store.Set("key with spaces", "v")
+	store.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store2.Get("greeting"); val != "hello world\nsecond line" {
+		t.Fatalf("expected value with spaces and newline to survive, got %q", val)
+	}
+	if _, ok := store2.Get("key with spaces"); !ok {
+		t.Fatalf("expected key with spaces to survive")
+	}
+}
+
+func TestPersistentKVStore_TruncatesTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to create PersistentKVStore: %v", err)
+	}
+	store.Set("foo", "bar")
+	store.Close()
+
+	info, _ := os.Stat(path)
+	goodSize := info.Size()
+	torn := record{op: opSet, key: "baz", value: "qux"}.marshal()
+	f, _ := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	f.Write(torn[:len(torn)/2])
+	f.Close()
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if _, ok := store2.Get("foo"); !ok {
+		t.Fatalf("expected intact record to be recovered")
+	}
+	if _, ok := store2.Get("baz"); ok {
+		t.Fatalf("expected torn record to be discarded")
+	}
+	info, _ = os.Stat(path)
+	if info.Size() != goodSize {
+		t.Fatalf("expected log to be truncated to %d bytes, got %d", goodSize, info.Size())
+	}
+
+	// New writes must land after the truncation point and be readable.
+	store2.Set("baz", "qux")
+	store2.Close()
+	store3, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to recover PersistentKVStore: %v", err)
+	}
+	if val, _ := store3.Get("baz"); val != "qux" {
+		t.Fatalf("expected write after truncation to survive, got %q", val)
+	}
+}
+
+func TestPersistentKVStore_MigratesTextLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	legacy := "SET foo bar\nSETTTL baz qux 60000\nSET gone x\nDEL gone\n"
+	if err := os.WriteFile(path, []byte(legacy), 0644); err != nil {
+		t.Fatalf("failed to write legacy log: %v", err)
+	}
+
+	store, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to migrate legacy log: %v", err)
+	}
+	if val, _ := store.Get("foo"); val != "bar" {
+		t.Fatalf("expected 'foo' to be migrated, got %q", val)
+	}
+	if val, _ := store.Get("baz"); val != "qux" {
+		t.Fatalf("expected 'baz' to be migrated, got %q", val)
+	}
+	if _, ok := store.Get("gone"); ok {
+		t.Fatalf("expected deleted key to stay deleted")
+	}
+	store.Close()
+
+	data, _ := os.ReadFile(path)
+	if !strings.HasPrefix(string(data), walMagic) {
+		t.Fatalf("expected log to be rewritten in the binary format")
+	}
+
+	store2, err := NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to reopen migrated log: %v", err)
+	}
+	if val, _ := store2.Get("foo"); val != "bar" {
+		t.Fatalf("expected 'foo' after reopening migrated log, got %q", val)
+	}
+}
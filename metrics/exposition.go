@@ -0,0 +1,135 @@
+// Package metrics writes metrics in the Prometheus text exposition format, without depending on a client library.
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ContentType is the media type of the Prometheus text exposition format.
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// Exposition collects samples, grouped into metric families, for writing in the text exposition format.
+// Labels are given as name, value pairs. It is not safe for concurrent use.
+type Exposition struct {
+	families []*family
+	byName   map[string]*family
+}
+
+// family is a named metric and its samples.
+type family struct {
+	name, help, kind string
+	lines            []string
+}
+
+// NewExposition creates an empty exposition.
+func NewExposition() *Exposition {
+	return &Exposition{byName: make(map[string]*family)}
+}
+
+// Counter adds a sample of a counter, a value that only increases.
+func (e *Exposition) Counter(name, help string, value float64, labels ...string) {
+	f := e.family(name, help, "counter")
+	f.lines = append(f.lines, sample(name, labels, value))
+}
+
+// Gauge adds a sample of a gauge, a value that may go up and down.
+func (e *Exposition) Gauge(name, help string, value float64, labels ...string) {
+	f := e.family(name, help, "gauge")
+	f.lines = append(f.lines, sample(name, labels, value))
+}
+
+// Histogram adds a histogram's buckets, sum, and count.
+func (e *Exposition) Histogram(name, help string, h HistogramSnapshot, labels ...string) {
+	f := e.family(name, help, "histogram")
+	for i, bound := range h.Bounds {
+		f.lines = append(f.lines, sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", formatFloat(bound)), float64(h.Counts[i])))
+	}
+	f.lines = append(f.lines,
+		sample(name+"_bucket", append(labels[:len(labels):len(labels)], "le", "+Inf"), float64(h.Count)),
+		sample(name+"_sum", labels, h.Sum),
+		sample(name+"_count", labels, float64(h.Count)),
+	)
+}
+
+// family returns the named family, creating it on first use. Samples keep the type the family was created with.
+func (e *Exposition) family(name, help, kind string) *family {
+	f, ok := e.byName[name]
+	if !ok {
+		f = &family{name: name, help: help, kind: kind}
+		e.byName[name] = f
+		e.families = append(e.families, f)
+	}
+	return f
+}
+
+// WriteTo writes every family, in the order each was first added.
+func (e *Exposition) WriteTo(w io.Writer) (int64, error) {
+	bw := bufio.NewWriter(w)
+	var n int64
+	for _, f := range e.families {
+		c, _ := fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s %s\n", f.name, helpEscaper.Replace(f.help), f.name, f.kind)
+		n += int64(c)
+		for _, line := range f.lines {
+			c, _ := bw.WriteString(line)
+			n += int64(c)
+		}
+	}
+	return n, bw.Flush()
+}
+
+// Handler serves the metrics that collect adds to a new exposition on each scrape.
+func Handler(collect func(*Exposition)) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		e := NewExposition()
+		collect(e)
+		w.Header().Set("Content-Type", ContentType)
+		e.WriteTo(w)
+	})
+}
+
+// sample formats one sample line.
+func sample(name string, labels []string, value float64) string {
+	var b strings.Builder
+	b.WriteString(name)
+	if len(labels) > 0 {
+		b.WriteByte('{')
+		for i := 0; i+1 < len(labels); i += 2 {
+			if i > 0 {
+				b.WriteByte(',')
+			}
+			b.WriteString(labels[i])
+			b.WriteString(`="`)
+			b.WriteString(labelEscaper.Replace(labels[i+1]))
+			b.WriteByte('"')
+		}
+		b.WriteByte('}')
+	}
+	b.WriteByte(' ')
+	b.WriteString(formatFloat(value))
+	b.WriteByte('\n')
+	return b.String()
+}
+
+var (
+	labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	helpEscaper  = strings.NewReplacer(`\`, `\\`, "\n", `\n`)
+)
+
+// formatFloat formats a sample value as the exposition format expects.
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,71 @@
+package metrics
+
+import (
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExposition_Format(t *testing.T) {
+	e := NewExposition()
+	e.Counter("requests_total", "Requests handled.", 3, "method", "Get", "code", "OK")
+	e.Gauge("keys", "Keys held.", 42)
+	e.Counter("requests_total", "Requests handled.", 1, "method", "Set", "code", "Internal")
+	e.Gauge("odd", "Help with a \\ and\na newline.", math.Inf(1), "name", "a \"quoted\"\nvalue")
+
+	var b strings.Builder
+	if _, err := e.WriteTo(&b); err != nil {
+		t.Fatalf("WriteTo failed: %v", err)
+	}
+	want := `# HELP requests_total Requests handled.
+# TYPE requests_total counter
+requests_total{method="Get",code="OK"} 3
+requests_total{method="Set",code="Internal"} 1
+# HELP keys Keys held.
+# TYPE keys gauge
+keys 42
+# HELP odd Help with a \\ and\na newline.
+# TYPE odd gauge
+odd{name="a \"quoted\"\nvalue"} +Inf
+`
+	if b.String() != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", b.String(), want)
+	}
+}
+
+func TestExposition_Histogram(t *testing.T) {
+	h := NewHistogram(1, 0.1)
+	h.Observe(0.05)
+	h.Observe(0.5)
+	h.ObserveDuration(2 * time.Second)
+
+	handler := Handler(func(e *Exposition) {
+		e.Histogram("latency_seconds", "Latency.", h.Snapshot(), "method", "Get")
+	})
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	if ct := rec.Header().Get("Content-Type"); ct != ContentType {
+		t.Fatalf("expected content type %q, got %q", ContentType, ct)
+	}
+	want := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{method="Get",le="0.1"} 1
+latency_seconds_bucket{method="Get",le="1"} 2
+latency_seconds_bucket{method="Get",le="+Inf"} 3
+latency_seconds_sum{method="Get"} 2.55
+latency_seconds_count{method="Get"} 3
+`
+	if rec.Body.String() != want {
+		t.Fatalf("unexpected exposition:\n%s\nwant:\n%s", rec.Body.String(), want)
+	}
+}
+
+func TestHistogram_Nil(t *testing.T) {
+	var h *Histogram
+	if snap := h.Snapshot(); snap.Count != 0 || len(snap.Bounds) != 0 {
+		t.Fatalf("expected an empty snapshot, got %+v", snap)
+	}
+}
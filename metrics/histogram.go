@@ -0,0 +1,68 @@
+package metrics
+
+import (
+	"math"
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultDurationBuckets are histogram bucket upper bounds, in seconds, suited to request and disk latencies.
+var DefaultDurationBuckets = []float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Histogram counts observations into buckets. It is safe for concurrent use.
+type Histogram struct {
+	bounds []float64       // bucket upper bounds, ascending
+	counts []atomic.Uint64 // observations per bucket, with a last bucket for values above every bound
+	sum    atomic.Uint64   // float64 bits
+}
+
+// NewHistogram creates a histogram with the given bucket upper bounds, or DefaultDurationBuckets if there are none.
+func NewHistogram(bounds ...float64) *Histogram {
+	if len(bounds) == 0 {
+		bounds = DefaultDurationBuckets
+	}
+	bounds = append([]float64(nil), bounds...)
+	sort.Float64s(bounds)
+	return &Histogram{bounds: bounds, counts: make([]atomic.Uint64, len(bounds)+1)}
+}
+
+// Observe records a value.
+func (h *Histogram) Observe(v float64) {
+	h.counts[sort.SearchFloat64s(h.bounds, v)].Add(1)
+	for {
+		old := h.sum.Load()
+		if h.sum.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+v)) {
+			return
+		}
+	}
+}
+
+// ObserveDuration records a duration in seconds.
+func (h *Histogram) ObserveDuration(d time.Duration) {
+	h.Observe(d.Seconds())
+}
+
+// HistogramSnapshot is a point-in-time view of a histogram.
+type HistogramSnapshot struct {
+	Bounds []float64 // bucket upper bounds, ascending
+	Counts []uint64  // cumulative number of observations at or below each bound
+	Count  uint64    // total number of observations
+	Sum    float64   // sum of all observations
+}
+
+// Snapshot returns the histogram's current counts. A nil histogram has none.
+func (h *Histogram) Snapshot() HistogramSnapshot {
+	if h == nil {
+		return HistogramSnapshot{}
+	}
+	snap := HistogramSnapshot{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds))}
+	var total uint64
+	for i := range h.bounds {
+		total += h.counts[i].Load()
+		snap.Counts[i] = total
+	}
+	snap.Count = total + h.counts[len(h.bounds)].Load()
+	snap.Sum = math.Float64frombits(h.sum.Load())
+	return snap
+}
@@ -0,0 +1,299 @@
+package server
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/ahmad-masud/KVStore/proto"
+)
+
+// Permission is a set of actions a principal may take on keys.
+type Permission uint8
+
+const (
+	// PermRead allows reading values, TTLs, and types, and listing and watching keys.
+	PermRead Permission = 1 << iota
+	// PermWrite allows writing values, TTLs, counters, and collections.
+	PermWrite
+	// PermDelete allows deleting keys.
+	PermDelete
+	// PermAdmin allows creating, listing, and dropping namespaces. It must be granted on the empty prefix.
+	PermAdmin
+)
+
+// permissionNames maps the names used in auth config files to permissions.
+var permissionNames = map[string]Permission{
+	"read":   PermRead,
+	"write":  PermWrite,
+	"delete": PermDelete,
+	"admin":  PermAdmin,
+}
+
+// String returns the permission's names joined by "+", such as "read+write".
+func (p Permission) String() string {
+	var names []string
+	for _, name := range []string{"read", "write", "delete", "admin"} {
+		if p&permissionNames[name] != 0 {
+			names = append(names, name)
+		}
+	}
+	return strings.Join(names, "+")
+}
+
+// Grant gives permissions on every key that starts with Prefix. An empty prefix covers every key.
+type Grant struct {
+	Prefix      string
+	Permissions Permission
+}
+
+// ACL maps principals to roles, and roles to the grants they hold.
+// A principal may do whatever any of its roles' grants allow; everything else is denied.
+// An ACL must not be changed once it is passed to a server.
+type ACL struct {
+	roles    map[string][]Grant
+	bindings map[string][]string // principal to role names
+}
+
+// NewACL creates an empty ACL that denies everything.
+func NewACL() *ACL {
+	return &ACL{
+		roles:    make(map[string][]Grant),
+		bindings: make(map[string][]string),
+	}
+}
+
+// AddRole adds grants to a role, creating it if needed.
+func (a *ACL) AddRole(role string, grants ...Grant) {
+	a.roles[role] = append(a.roles[role], grants...)
+}
+
+// Bind gives a principal the named roles.
+func (a *ACL) Bind(principal string, roles ...string) {
+	a.bindings[principal] = append(a.bindings[principal], roles...)
+}
+
+// Allowed reports whether principal holds every permission in perm on key.
+func (a *ACL) Allowed(principal, key string, perm Permission) bool {
+	return a.allowed(principal, scope{key: key, perm: perm})
+}
+
+// allowed reports whether principal holds every permission in s.perm on the key, or on every key
+// with the prefix, named by s. Permissions may come from different grants.
+func (a *ACL) allowed(principal string, s scope) bool {
+	var held Permission
+	for _, role := range a.bindings[principal] {
+		for _, grant := range a.roles[role] {
+			if strings.HasPrefix(s.key, grant.Prefix) {
+				held |= grant.Permissions
+			}
+		}
+	}
+	return held&s.perm == s.perm
+}
+
+// AuthConfig is an auth config file: bearer tokens, the roles principals hold, the grants of each role,
+// and the namespaces principals are confined to.
+//
+//	{
+//	  "tokens": {"<hex SHA-256 of the token>": "ci-bot"},
+//	  "principals": {"ci-bot": ["writer"], "billing.internal": ["reader"]},
+//	  "roles": {
+//	    "writer": [{"prefix": "app/", "permissions": ["read", "write", "delete"]}],
+//	    "reader": [{"prefix": "", "permissions": ["read"]}]
+//	  },
+//	  "namespaces": {"ci-bot": "ci"}
+//	}
+//
+// Principals are the names returned by the authenticators: the token's name for a bearer token,
+// or the common name of a client certificate.
+type AuthConfig struct {
+	Tokens     map[string]string       `json:"tokens"`
+	Principals map[string][]string     `json:"principals"`
+	Roles      map[string][]GrantEntry `json:"roles"`
+	Namespaces map[string]string       `json:"namespaces"`
+}
+
+// GrantEntry is a grant as written in an auth config file.
+type GrantEntry struct {
+	Prefix      string   `json:"prefix"`
+	Permissions []string `json:"permissions"`
+}
+
+// LoadAuthConfig reads and validates an auth config file.
+func LoadAuthConfig(path string) (*AuthConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config AuthConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("parse auth config %s: %w", path, err)
+	}
+	if err := config.validate(); err != nil {
+		return nil, fmt.Errorf("invalid auth config %s: %w", path, err)
+	}
+	return &config, nil
+}
+
+// validate checks that token hashes are well-formed and that every role and permission exists.
+func (c *AuthConfig) validate() error {
+	for hash := range c.Tokens {
+		if b, err := hex.DecodeString(hash); err != nil || len(b) != 32 {
+			return fmt.Errorf("token %q is not a hex SHA-256 hash", hash)
+		}
+	}
+	for principal, roles := range c.Principals {
+		for _, role := range roles {
+			if _, ok := c.Roles[role]; !ok {
+				return fmt.Errorf("principal %q has unknown role %q", principal, role)
+			}
+		}
+	}
+	for role, grants := range c.Roles {
+		for _, grant := range grants {
+			for _, name := range grant.Permissions {
+				if _, ok := permissionNames[name]; !ok {
+					return fmt.Errorf("role %q has unknown permission %q", role, name)
+				}
+				if name == "admin" && grant.Prefix != "" {
+					return fmt.Errorf("role %q grants admin on prefix %q; admin must be granted on the empty prefix", role, grant.Prefix)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// ACL builds the ACL described by the config.
+func (c *AuthConfig) ACL() *ACL {
+	acl := NewACL()
+	for role, entries := range c.Roles {
+		grants := make([]Grant, len(entries))
+		for i, entry := range entries {
+			grants[i].Prefix = entry.Prefix
+			for _, name := range entry.Permissions {
+				grants[i].Permissions |= permissionNames[name]
+			}
+		}
+		acl.AddRole(role, grants...)
+	}
+	for principal, roles := range c.Principals {
+		acl.Bind(principal, roles...)
+	}
+	return acl
+}
+
+// Authenticators returns a bearer-token authenticator for the config's tokens, if it has any,
+// followed by an mTLS authenticator.
+func (c *AuthConfig) Authenticators() []Authenticator {
+	var authenticators []Authenticator
+	if len(c.Tokens) > 0 {
+		authenticators = append(authenticators, NewBearerTokenAuthenticator(c.Tokens))
+	}
+	return append(authenticators, NewMTLSAuthenticator())
+}
+
+// scope is a key, or every key with a prefix, and the permissions a request needs on it.
+type scope struct {
+	key    string
+	prefix bool
+	perm   Permission
+}
+
+// requestScopes returns the keys a KVStore request touches and the permissions it needs on each.
+// It returns false for a request it does not know, which must then be denied.
+func requestScopes(req interface{}) ([]scope, bool) {
+	switch req := req.(type) {
+	case *proto.GetRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.TTLRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.TypeRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.HGetRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.KeyRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.LRangeRequest:
+		return []scope{{key: req.Key, perm: PermRead}}, true
+	case *proto.MGetRequest:
+		return keyScopes(req.Keys, PermRead), true
+	case *proto.ListRequest:
+		return []scope{{key: req.Prefix, prefix: true, perm: PermRead}}, true
+	case *proto.WatchRequest:
+		return []scope{{key: req.Key, prefix: req.Prefix, perm: PermRead}}, true
+
+	case *proto.SetRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.CompareAndSwapRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.ExpireRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.PersistRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.IncrByRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.IncrByFloatRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.HSetRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.HDelRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.PushRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.MembersRequest:
+		return []scope{{key: req.Key, perm: PermWrite}}, true
+	case *proto.MSetRequest:
+		scopes := make([]scope, len(req.Entries))
+		for i, entry := range req.Entries {
+			scopes[i] = scope{key: entry.Key, perm: PermWrite}
+		}
+		return scopes, true
+
+	case *proto.GetAndTouchRequest:
+		return []scope{{key: req.Key, perm: PermRead | PermWrite}}, true
+	case *proto.LPopRequest:
+		return []scope{{key: req.Key, perm: PermRead | PermWrite}}, true
+
+	case *proto.DeleteRequest:
+		return []scope{{key: req.Key, perm: PermDelete}}, true
+	case *proto.MDeleteRequest:
+		return keyScopes(req.Keys, PermDelete), true
+
+	case *proto.CreateNamespaceRequest, *proto.ListNamespacesRequest, *proto.DropNamespaceRequest:
+		return []scope{{prefix: true, perm: PermAdmin}}, true
+
+	case *proto.TxnRequest:
+		var scopes []scope
+		for _, cmp := range req.Compare {
+			scopes = append(scopes, scope{key: cmp.Key, perm: PermRead})
+		}
+		// Either branch may run, so both must be allowed.
+		for _, ops := range [][]*proto.TxnOp{req.Success, req.Failure} {
+			for _, op := range ops {
+				perm := PermRead
+				switch op.Type {
+				case proto.TxnOp_PUT:
+					perm = PermWrite
+				case proto.TxnOp_DELETE:
+					perm = PermDelete
+				}
+				scopes = append(scopes, scope{key: op.Key, perm: perm})
+			}
+		}
+		return scopes, true
+	}
+	return nil, false
+}
+
+// keyScopes returns a scope needing perm for each key.
+func keyScopes(keys []string, perm Permission) []scope {
+	scopes := make([]scope, len(keys))
+	for i, key := range keys {
+		scopes[i] = scope{key: key, perm: perm}
+	}
+	return scopes
+}
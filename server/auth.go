@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// ErrNoCredentials is returned by an Authenticator when a request carries no credentials of its kind,
+// so that the next authenticator can try.
+var ErrNoCredentials = errors.New("no credentials")
+
+// Authenticator identifies the principal making a request.
+type Authenticator interface {
+	// Authenticate returns the name of the principal that sent the request in ctx. It returns
+	// ErrNoCredentials if the request has no credentials of its kind, and any other error if
+	// it has credentials that are not valid.
+	Authenticate(ctx context.Context) (string, error)
+}
+
+// WithAuthenticators requires every request to be authenticated by one of the authenticators,
+// tried in order. Requests that none of them accept fail with Unauthenticated.
+func WithAuthenticators(authenticators ...Authenticator) Option {
+	return func(s *Server) {
+		s.authenticators = append(s.authenticators, authenticators...)
+	}
+}
+
+// WithACL checks every KVStore request against acl, failing with PermissionDenied unless the
+// authenticated principal holds the permissions the request needs on each key it touches.
+// It requires WithAuthenticators.
+func WithACL(acl *ACL) Option {
+	return func(s *Server) {
+		s.acl = acl
+	}
+}
+
+// WithAuthConfig loads an auth config file, authenticating requests by bearer token or client
+// certificate, checking them against the file's ACL, and binding principals to its namespaces.
+// See AuthConfig for the format. Listen fails if the file cannot be loaded.
+func WithAuthConfig(path string) Option {
+	return func(s *Server) {
+		config, err := LoadAuthConfig(path)
+		if err != nil {
+			s.optionFailed(fmt.Errorf("failed to load auth config: %w", err))
+			return
+		}
+		s.authenticators = append(s.authenticators, config.Authenticators()...)
+		s.acl = config.ACL()
+		WithNamespaceBindings(config.Namespaces)(s)
+	}
+}
+
+// principalKey is the context key under which the authenticated principal is stored.
+type principalKey struct{}
+
+// PrincipalFromContext returns the principal that authenticated the request, if any.
+// Hooks can use it to make their own decisions about the caller.
+func PrincipalFromContext(ctx context.Context) (string, bool) {
+	principal, ok := ctx.Value(principalKey{}).(string)
+	return principal, ok
+}
+
+// HashToken returns the hex SHA-256 hash of a bearer token, the form in which tokens are configured.
+func HashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerTokenAuthenticator accepts "authorization: Bearer <token>" metadata.
+type bearerTokenAuthenticator struct {
+	principals map[string]string // token hash to principal
+}
+
+// NewBearerTokenAuthenticator authenticates requests with an "authorization: Bearer <token>" header.
+// tokens maps the HashToken of each accepted token to the principal it identifies, so the tokens
+// themselves need not be stored.
+func NewBearerTokenAuthenticator(tokens map[string]string) Authenticator {
+	principals := make(map[string]string, len(tokens))
+	for hash, principal := range tokens {
+		principals[strings.ToLower(hash)] = principal
+	}
+	return &bearerTokenAuthenticator{principals: principals}
+}
+
+// Authenticate returns the principal for the request's bearer token.
+func (a *bearerTokenAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 {
+		return "", ErrNoCredentials
+	}
+	token, ok := strings.CutPrefix(values[0], "Bearer ")
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	// Looking up the token's hash, rather than the token, means lookup timing reveals nothing about valid tokens.
+	principal, ok := a.principals[HashToken(token)]
+	if !ok {
+		return "", errors.New("invalid bearer token")
+	}
+	return principal, nil
+}
+
+// mtlsAuthenticator accepts verified client certificates.
+type mtlsAuthenticator struct{}
+
+// NewMTLSAuthenticator authenticates requests by the common name of their verified client certificate.
+// It requires WithTLS and WithClientCA.
+func NewMTLSAuthenticator() Authenticator {
+	return mtlsAuthenticator{}
+}
+
+// Authenticate returns the common name of the request's client certificate.
+func (mtlsAuthenticator) Authenticate(ctx context.Context) (string, error) {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return "", ErrNoCredentials
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 || len(info.State.VerifiedChains[0]) == 0 {
+		return "", ErrNoCredentials
+	}
+	name := info.State.VerifiedChains[0][0].Subject.CommonName
+	if name == "" {
+		return "", errors.New("client certificate has no common name")
+	}
+	return name, nil
+}
+
+// authEnabled reports whether requests must be authenticated.
+func (s *Server) authEnabled() bool {
+	return len(s.authenticators) > 0 || s.acl != nil
+}
+
+// authenticate identifies the principal making a request and returns a context carrying it.
+func (s *Server) authenticate(ctx context.Context) (context.Context, error) {
+	for _, authenticator := range s.authenticators {
+		principal, err := authenticator.Authenticate(ctx)
+		if errors.Is(err, ErrNoCredentials) {
+			continue
+		} else if err != nil {
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+		return context.WithValue(ctx, principalKey{}, principal), nil
+	}
+	return nil, status.Error(codes.Unauthenticated, "missing credentials")
+}
+
+// authorize checks that the principal in ctx may make a request. Only KVStore requests are checked
+// against the ACL; other services, such as reflection, only need the request to be authenticated.
+func (s *Server) authorize(ctx context.Context, fullMethod string, req interface{}) error {
+	if s.acl == nil || !strings.HasPrefix(fullMethod, "/"+proto.KVStore_ServiceDesc.ServiceName+"/") {
+		return nil
+	}
+	principal, _ := PrincipalFromContext(ctx)
+	scopes, ok := requestScopes(req)
+	if !ok {
+		return status.Errorf(codes.PermissionDenied, "%s is not covered by the ACL", fullMethod)
+	}
+	for _, sc := range scopes {
+		if s.acl.allowed(principal, sc) {
+			continue
+		}
+		if sc.perm == PermAdmin {
+			return status.Errorf(codes.PermissionDenied, "%s may not manage namespaces", principal)
+		}
+		if sc.prefix {
+			return status.Errorf(codes.PermissionDenied, "%s may not %s keys starting with %q", principal, sc.perm, sc.key)
+		}
+		return status.Errorf(codes.PermissionDenied, "%s may not %s %q", principal, sc.perm, sc.key)
+	}
+	return nil
+}
+
+// authUnary authenticates and authorizes unary requests before they reach the handler.
+func (s *Server) authUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.authenticate(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.authorize(ctx, info.FullMethod, req); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// authStream authenticates streaming calls, and authorizes each message the client sends.
+func (s *Server) authStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.authenticate(stream.Context())
+	if err != nil {
+		return err
+	}
+	return handler(srv, &authorizedStream{ServerStream: stream, ctx: ctx, server: s, method: info.FullMethod})
+}
+
+// authorizedStream carries the authenticated principal and authorizes each received message.
+type authorizedStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	server *Server
+	method string
+}
+
+// Context returns the stream's context, carrying the authenticated principal.
+func (a *authorizedStream) Context() context.Context {
+	return a.ctx
+}
+
+// RecvMsg receives a message and checks that the principal may send it.
+func (a *authorizedStream) RecvMsg(m interface{}) error {
+	if err := a.ServerStream.RecvMsg(m); err != nil {
+		return err
+	}
+	return a.server.authorize(a.ctx, a.method, m)
+}
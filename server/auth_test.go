@@ -0,0 +1,234 @@
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// writeAuthConfig writes an auth config file giving "reader" read access to every key, and "writer"
+// read and write access to keys under "app/", and returns its path.
+func writeAuthConfig(t *testing.T, dir string) string {
+	t.Helper()
+	config := fmt.Sprintf(`{
+		"tokens": {%q: "reader", %q: "writer"},
+		"principals": {"reader": ["reader"], "writer": ["app-writer"], "billing": ["app-writer"]},
+		"roles": {
+			"reader": [{"prefix": "", "permissions": ["read"]}],
+			"app-writer": [{"prefix": "app/", "permissions": ["read", "write"]}]
+		}
+	}`, HashToken("read-token"), HashToken("write-token"))
+	return writeFile(t, dir, "auth.json", []byte(config))
+}
+
+// dialAuth connects to addr without TLS and returns a client and a function that returns
+// a context carrying the given bearer token.
+func dialAuth(t *testing.T, addr string) (proto.KVStoreClient, func(token string) context.Context) {
+	t.Helper()
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return proto.NewKVStoreClient(conn), func(token string) context.Context {
+		if token == "" {
+			return context.Background()
+		}
+		return metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+	}
+}
+
+func TestServer_BearerTokenAuth(t *testing.T) {
+	s := NewServer(WithAuthConfig(writeAuthConfig(t, t.TempDir())))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, as := dialAuth(t, addr)
+
+	if _, err := client.Get(as(""), &proto.GetRequest{Key: "app/x"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated without a token, got %v", err)
+	}
+	if _, err := client.Get(as("wrong"), &proto.GetRequest{Key: "app/x"}); status.Code(err) != codes.Unauthenticated {
+		t.Fatalf("expected Unauthenticated with an unknown token, got %v", err)
+	}
+
+	if _, err := client.Set(as("write-token"), &proto.SetRequest{Key: "app/x", Value: []byte("1")}); err != nil {
+		t.Fatalf("expected the writer to write under app/, got %v", err)
+	}
+	if _, err := client.Set(as("write-token"), &proto.SetRequest{Key: "other/x", Value: []byte("1")}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied writing outside app/, got %v", err)
+	}
+	if _, err := client.Delete(as("write-token"), &proto.DeleteRequest{Key: "app/x"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied deleting without the delete permission, got %v", err)
+	}
+	if resp, err := client.Get(as("read-token"), &proto.GetRequest{Key: "app/x"}); err != nil || string(resp.Value) != "1" {
+		t.Fatalf("expected the reader to read app/x, got %+v (err=%v)", resp, err)
+	}
+	if _, err := client.Set(as("read-token"), &proto.SetRequest{Key: "app/x", Value: []byte("2")}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a read-only principal, got %v", err)
+	}
+
+	// Reading and writing in one call needs both permissions on the key.
+	if _, err := client.GetAndTouch(as("read-token"), &proto.GetAndTouchRequest{Key: "app/x"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for GetAndTouch without write, got %v", err)
+	}
+	// A batch is denied if any of its keys is.
+	if _, err := client.MGet(as("write-token"), &proto.MGetRequest{Keys: []string{"app/x", "other/y"}}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a batch with a key outside app/, got %v", err)
+	}
+	// A transaction needs permission for both branches.
+	txn := &proto.TxnRequest{
+		Success: []*proto.TxnOp{{Type: proto.TxnOp_PUT, Key: "app/x", Value: []byte("3")}},
+		Failure: []*proto.TxnOp{{Type: proto.TxnOp_DELETE, Key: "app/x"}},
+	}
+	if _, err := client.Txn(as("write-token"), txn); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a transaction with a forbidden branch, got %v", err)
+	}
+	// Listing needs read permission on every key with the prefix.
+	if _, err := client.List(as("write-token"), &proto.ListRequest{Prefix: "app/"}); err != nil {
+		t.Fatalf("expected the writer to list app/, got %v", err)
+	}
+	if _, err := client.List(as("write-token"), &proto.ListRequest{}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied listing every key, got %v", err)
+	}
+}
+
+func TestServer_WatchAuth(t *testing.T) {
+	s := NewServer(WithAuthConfig(writeAuthConfig(t, t.TempDir())))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, as := dialAuth(t, addr)
+
+	ctx, cancel := context.WithTimeout(as("write-token"), 5*time.Second)
+	defer cancel()
+	stream, err := client.Watch(ctx, &proto.WatchRequest{Key: "", Prefix: true})
+	if err != nil {
+		t.Fatalf("failed to open watch: %v", err)
+	}
+	if _, err := stream.Recv(); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied watching every key, got %v", err)
+	}
+
+	// Write first and replay from before the write, so the event does not race the watch starting.
+	client.Set(as("write-token"), &proto.SetRequest{Key: "app/first", Value: []byte("0")})
+	if _, err := client.Set(as("write-token"), &proto.SetRequest{Key: "app/x", Value: []byte("1")}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	first, _ := client.Get(as("write-token"), &proto.GetRequest{Key: "app/first"})
+	stream, err = client.Watch(ctx, &proto.WatchRequest{Key: "app/", Prefix: true, Revision: first.Version})
+	if err != nil {
+		t.Fatalf("failed to open watch: %v", err)
+	}
+	if ev, err := stream.Recv(); err != nil || ev.Key != "app/x" {
+		t.Fatalf("expected an event for app/x, got %+v (err=%v)", ev, err)
+	}
+	cancel()
+	if _, err := stream.Recv(); err == nil || err == io.EOF {
+		t.Fatalf("expected the watch to end with the cancelled context, got %v", err)
+	}
+}
+
+func TestServer_MTLSIdentityAuth(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	var principal string
+	s := NewServer(
+		WithTLS(writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)),
+		WithClientCA(writeFile(t, dir, "ca.pem", ca.pem)),
+		WithAuthConfig(writeAuthConfig(t, dir)),
+		WithPreHook(func(ctx context.Context, method string, req interface{}) error {
+			principal, _ = PrincipalFromContext(ctx)
+			return nil
+		}),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	dial := func(name string) proto.KVStoreClient {
+		clientPEM, clientKey, _ := ca.issue(t, name, x509.ExtKeyUsageClientAuth)
+		cert, err := tls.X509KeyPair(clientPEM, clientKey)
+		if err != nil {
+			t.Fatalf("failed to load client certificate: %v", err)
+		}
+		creds := credentials.NewTLS(&tls.Config{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+		conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+		if err != nil {
+			t.Fatalf("failed to dial: %v", err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		return proto.NewKVStoreClient(conn)
+	}
+
+	ctx := context.Background()
+	if _, err := dial("billing").Set(ctx, &proto.SetRequest{Key: "app/invoice", Value: []byte("1")}); err != nil {
+		t.Fatalf("expected the billing certificate to write under app/, got %v", err)
+	}
+	if principal != "billing" {
+		t.Fatalf("expected hooks to see the principal 'billing', got %q", principal)
+	}
+	if _, err := dial("stranger").Get(ctx, &proto.GetRequest{Key: "app/invoice"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied for a certificate with no roles, got %v", err)
+	}
+}
+
+func TestACL_Allowed(t *testing.T) {
+	acl := NewACL()
+	acl.AddRole("reader", Grant{Prefix: "", Permissions: PermRead})
+	acl.AddRole("cleaner", Grant{Prefix: "tmp/", Permissions: PermWrite | PermDelete})
+	acl.Bind("ops", "reader", "cleaner")
+
+	if !acl.Allowed("ops", "tmp/a", PermRead|PermWrite) {
+		t.Fatalf("expected permissions from different roles to combine")
+	}
+	if acl.Allowed("ops", "app/a", PermWrite) {
+		t.Fatalf("expected a grant to cover only its prefix")
+	}
+	if acl.Allowed("nobody", "tmp/a", PermRead) {
+		t.Fatalf("expected an unbound principal to be denied")
+	}
+}
+
+func TestLoadAuthConfig_Invalid(t *testing.T) {
+	dir := t.TempDir()
+	tests := map[string]string{
+		"unknown role":       `{"principals": {"p": ["missing"]}}`,
+		"unknown permission": `{"roles": {"r": [{"prefix": "", "permissions": ["superuser"]}]}}`,
+		"scoped admin":       `{"roles": {"r": [{"prefix": "app/", "permissions": ["admin"]}]}}`,
+		"plaintext token":    `{"tokens": {"secret": "p"}}`,
+		"malformed":          `{"roles": [`,
+	}
+	for name, config := range tests {
+		path := writeFile(t, dir, strings.ReplaceAll(name, " ", "-")+".json", []byte(config))
+		if _, err := LoadAuthConfig(path); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+	if _, err := LoadAuthConfig(filepath.Join(dir, "missing.json")); err == nil {
+		t.Errorf("expected an error for a missing file")
+	}
+}
+
+func TestWithAuthConfig_Invalid(t *testing.T) {
+	s := NewServer(WithAuthConfig(filepath.Join(t.TempDir(), "missing.json")))
+	_, stop := startServing(t, s)
+	if err := stop(); err == nil || !strings.Contains(err.Error(), "auth config") {
+		t.Fatalf("expected serving to fail with the config error, got %v", err)
+	}
+}
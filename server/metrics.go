@@ -0,0 +1,185 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+	"github.com/ahmad-masud/KVStore/metrics"
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// MetricsPath is the HTTP path the metrics listener serves metrics on.
+const MetricsPath = "/metrics"
+
+// WithMetrics records the count, latency, and status code of every request, and serves Prometheus metrics
+// over HTTP on addr, at MetricsPath, while the server runs. With an empty addr no listener is started,
+// and MetricsHandler can be mounted on an existing HTTP server instead.
+func WithMetrics(addr string) Option {
+	return func(s *Server) {
+		s.metricsAddr = addr
+		s.rpcMetrics = &rpcMetrics{
+			requests:  make(map[rpcResult]uint64),
+			durations: make(map[string]*metrics.Histogram),
+		}
+	}
+}
+
+// rpcMetrics records KVStore requests by method.
+type rpcMetrics struct {
+	mu        sync.Mutex
+	requests  map[rpcResult]uint64
+	durations map[string]*metrics.Histogram // method to request latencies
+}
+
+// rpcResult is a method and the status code it returned.
+type rpcResult struct {
+	method string
+	code   string
+}
+
+// observe records a finished request.
+func (m *rpcMetrics) observe(method string, err error, elapsed time.Duration) {
+	m.mu.Lock()
+	m.requests[rpcResult{method: method, code: status.Code(err).String()}]++
+	histogram, ok := m.durations[method]
+	if !ok {
+		histogram = metrics.NewHistogram()
+		m.durations[method] = histogram
+	}
+	m.mu.Unlock()
+	histogram.ObserveDuration(elapsed)
+}
+
+// write adds the recorded requests to e, sorted by method and code.
+func (m *rpcMetrics) write(e *metrics.Exposition) {
+	type count struct {
+		rpcResult
+		n uint64
+	}
+	type latency struct {
+		method    string
+		histogram *metrics.Histogram
+	}
+	m.mu.Lock()
+	counts := make([]count, 0, len(m.requests))
+	for result, n := range m.requests {
+		counts = append(counts, count{result, n})
+	}
+	latencies := make([]latency, 0, len(m.durations))
+	for method, histogram := range m.durations {
+		latencies = append(latencies, latency{method, histogram})
+	}
+	m.mu.Unlock()
+
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].method != counts[j].method {
+			return counts[i].method < counts[j].method
+		}
+		return counts[i].code < counts[j].code
+	})
+	for _, c := range counts {
+		e.Counter("kvstore_requests_total", "Requests handled, by method and status code.", float64(c.n), "method", c.method, "code", c.code)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].method < latencies[j].method })
+	for _, l := range latencies {
+		e.Histogram("kvstore_request_duration_seconds", "Time taken to handle requests, by method.", l.histogram.Snapshot(), "method", l.method)
+	}
+}
+
+// MetricsHandler returns an HTTP handler serving the server's metrics in the Prometheus text format:
+// request counts and latencies if WithMetrics is set, rate limit rejections, and the metrics of the
+// storage backend and of each namespace, labelled with the namespace's name.
+func (s *Server) MetricsHandler() http.Handler {
+	return metrics.Handler(s.writeMetrics)
+}
+
+// writeMetrics adds the server's metrics to e.
+func (s *Server) writeMetrics(e *metrics.Exposition) {
+	if s.rpcMetrics != nil {
+		s.rpcMetrics.write(e)
+	}
+
+	rejections := s.RateLimitRejections()
+	methods := make([]string, 0, len(rejections))
+	for method := range rejections {
+		methods = append(methods, method)
+	}
+	sort.Strings(methods)
+	for _, method := range methods {
+		e.Counter("kvstore_rate_limit_rejections_total", "Requests rejected by rate limits, by method.", float64(rejections[method]), "method", method)
+	}
+
+	kvstore.WriteMetrics(e, s.storage)
+	if s.namespaces != nil {
+		for _, ns := range s.namespaces.List() {
+			kvstore.WriteMetrics(e, ns.Storage, "namespace", ns.Name)
+		}
+	}
+}
+
+// kvstoreMethod returns the KVStore method name of fullMethod, or false for other services.
+func kvstoreMethod(fullMethod string) (string, bool) {
+	prefix := "/" + proto.KVStore_ServiceDesc.ServiceName + "/"
+	if !strings.HasPrefix(fullMethod, prefix) {
+		return "", false
+	}
+	return strings.TrimPrefix(fullMethod, prefix), true
+}
+
+// metricsUnary records unary requests.
+func (s *Server) metricsUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	method, ok := kvstoreMethod(info.FullMethod)
+	if !ok {
+		return handler(ctx, req)
+	}
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	s.rpcMetrics.observe(method, err, time.Since(start))
+	return resp, err
+}
+
+// metricsStream records streaming calls, timing each from start to finish.
+func (s *Server) metricsStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	method, ok := kvstoreMethod(info.FullMethod)
+	if !ok {
+		return handler(srv, stream)
+	}
+	start := time.Now()
+	err := handler(srv, stream)
+	s.rpcMetrics.observe(method, err, time.Since(start))
+	return err
+}
+
+// startMetrics starts the metrics listener, if WithMetrics is set, and returns a function that stops it.
+func (s *Server) startMetrics() (func(), error) {
+	if s.metricsAddr == "" {
+		return func() {}, nil
+	}
+	lis, err := net.Listen("tcp", s.metricsAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(MetricsPath, s.MetricsHandler())
+	httpServer := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := httpServer.Serve(lis); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Printf("Metrics listener failed: %v", err)
+		}
+	}()
+	log.Printf("Serving metrics on http://%s%s", lis.Addr(), MetricsPath)
+
+	return func() { httpServer.Close() }, nil
+}
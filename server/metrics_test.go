@@ -0,0 +1,80 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+	"github.com/ahmad-masud/KVStore/proto"
+)
+
+func TestServer_Metrics(t *testing.T) {
+	// Reserve a free port for the metrics listener.
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	metricsAddr := lis.Addr().String()
+	lis.Close()
+
+	namespaces := kvstore.NewNamespaces()
+	namespaces.Create("team-a", kvstore.Quota{})
+	s := NewServer(
+		WithMetrics(metricsAddr),
+		WithNamespaces(namespaces),
+		WithRateLimit(RateLimit{Rate: 1, Methods: []string{"Delete"}}),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := context.Background()
+
+	client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")})
+	client.Get(ctx, &proto.GetRequest{Key: "k"})
+	client.Get(inNamespace("team-b"), &proto.GetRequest{Key: "k"})
+	client.Delete(ctx, &proto.DeleteRequest{Key: "k"})
+	client.Delete(ctx, &proto.DeleteRequest{Key: "k"})
+	client.Set(inNamespace("team-a"), &proto.SetRequest{Key: "k", Value: []byte("v")})
+
+	resp, err := http.Get("http://" + metricsAddr + MetricsPath)
+	if err != nil {
+		t.Fatalf("failed to scrape metrics: %v", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	out := string(body)
+
+	for _, want := range []string{
+		`kvstore_requests_total{method="Get",code="OK"} 1`,
+		`kvstore_requests_total{method="Get",code="NotFound"} 1`,
+		`kvstore_requests_total{method="Delete",code="ResourceExhausted"} 1`,
+		`kvstore_requests_total{method="Set",code="OK"} 2`,
+		`kvstore_request_duration_seconds_count{method="Set"} 2`,
+		`kvstore_rate_limit_rejections_total{method="Delete"} 1`,
+		`kvstore_keys 0`,
+		`kvstore_keys{namespace="team-a"} 1`,
+	} {
+		if !strings.Contains(out, want+"\n") {
+			t.Fatalf("expected %q in:\n%s", want, out)
+		}
+	}
+}
+
+func TestServer_MetricsHandler(t *testing.T) {
+	s := NewServer()
+	s.storage.Set("k", "v")
+
+	rec := httptest.NewRecorder()
+	s.MetricsHandler().ServeHTTP(rec, httptest.NewRequest("GET", MetricsPath, nil))
+	if !strings.Contains(rec.Body.String(), "kvstore_keys 1\n") {
+		t.Fatalf("expected the storage metrics, got:\n%s", rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "kvstore_requests_total") {
+		t.Fatalf("expected no request metrics without WithMetrics")
+	}
+}
@@ -0,0 +1,344 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// NamespaceMetadataKey is the request metadata key that selects the namespace a request runs in.
+// Requests without it use the server's default storage.
+const NamespaceMetadataKey = "kvstore-namespace"
+
+// WithNamespaces lets requests run in isolated namespaces, selected by the NamespaceMetadataKey
+// metadata or bound to the caller with WithNamespaceBindings, and enables the namespace admin RPCs.
+func WithNamespaces(namespaces *kvstore.Namespaces) Option {
+	return func(s *Server) {
+		s.namespaces = namespaces
+	}
+}
+
+// WithNamespaceBindings confines authenticated principals to namespaces: every request from a bound
+// principal runs in its namespace, and naming another namespace fails with PermissionDenied.
+// It requires WithNamespaces and WithAuthenticators.
+func WithNamespaceBindings(bindings map[string]string) Option {
+	return func(s *Server) {
+		if s.namespaceBindings == nil {
+			s.namespaceBindings = make(map[string]string, len(bindings))
+		}
+		for principal, namespace := range bindings {
+			s.namespaceBindings[principal] = namespace
+		}
+	}
+}
+
+// namespaceKey is the context key under which the request's namespace is stored.
+type namespaceKey struct{}
+
+// storageFor returns the storage of the namespace a request runs in, or the default storage.
+func (s *Server) storageFor(ctx context.Context) kvstore.Storage {
+	if ns, ok := ctx.Value(namespaceKey{}).(*kvstore.Namespace); ok {
+		return ns.Storage
+	}
+	return s.storage
+}
+
+// enterNamespace resolves the namespace a KVStore request runs in and returns a context carrying it. Admin requests and other services never run in a namespace.
+func (s *Server) enterNamespace(ctx context.Context, fullMethod string, req interface{}) (context.Context, error) {
+	if !strings.HasPrefix(fullMethod, "/"+proto.KVStore_ServiceDesc.ServiceName+"/") || isAdminRequest(req) {
+		return ctx, nil
+	}
+
+	var name string
+	if values := metadata.ValueFromIncomingContext(ctx, NamespaceMetadataKey); len(values) > 0 {
+		name = values[0]
+	}
+	if principal, ok := PrincipalFromContext(ctx); ok {
+		if bound, ok := s.namespaceBindings[principal]; ok {
+			if name != "" && name != bound {
+				return nil, status.Errorf(codes.PermissionDenied, "%s may only use namespace %q", principal, bound)
+			}
+			name = bound
+		}
+	}
+	if name == "" {
+		return ctx, nil
+	}
+
+	if s.namespaces == nil {
+		return nil, status.Error(codes.FailedPrecondition, "server does not have namespaces enabled")
+	}
+	ns, ok := s.namespaces.Get(name)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "namespace %q not found", name)
+	}
+	return context.WithValue(ctx, namespaceKey{}, ns), nil
+}
+
+// admit checks a request against its namespace's ops/sec limit.
+func (s *Server) admit(ns *kvstore.Namespace) error {
+	quota := ns.Quota
+	if quota.MaxOpsPerSecond > 0 {
+		limiter, _ := s.namespaceLimiters.LoadOrStore(ns, newTokenBucket(quota.MaxOpsPerSecond, math.Max(quota.MaxOpsPerSecond, 1), time.Now()))
+		if ok, _ := limiter.(*tokenBucket).take(time.Now()); !ok {
+			return status.Errorf(codes.ResourceExhausted, "namespace %q is over its limit of %g operations per second", ns.Name, quota.MaxOpsPerSecond)
+		}
+	}
+	return nil
+}
+
+// numberSize is the length of the longest formatted integer or float a counter can hold.
+const numberSize = 24
+
+// quotaWrites returns the keys that a request to method may add or grow, with the size of what it stores
+// at each. Requests that only shrink or delete keys, or change their expiry, return nothing.
+func quotaWrites(method string, req interface{}) []kvstore.Write {
+	switch req := req.(type) {
+	case *proto.SetRequest:
+		return []kvstore.Write{{Key: req.Key, Size: int64(len(req.Value))}}
+	case *proto.CompareAndSwapRequest:
+		return []kvstore.Write{{Key: req.Key, Size: int64(len(req.Value))}}
+	case *proto.MSetRequest:
+		writes := make([]kvstore.Write, len(req.Entries))
+		for i, entry := range req.Entries {
+			writes[i] = kvstore.Write{Key: entry.Key, Size: int64(len(entry.Value))}
+		}
+		return writes
+	case *proto.IncrByRequest:
+		return []kvstore.Write{{Key: req.Key, Size: numberSize}}
+	case *proto.IncrByFloatRequest:
+		return []kvstore.Write{{Key: req.Key, Size: numberSize}}
+	case *proto.HSetRequest:
+		var size int64
+		for field, value := range req.Fields {
+			size += int64(len(field) + len(value))
+		}
+		return []kvstore.Write{{Key: req.Key, Size: size}}
+	case *proto.PushRequest:
+		var size int64
+		for _, value := range req.Values {
+			size += int64(len(value))
+		}
+		return []kvstore.Write{{Key: req.Key, Size: size}}
+	case *proto.MembersRequest:
+		if method != "/"+proto.KVStore_ServiceDesc.ServiceName+"/SAdd" {
+			return nil
+		}
+		var size int64
+		for _, member := range req.Members {
+			size += int64(len(member))
+		}
+		return []kvstore.Write{{Key: req.Key, Size: size}}
+	case *proto.TxnRequest:
+		// Either branch may run, so both are counted.
+		var writes []kvstore.Write
+		for _, ops := range [][]*proto.TxnOp{req.Success, req.Failure} {
+			for _, op := range ops {
+				if op.Type == proto.TxnOp_PUT {
+					writes = append(writes, kvstore.Write{Key: op.Key, Size: int64(len(op.Value))})
+				}
+			}
+		}
+		return writes
+	}
+	return nil
+}
+
+// namespaceUnary runs unary requests in their namespace.
+func (s *Server) namespaceUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := s.enterNamespace(ctx, info.FullMethod, req)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// namespaceStream runs streaming calls in their namespace.
+func (s *Server) namespaceStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	ctx, err := s.enterNamespace(stream.Context(), info.FullMethod, nil)
+	if err != nil {
+		return err
+	}
+	return handler(srv, &contextStream{ServerStream: stream, ctx: ctx})
+}
+
+// quotaUnary checks unary requests against their namespace's quota. Requests that may add keys or bytes
+// run through Namespace.Admit, which checks them against the namespace's key and byte limits.
+func (s *Server) quotaUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ns, ok := ctx.Value(namespaceKey{}).(*kvstore.Namespace)
+	if !ok {
+		return handler(ctx, req)
+	}
+	if err := s.admit(ns); err != nil {
+		return nil, err
+	}
+	writes := quotaWrites(info.FullMethod, req)
+	if len(writes) == 0 {
+		return handler(ctx, req)
+	}
+
+	var resp interface{}
+	var handlerErr error
+	err := ns.Admit(writes, func() {
+		resp, handlerErr = handler(ctx, req)
+	})
+	if errors.Is(err, kvstore.ErrQuotaExceeded) {
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	return resp, handlerErr
+}
+
+// quotaStream checks streaming calls against their namespace's ops/sec limit, counting each call once when it starts.
+func (s *Server) quotaStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if ns, ok := stream.Context().Value(namespaceKey{}).(*kvstore.Namespace); ok {
+		if err := s.admit(ns); err != nil {
+			return err
+		}
+	}
+	return handler(srv, stream)
+}
+
+// contextStream replaces a stream's context.
+type contextStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+// Context returns the replacement context.
+func (c *contextStream) Context() context.Context {
+	return c.ctx
+}
+
+// isAdminRequest reports whether req is for one of the namespace admin RPCs.
+func isAdminRequest(req interface{}) bool {
+	switch req.(type) {
+	case *proto.CreateNamespaceRequest, *proto.ListNamespacesRequest, *proto.DropNamespaceRequest:
+		return true
+	}
+	return false
+}
+
+// CreateNamespace creates an empty namespace with a quota.
+// It fails with InvalidArgument for an invalid name or negative quota, and AlreadyExists if the name is taken.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) CreateNamespace(ctx context.Context, req *proto.CreateNamespaceRequest) (*proto.Namespace, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "CreateNamespace", req); err != nil {
+			return nil, err
+		}
+	}
+	if s.namespaces == nil {
+		return nil, status.Error(codes.FailedPrecondition, "server does not have namespaces enabled")
+	}
+
+	q := req.GetQuota()
+	if q.GetMaxKeys() < 0 || q.GetMaxBytes() < 0 || q.GetMaxOpsPerSecond() < 0 {
+		return nil, status.Error(codes.InvalidArgument, "quota limits must not be negative")
+	}
+	quota := kvstore.Quota{
+		MaxKeys:         int(q.GetMaxKeys()),
+		MaxBytes:        q.GetMaxBytes(),
+		MaxOpsPerSecond: q.GetMaxOpsPerSecond(),
+	}
+	ns, err := s.namespaces.Create(req.Name, quota)
+	switch {
+	case errors.Is(err, kvstore.ErrInvalidNamespace):
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, kvstore.ErrNamespaceExists):
+		return nil, status.Error(codes.AlreadyExists, err.Error())
+	case err != nil:
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	resp := namespaceInfo(ns)
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "CreateNamespace", req, resp)
+	}
+
+	return resp, nil
+}
+
+// ListNamespaces returns every namespace with its quota and usage.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) ListNamespaces(ctx context.Context, req *proto.ListNamespacesRequest) (*proto.ListNamespacesResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "ListNamespaces", req); err != nil {
+			return nil, err
+		}
+	}
+	if s.namespaces == nil {
+		return nil, status.Error(codes.FailedPrecondition, "server does not have namespaces enabled")
+	}
+
+	resp := &proto.ListNamespacesResponse{}
+	for _, ns := range s.namespaces.List() {
+		resp.Namespaces = append(resp.Namespaces, namespaceInfo(ns))
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "ListNamespaces", req, resp)
+	}
+
+	return resp, nil
+}
+
+// DropNamespace deletes a namespace and every key in it. It fails with NotFound if there is no such namespace.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) DropNamespace(ctx context.Context, req *proto.DropNamespaceRequest) (*proto.DropNamespaceResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "DropNamespace", req); err != nil {
+			return nil, err
+		}
+	}
+	if s.namespaces == nil {
+		return nil, status.Error(codes.FailedPrecondition, "server does not have namespaces enabled")
+	}
+
+	ns, _ := s.namespaces.Get(req.Name)
+	if err := s.namespaces.Drop(req.Name); errors.Is(err, kvstore.ErrNamespaceNotFound) {
+		return nil, status.Error(codes.NotFound, err.Error())
+	} else if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	s.namespaceLimiters.Delete(ns)
+
+	resp := &proto.DropNamespaceResponse{Success: true}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "DropNamespace", req, resp)
+	}
+
+	return resp, nil
+}
+
+// namespaceInfo describes a namespace and its current usage.
+func namespaceInfo(ns *kvstore.Namespace) *proto.Namespace {
+	info := &proto.Namespace{
+		Name: ns.Name,
+		Quota: &proto.NamespaceQuota{
+			MaxKeys:         int64(ns.Quota.MaxKeys),
+			MaxBytes:        ns.Quota.MaxBytes,
+			MaxOpsPerSecond: ns.Quota.MaxOpsPerSecond,
+		},
+	}
+	if provider, ok := ns.Storage.(kvstore.StatsProvider); ok {
+		stats := provider.Stats()
+		info.Keys = int64(stats.Keys)
+		info.Bytes = stats.Bytes
+	}
+	return info
+}
@@ -0,0 +1,228 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// inNamespace returns a context that runs requests in the named namespace.
+func inNamespace(name string) context.Context {
+	return metadata.AppendToOutgoingContext(context.Background(), NamespaceMetadataKey, name)
+}
+
+func TestServer_Namespaces(t *testing.T) {
+	s := NewServer(WithNamespaces(kvstore.NewNamespaces()))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := context.Background()
+
+	if _, err := client.CreateNamespace(ctx, &proto.CreateNamespaceRequest{Name: "team-a"}); err != nil {
+		t.Fatalf("CreateNamespace failed: %v", err)
+	}
+	if _, err := client.CreateNamespace(ctx, &proto.CreateNamespaceRequest{Name: "team-a"}); status.Code(err) != codes.AlreadyExists {
+		t.Fatalf("expected AlreadyExists, got %v", err)
+	}
+	if _, err := client.CreateNamespace(ctx, &proto.CreateNamespaceRequest{Name: "../etc"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for an invalid name, got %v", err)
+	}
+
+	client.Set(ctx, &proto.SetRequest{Key: "config", Value: []byte("default")})
+	client.Set(inNamespace("team-a"), &proto.SetRequest{Key: "config", Value: []byte("a")})
+	if resp, _ := client.Get(ctx, &proto.GetRequest{Key: "config"}); string(resp.Value) != "default" {
+		t.Fatalf("expected the default keyspace to be untouched, got %q", resp.Value)
+	}
+	if resp, _ := client.Get(inNamespace("team-a"), &proto.GetRequest{Key: "config"}); string(resp.Value) != "a" {
+		t.Fatalf("expected team-a's own value, got %q", resp.Value)
+	}
+	if _, err := client.Get(inNamespace("team-b"), &proto.GetRequest{Key: "config"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound for a missing namespace, got %v", err)
+	}
+
+	list, err := client.ListNamespaces(ctx, &proto.ListNamespacesRequest{})
+	if err != nil || len(list.Namespaces) != 1 || list.Namespaces[0].Name != "team-a" || list.Namespaces[0].Keys != 1 {
+		t.Fatalf("unexpected namespaces: %+v (err=%v)", list, err)
+	}
+
+	if _, err := client.DropNamespace(ctx, &proto.DropNamespaceRequest{Name: "team-a"}); err != nil {
+		t.Fatalf("DropNamespace failed: %v", err)
+	}
+	if _, err := client.Get(inNamespace("team-a"), &proto.GetRequest{Key: "config"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound after the namespace was dropped, got %v", err)
+	}
+	if _, err := client.DropNamespace(ctx, &proto.DropNamespaceRequest{Name: "team-a"}); status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound dropping a missing namespace, got %v", err)
+	}
+}
+
+func TestServer_NamespacesDisabled(t *testing.T) {
+	s := NewServer()
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+
+	if _, err := client.Get(inNamespace("team-a"), &proto.GetRequest{Key: "k"}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition when namespaces are disabled, got %v", err)
+	}
+	if _, err := client.ListNamespaces(context.Background(), &proto.ListNamespacesRequest{}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition when namespaces are disabled, got %v", err)
+	}
+}
+
+func TestServer_NamespaceQuotas(t *testing.T) {
+	namespaces := kvstore.NewNamespaces()
+	namespaces.Create("keys", kvstore.Quota{MaxKeys: 2})
+	namespaces.Create("bytes", kvstore.Quota{MaxBytes: 200})
+	namespaces.Create("ops", kvstore.Quota{MaxOpsPerSecond: 1})
+	s := NewServer(WithNamespaces(namespaces))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+
+	keys := inNamespace("keys")
+	client.Set(keys, &proto.SetRequest{Key: "a", Value: []byte("1")})
+	client.Set(keys, &proto.SetRequest{Key: "b", Value: []byte("1")})
+	if _, err := client.Set(keys, &proto.SetRequest{Key: "c", Value: []byte("1")}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted adding a key beyond the limit, got %v", err)
+	}
+	if _, err := client.Set(keys, &proto.SetRequest{Key: "a", Value: []byte("2")}); err != nil {
+		t.Fatalf("expected overwriting an existing key to succeed, got %v", err)
+	}
+	if _, err := client.MSet(keys, &proto.MSetRequest{Entries: []*proto.SetRequest{{Key: "a"}, {Key: "d"}}}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for a batch that adds a key, got %v", err)
+	}
+	client.Delete(keys, &proto.DeleteRequest{Key: "b"})
+	if _, err := client.Set(keys, &proto.SetRequest{Key: "c", Value: []byte("1")}); err != nil {
+		t.Fatalf("expected a key to fit after a delete, got %v", err)
+	}
+
+	bytes := inNamespace("bytes")
+	var err error
+	for i := 0; i < 10 && err == nil; i++ {
+		_, err = client.Set(bytes, &proto.SetRequest{Key: fmt.Sprintf("k%d", i), Value: make([]byte, 50)})
+	}
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted once the byte limit is reached, got %v", err)
+	}
+	if _, err := client.Get(bytes, &proto.GetRequest{Key: "k0"}); err != nil {
+		t.Fatalf("expected reads to succeed at the byte limit, got %v", err)
+	}
+	if _, err := client.Delete(bytes, &proto.DeleteRequest{Key: "k0"}); err != nil {
+		t.Fatalf("expected deletes to succeed at the byte limit, got %v", err)
+	}
+
+	ops := inNamespace("ops")
+	if _, err := client.Get(ops, &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected the first request to succeed, got %v", err)
+	}
+	if _, err := client.Get(ops, &proto.GetRequest{Key: "k"}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted beyond the ops/sec limit, got %v", err)
+	}
+}
+
+func TestServer_NamespaceQuotasConcurrent(t *testing.T) {
+	namespaces := kvstore.NewNamespaces()
+	ns, _ := namespaces.Create("team-a", kvstore.Quota{MaxKeys: 10, MaxBytes: 2000})
+	s := NewServer(WithNamespaces(namespaces))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := inNamespace("team-a")
+
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "big", Value: make([]byte, 2000)}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted for a value larger than the byte limit, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			client.Set(ctx, &proto.SetRequest{Key: fmt.Sprintf("k%d", i), Value: []byte("v")})
+		}(i)
+	}
+	wg.Wait()
+	if stats := ns.Storage.(kvstore.StatsProvider).Stats(); stats.Keys != 10 {
+		t.Fatalf("expected concurrent writes to stop at the key limit, got %d keys", stats.Keys)
+	}
+}
+
+func TestServer_NamespaceBindings(t *testing.T) {
+	dir := t.TempDir()
+	config := fmt.Sprintf(`{
+		"tokens": {%q: "ops", %q: "ci-bot"},
+		"principals": {"ops": ["admin"], "ci-bot": ["rw"]},
+		"roles": {
+			"admin": [{"prefix": "", "permissions": ["read", "write", "admin"]}],
+			"rw": [{"prefix": "", "permissions": ["read", "write"]}]
+		},
+		"namespaces": {"ci-bot": "ci"}
+	}`, HashToken("ops-token"), HashToken("ci-token"))
+	s := NewServer(
+		WithNamespaces(kvstore.NewNamespaces()),
+		WithAuthConfig(writeFile(t, dir, "auth.json", []byte(config))),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, as := dialAuth(t, addr)
+
+	if _, err := client.CreateNamespace(as("ci-token"), &proto.CreateNamespaceRequest{Name: "ci"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied creating a namespace without admin, got %v", err)
+	}
+	if _, err := client.CreateNamespace(as("ops-token"), &proto.CreateNamespaceRequest{Name: "ci"}); err != nil {
+		t.Fatalf("expected an admin to create a namespace, got %v", err)
+	}
+
+	if _, err := client.Set(as("ci-token"), &proto.SetRequest{Key: "build", Value: []byte("42")}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if resp, _ := client.Get(as("ops-token"), &proto.GetRequest{Key: "build"}); resp.Found {
+		t.Fatalf("expected the bound principal's write to stay in its namespace")
+	}
+	ciCtx := metadata.AppendToOutgoingContext(inNamespace("ci"), "authorization", "Bearer ops-token")
+	if resp, _ := client.Get(ciCtx, &proto.GetRequest{Key: "build"}); string(resp.Value) != "42" {
+		t.Fatalf("expected the write to land in namespace ci, got %q", resp.Value)
+	}
+
+	otherCtx := metadata.AppendToOutgoingContext(inNamespace("other"), "authorization", "Bearer ci-token")
+	if _, err := client.Get(otherCtx, &proto.GetRequest{Key: "build"}); status.Code(err) != codes.PermissionDenied {
+		t.Fatalf("expected PermissionDenied leaving the bound namespace, got %v", err)
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	now := time.Now()
+	bucket := newTokenBucket(2, 2, now)
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := bucket.take(now); !ok {
+			t.Fatalf("expected the burst to allow request %d", i)
+		}
+	}
+	ok, wait := bucket.take(now)
+	if ok || wait != 500*time.Millisecond {
+		t.Fatalf("expected to wait 500ms for the next token, got ok=%v wait=%v", ok, wait)
+	}
+	if ok, _ := bucket.take(now.Add(500 * time.Millisecond)); !ok {
+		t.Fatalf("expected a token after waiting")
+	}
+	if ok, _ := bucket.take(now.Add(time.Hour)); !ok {
+		t.Fatalf("expected a token after a long idle period")
+	}
+	if ok, _ := bucket.take(now.Add(time.Hour)); !ok {
+		t.Fatalf("expected the bucket to refill up to its burst")
+	}
+	if ok, _ := bucket.take(now.Add(time.Hour)); ok {
+		t.Fatalf("expected the bucket not to refill beyond its burst")
+	}
+}
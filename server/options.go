@@ -6,9 +6,17 @@ import (
 	"github.com/ahmad-masud/KVStore/kvstore"
 )
 
-// Option configures the Server.
+// Option configures the Server. An option that fails, for example because a file it loads is
+// invalid, makes Listen return its error instead of serving.
 type Option func(*Server)
 
+// optionFailed records err as the error serving fails with, keeping the first one.
+func (s *Server) optionFailed(err error) {
+	if s.optionErr == nil {
+		s.optionErr = err
+	}
+}
+
 // WithStorage allows injecting a custom storage backend.
 func WithStorage(storage kvstore.Storage) Option {
 	return func(s *Server) {
@@ -38,9 +46,10 @@ func WithDefaultTTL(ttl time.Duration) Option {
 }
 
 // WithDiskPersistence enables persistence using an append-only file.
-func WithDiskPersistence(path string, compact bool) Option {
+// Additional options configure the persistent store, such as its fsync policy.
+func WithDiskPersistence(path string, compact bool, opts ...kvstore.PersistentOption) Option {
 	return func(s *Server) {
-		diskStore, err := kvstore.NewPersistentKVStore(path, compact)
+		diskStore, err := kvstore.NewPersistentKVStore(path, compact, opts...)
 		if err != nil {
 			panic("failed to initialize persistent store: " + err.Error())
 		}
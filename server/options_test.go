@@ -2,7 +2,9 @@ package server
 
 import (
 	"context"
-	"os"
+	"crypto/tls"
+	"path/filepath"
+	"runtime"
 	"testing"
 	"time"
 
@@ -21,6 +23,22 @@ func TestWithStorage(t *testing.T) {
 	}
 }
 
+func TestNewServer_WithStorageSkipsDefault(t *testing.T) {
+	customStore := kvstore.New()
+	defer customStore.Close()
+
+	before := runtime.NumGoroutine()
+	for i := 0; i < 20; i++ {
+		if s := NewServer(WithStorage(customStore)); s.storage != customStore {
+			t.Fatalf("expected storage to be set")
+		}
+	}
+	// Each default store would start an expiry goroutine that nothing stops.
+	if after := runtime.NumGoroutine(); after-before >= 20 {
+		t.Fatalf("expected no default store to be created, got %d new goroutines", after-before)
+	}
+}
+
 func TestWithPreHook(t *testing.T) {
 	hook := func(ctx context.Context, method string, req interface{}) error {
 		return nil
@@ -62,17 +80,48 @@ func TestWithDefaultTTL(t *testing.T) {
 }
 
 func TestWithDiskPersistence(t *testing.T) {
-	tmpfile, err := os.CreateTemp("", "kvstore_test_log")
-	if err != nil {
-		t.Fatalf("failed to create temp file: %v", err)
-	}
-	defer os.Remove(tmpfile.Name())
+	logPath := filepath.Join(t.TempDir(), "kvstore_test_log")
 
 	s := NewServer(
-		WithDiskPersistence(tmpfile.Name(), true),
+		WithDiskPersistence(logPath, true),
 	)
 
 	if s.storage == nil {
 		t.Fatalf("expected storage to be initialized")
 	}
 }
+
+func TestWithTLS(t *testing.T) {
+	s := NewServer(
+		WithTLS("server.pem", "server.key"),
+		WithClientCA("ca.pem"),
+		WithMinTLSVersion(tls.VersionTLS13),
+		WithCertPollInterval(time.Minute),
+	)
+
+	want := tlsOptions{
+		certFile:     "server.pem",
+		keyFile:      "server.key",
+		clientCAFile: "ca.pem",
+		minVersion:   tls.VersionTLS13,
+		pollInterval: time.Minute,
+	}
+	if s.tls != want {
+		t.Fatalf("expected TLS options %+v, got %+v", want, s.tls)
+	}
+}
+
+func TestWithNamespaces(t *testing.T) {
+	namespaces := kvstore.NewNamespaces()
+
+	s := &Server{}
+	WithNamespaces(namespaces)(s)
+	WithNamespaceBindings(map[string]string{"ci-bot": "ci"})(s)
+
+	if s.namespaces != namespaces {
+		t.Fatalf("expected namespaces to be set")
+	}
+	if s.namespaceBindings["ci-bot"] != "ci" {
+		t.Fatalf("expected namespace bindings to be set")
+	}
+}
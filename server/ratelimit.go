@@ -0,0 +1,219 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RetryAfterMetadataKey is the trailer metadata key that tells a rate-limited client how many seconds,
+// with millisecond precision, to wait before retrying.
+const RetryAfterMetadataKey = "retry-after"
+
+// RateLimitKey selects what a rate limit is counted per.
+type RateLimitKey int
+
+const (
+	// ByPeer counts requests per client IP address.
+	ByPeer RateLimitKey = iota
+	// ByIdentity counts requests per authenticated principal. Requests without a principal are counted per IP address.
+	ByIdentity
+	// ByNamespace counts requests per namespace, with requests outside any namespace counted together.
+	ByNamespace
+)
+
+// RateLimit is a token-bucket limit: each key may make Rate requests per second on average,
+// with bursts of up to Burst requests.
+type RateLimit struct {
+	Rate    float64      // requests per second
+	Burst   int          // largest burst; defaults to Rate rounded up, and at least 1
+	Key     RateLimitKey // what requests are counted per
+	Methods []string     // RPC method names, such as "Set"; empty means every KVStore method
+}
+
+// WithRateLimit adds a rate limit. A request must be within every limit that covers its method,
+// or it fails with ResourceExhausted and a RetryAfterMetadataKey trailer. Listen fails if the rate is
+// not a positive number of requests per second.
+func WithRateLimit(limit RateLimit) Option {
+	return func(s *Server) {
+		if limit.Rate <= 0 || math.IsInf(limit.Rate, 0) || math.IsNaN(limit.Rate) {
+			s.optionFailed(fmt.Errorf("invalid rate limit %v: must be a positive number of requests per second", limit.Rate))
+			return
+		}
+		s.rateLimiters = append(s.rateLimiters, newRateLimiter(limit))
+	}
+}
+
+// minSweep is the number of buckets a limiter holds before it first drops idle ones.
+const minSweep = 1024
+
+// rateLimiter holds a token bucket for each key seen by a limit.
+type rateLimiter struct {
+	limit   RateLimit
+	burst   float64
+	methods map[string]bool // nil means every method
+
+	mu        sync.Mutex
+	buckets   map[string]*tokenBucket
+	nextSweep int // drop idle buckets once there are this many
+}
+
+// newRateLimiter creates a limiter for limit.
+func newRateLimiter(limit RateLimit) *rateLimiter {
+	burst := float64(limit.Burst)
+	if burst <= 0 {
+		burst = math.Max(math.Ceil(limit.Rate), 1)
+	}
+	r := &rateLimiter{
+		limit:     limit,
+		burst:     burst,
+		buckets:   make(map[string]*tokenBucket),
+		nextSweep: minSweep,
+	}
+	if len(limit.Methods) > 0 {
+		r.methods = make(map[string]bool, len(limit.Methods))
+		for _, method := range limit.Methods {
+			r.methods[method] = true
+		}
+	}
+	return r
+}
+
+// covers reports whether the limit applies to method.
+func (r *rateLimiter) covers(method string) bool {
+	return r.methods == nil || r.methods[method]
+}
+
+// bucket returns key's bucket, creating a full one for a new key.
+func (r *rateLimiter) bucket(key string, now time.Time) *tokenBucket {
+	r.mu.Lock()
+	bucket, ok := r.buckets[key]
+	if !ok {
+		if len(r.buckets) >= r.nextSweep {
+			r.sweepLocked(now)
+		}
+		bucket = newTokenBucket(r.limit.Rate, r.burst, now)
+		r.buckets[key] = bucket
+	}
+	r.mu.Unlock()
+	return bucket
+}
+
+// sweepLocked drops buckets that have refilled, since a new bucket would behave the same.
+// The caller must hold r.mu.
+func (r *rateLimiter) sweepLocked(now time.Time) {
+	for key, bucket := range r.buckets {
+		if bucket.full(now) {
+			delete(r.buckets, key)
+		}
+	}
+	r.nextSweep = 2 * len(r.buckets)
+	if r.nextSweep < minSweep {
+		r.nextSweep = minSweep
+	}
+}
+
+// key returns what a request is counted against under this limit.
+func (r *rateLimiter) key(ctx context.Context) string {
+	switch r.limit.Key {
+	case ByIdentity:
+		if principal, ok := PrincipalFromContext(ctx); ok {
+			return "identity:" + principal
+		}
+	case ByNamespace:
+		if ns, ok := ctx.Value(namespaceKey{}).(*kvstore.Namespace); ok {
+			return "namespace:" + ns.Name
+		}
+		return "namespace:"
+	}
+	return "peer:" + peerHost(ctx)
+}
+
+// peerHost returns the IP address of the client that sent the request in ctx.
+func peerHost(ctx context.Context) string {
+	p, ok := peer.FromContext(ctx)
+	if !ok || p.Addr == nil {
+		return ""
+	}
+	addr := p.Addr.String()
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// RateLimitRejections returns the number of requests rejected by rate limits, by RPC method name.
+func (s *Server) RateLimitRejections() map[string]uint64 {
+	s.rejectionsMu.Lock()
+	defer s.rejectionsMu.Unlock()
+
+	rejections := make(map[string]uint64, len(s.rejections))
+	for method, n := range s.rejections {
+		rejections[method] = n
+	}
+	return rejections
+}
+
+// limit checks a KVStore request against every rate limit covering its method. A rejected request
+// is not counted against any limit: tokens taken from the limits it passed are refunded.
+func (s *Server) limit(ctx context.Context, fullMethod string) error {
+	method, ok := kvstoreMethod(fullMethod)
+	if !ok {
+		return nil
+	}
+
+	now := time.Now()
+	var taken []*tokenBucket
+	for _, limiter := range s.rateLimiters {
+		if !limiter.covers(method) {
+			continue
+		}
+		bucket := limiter.bucket(limiter.key(ctx), now)
+		if ok, wait := bucket.take(now); !ok {
+			for _, b := range taken {
+				b.refund()
+			}
+
+			s.rejectionsMu.Lock()
+			if s.rejections == nil {
+				s.rejections = make(map[string]uint64)
+			}
+			s.rejections[method]++
+			s.rejectionsMu.Unlock()
+
+			retryAfter := strconv.FormatFloat(math.Ceil(wait.Seconds()*1000)/1000, 'f', -1, 64)
+			_ = grpc.SetTrailer(ctx, metadata.Pairs(RetryAfterMetadataKey, retryAfter))
+			return status.Errorf(codes.ResourceExhausted, "rate limit exceeded for %s; retry after %ss", method, retryAfter)
+		}
+		taken = append(taken, bucket)
+	}
+	return nil
+}
+
+// rateLimitUnary applies the rate limits to unary requests.
+func (s *Server) rateLimitUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if err := s.limit(ctx, info.FullMethod); err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// rateLimitStream applies the rate limits to streaming calls, counting each call once when it starts.
+func (s *Server) rateLimitStream(srv interface{}, stream grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if err := s.limit(stream.Context(), info.FullMethod); err != nil {
+		return err
+	}
+	return handler(srv, stream)
+}
@@ -0,0 +1,158 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/kvstore"
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+func TestServer_RateLimitByPeer(t *testing.T) {
+	s := NewServer(WithRateLimit(RateLimit{Rate: 1, Burst: 2, Methods: []string{"Set"}}))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := context.Background()
+
+	for i := 0; i < 2; i++ {
+		if _, err := client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")}); err != nil {
+			t.Fatalf("expected the burst to allow Set %d, got %v", i, err)
+		}
+	}
+	var trailer metadata.MD
+	_, err := client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")}, grpc.Trailer(&trailer))
+	if status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected ResourceExhausted beyond the burst, got %v", err)
+	}
+	values := trailer.Get(RetryAfterMetadataKey)
+	if len(values) != 1 {
+		t.Fatalf("expected a %s trailer, got %v", RetryAfterMetadataKey, trailer)
+	}
+	if seconds, err := strconv.ParseFloat(values[0], 64); err != nil || seconds <= 0 || seconds > 1 {
+		t.Fatalf("expected to retry within a second, got %q", values[0])
+	}
+
+	if _, err := client.Get(ctx, &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected methods without a limit to succeed, got %v", err)
+	}
+	if rejections := s.RateLimitRejections(); rejections["Set"] != 1 || len(rejections) != 1 {
+		t.Fatalf("expected one rejected Set, got %v", rejections)
+	}
+}
+
+func TestServer_RateLimitByIdentity(t *testing.T) {
+	tokens := map[string]string{HashToken("a-token"): "a", HashToken("b-token"): "b"}
+	s := NewServer(
+		WithAuthenticators(NewBearerTokenAuthenticator(tokens)),
+		WithRateLimit(RateLimit{Rate: 1, Burst: 1, Key: ByIdentity}),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, as := dialAuth(t, addr)
+
+	if _, err := client.Get(as("a-token"), &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if _, err := client.Delete(as("a-token"), &proto.DeleteRequest{Key: "k"}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected a's second request to be limited, got %v", err)
+	}
+	if _, err := client.Get(as("b-token"), &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected b to have its own limit, got %v", err)
+	}
+	if rejections := s.RateLimitRejections(); rejections["Delete"] != 1 {
+		t.Fatalf("expected one rejected Delete, got %v", rejections)
+	}
+}
+
+func TestServer_RateLimitByNamespace(t *testing.T) {
+	namespaces := kvstore.NewNamespaces()
+	namespaces.Create("team-a", kvstore.Quota{})
+	namespaces.Create("team-b", kvstore.Quota{})
+	s := NewServer(
+		WithNamespaces(namespaces),
+		WithRateLimit(RateLimit{Rate: 1, Key: ByNamespace, Methods: []string{"Get"}}),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+
+	if _, err := client.Get(inNamespace("team-a"), &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if _, err := client.Get(inNamespace("team-a"), &proto.GetRequest{Key: "k"}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected team-a's second Get to be limited, got %v", err)
+	}
+	if _, err := client.Get(inNamespace("team-b"), &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected team-b to have its own limit, got %v", err)
+	}
+	if _, err := client.Get(context.Background(), &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected the default keyspace to have its own limit, got %v", err)
+	}
+}
+
+func TestServer_RateLimitRejectionNotCharged(t *testing.T) {
+	namespaces := kvstore.NewNamespaces()
+	namespaces.Create("team-a", kvstore.Quota{MaxOpsPerSecond: 2})
+	s := NewServer(
+		WithNamespaces(namespaces),
+		WithRateLimit(RateLimit{Rate: 1, Burst: 2}),
+		WithRateLimit(RateLimit{Rate: 1, Burst: 1, Methods: []string{"Set"}}),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := inNamespace("team-a")
+
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")}); status.Code(err) != codes.ResourceExhausted {
+		t.Fatalf("expected the second Set to be limited, got %v", err)
+	}
+	// The rejected Set must not have used up the first limit's burst or the namespace's ops/sec quota.
+	if _, err := client.Get(ctx, &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected a rejected request not to be charged, got %v", err)
+	}
+}
+
+func TestWithRateLimit_Invalid(t *testing.T) {
+	s := NewServer(WithRateLimit(RateLimit{Rate: 0}))
+	_, stop := startServing(t, s)
+	if err := stop(); err == nil || !strings.Contains(err.Error(), "rate limit") {
+		t.Fatalf("expected serving to fail with a non-positive rate, got %v", err)
+	}
+}
+
+func TestRateLimiter_Sweep(t *testing.T) {
+	now := time.Now()
+	limiter := newRateLimiter(RateLimit{Rate: 10})
+	for i := 0; i < minSweep-1; i++ {
+		limiter.bucket(fmt.Sprintf("idle-%d", i), now).take(now)
+	}
+	for i := 0; i < 10; i++ {
+		limiter.bucket("busy", now).take(now)
+	}
+
+	// Creating another bucket drops the ones that have refilled, but keeps the busy one.
+	later := now.Add(100 * time.Millisecond)
+	limiter.bucket("new", later).take(later)
+	if len(limiter.buckets) != 2 {
+		t.Fatalf("expected only the busy and new buckets to remain, got %d", len(limiter.buckets))
+	}
+	if ok, _ := limiter.bucket("busy", later).take(later); !ok {
+		t.Fatalf("expected the busy bucket to have refilled one token")
+	}
+	if ok, _ := limiter.bucket("busy", later).take(later); ok {
+		t.Fatalf("expected the busy bucket to keep its state across a sweep")
+	}
+}
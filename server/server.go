@@ -2,10 +2,14 @@ package server
 
 import (
 	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
 	"log"
 	"net"
 	"os"
 	"os/signal"
+	"sync"
 	"syscall"
 	"time"
 
@@ -13,7 +17,19 @@ import (
 	"github.com/ahmad-masud/KVStore/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/reflection"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+// Page sizes for List.
+const (
+	// DefaultListLimit is the page size used when a ListRequest does not set one.
+	DefaultListLimit = 100
+	// MaxListLimit is the largest page size List returns; larger limits are reduced to it.
+	MaxListLimit = 1000
 )
 
 // Server is a gRPC server that handles key-value store operations.
@@ -25,21 +41,49 @@ type Server struct {
 	preHook    PreHookFunc
 	postHook   PostHookFunc
 	defaultTTL time.Duration
+	tls        tlsOptions
+
+	authenticators []Authenticator
+	acl            *ACL
+
+	namespaces        *kvstore.Namespaces
+	namespaceBindings map[string]string // principal to namespace
+	namespaceLimiters sync.Map          // *kvstore.Namespace to the *tokenBucket enforcing its ops/sec quota
+
+	rateLimiters []*rateLimiter
+	rejectionsMu sync.Mutex
+	rejections   map[string]uint64 // RPC method name to requests rejected by rate limits
+
+	metricsAddr string
+	rpcMetrics  *rpcMetrics // nil unless WithMetrics is set
+
+	shutdown     chan struct{} // closed when the server starts shutting down, ending open watches
+	shutdownOnce sync.Once
+
+	optionErr error // first error from an option, such as an unreadable config file; serving fails with it
 }
 
 // NewServer creates a new Server instance with optional functional configuration.
-// By default, it uses an in-memory storage backend.
+// By default, it uses an in-memory storage backend, created only if no option sets one.
 func NewServer(opts ...Option) *Server {
 	s := &Server{
-		storage: kvstore.New(),
+		tls: tlsOptions{
+			minVersion:   tls.VersionTLS12,
+			pollInterval: DefaultCertPollInterval,
+		},
+		shutdown: make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(s)
 	}
+	if s.storage == nil {
+		s.storage = kvstore.New()
+	}
 	return s
 }
 
 // Set stores a key-value pair into the storage backend, optionally applying a TTL (time-to-live).
+// An invalid TTL fails with InvalidArgument; see ttlFor.
 // If a PreHookFunc is set, it runs before the operation.
 // If a PostHookFunc is set, it runs after a successful operation.
 func (s *Server) Set(ctx context.Context, req *proto.SetRequest) (*proto.SetResponse, error) {
@@ -49,15 +93,17 @@ func (s *Server) Set(ctx context.Context, req *proto.SetRequest) (*proto.SetResp
 		}
 	}
 
-	var ttl time.Duration
-	if req.Ttl > 0 {
-		ttl = time.Duration(req.Ttl) * time.Second
-		s.storage.SetWithTTL(req.Key, req.Value, ttl)
-	} else if s.defaultTTL > 0 {
-		ttl = s.defaultTTL
-		s.storage.SetWithTTL(req.Key, req.Value, ttl)
-	} else {
-		s.storage.Set(req.Key, req.Value)
+	exp, err := s.ttlFor(req)
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case !exp.at.IsZero():
+		s.storageFor(ctx).SetWithExpiry(req.Key, string(req.Value), exp.at)
+	case exp.ttl > 0:
+		s.storageFor(ctx).SetWithTTL(req.Key, string(req.Value), exp.ttl)
+	default:
+		s.storageFor(ctx).Set(req.Key, string(req.Value))
 	}
 
 	resp := &proto.SetResponse{Success: true}
@@ -79,11 +125,12 @@ func (s *Server) Get(ctx context.Context, req *proto.GetRequest) (*proto.GetResp
 		}
 	}
 
-	value, found := s.storage.Get(req.Key)
+	value, version, found := s.storageFor(ctx).GetWithVersion(req.Key)
 
 	resp := &proto.GetResponse{
-		Value: value,
-		Found: found,
+		Value:   []byte(value),
+		Found:   found,
+		Version: version,
 	}
 
 	if s.postHook != nil {
@@ -103,7 +150,7 @@ func (s *Server) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.D
 		}
 	}
 
-	success := s.storage.Delete(req.Key)
+	success := s.storageFor(ctx).Delete(req.Key)
 
 	resp := &proto.DeleteResponse{
 		Success: success,
@@ -116,38 +163,1035 @@ func (s *Server) Delete(ctx context.Context, req *proto.DeleteRequest) (*proto.D
 	return resp, nil
 }
 
+// MSet stores several key-value pairs in one storage call, applying each entry's TTL or the default TTL.
+// Hooks run once for the whole batch rather than once per key.
+func (s *Server) MSet(ctx context.Context, req *proto.MSetRequest) (*proto.MSetResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "MSet", req); err != nil {
+			return nil, err
+		}
+	}
+
+	entries := make([]kvstore.Entry, len(req.Entries))
+	results := make([]*proto.SetResponse, len(req.Entries))
+	for i, entry := range req.Entries {
+		exp, err := s.ttlFor(entry)
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = kvstore.Entry{Key: entry.Key, Value: string(entry.Value), TTL: exp.ttl, ExpiresAt: exp.at}
+		results[i] = &proto.SetResponse{Success: true}
+	}
+	s.storageFor(ctx).MSet(entries)
+
+	resp := &proto.MSetResponse{Results: results}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "MSet", req, resp)
+	}
+
+	return resp, nil
+}
+
+// MGet retrieves several keys in one storage call, returning results in request order.
+// Hooks run once for the whole batch rather than once per key.
+func (s *Server) MGet(ctx context.Context, req *proto.MGetRequest) (*proto.MGetResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "MGet", req); err != nil {
+			return nil, err
+		}
+	}
+
+	found := s.storageFor(ctx).MGet(req.Keys)
+	results := make([]*proto.GetResponse, len(found))
+	for i, res := range found {
+		results[i] = &proto.GetResponse{Value: []byte(res.Value), Found: res.Found, Version: res.Version}
+	}
+
+	resp := &proto.MGetResponse{Results: results}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "MGet", req, resp)
+	}
+
+	return resp, nil
+}
+
+// MDelete removes several keys in one storage call, reporting per key whether it was deleted.
+// Hooks run once for the whole batch rather than once per key.
+func (s *Server) MDelete(ctx context.Context, req *proto.MDeleteRequest) (*proto.MDeleteResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "MDelete", req); err != nil {
+			return nil, err
+		}
+	}
+
+	deleted := s.storageFor(ctx).MDelete(req.Keys)
+	results := make([]*proto.DeleteResponse, len(deleted))
+	for i, ok := range deleted {
+		results[i] = &proto.DeleteResponse{Success: ok}
+	}
+
+	resp := &proto.MDeleteResponse{Results: results}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "MDelete", req, resp)
+	}
+
+	return resp, nil
+}
+
+// CompareAndSwap stores a key-value pair only if the key's current version matches the expected version.
+// An expected version of 0 only succeeds if the key does not exist.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) CompareAndSwap(ctx context.Context, req *proto.CompareAndSwapRequest) (*proto.ConditionalSetResponse, error) {
+	cond := kvstore.Compare{Key: req.Key, Target: kvstore.CompareVersion, Version: req.Version}
+	return s.conditionalSet(ctx, "CompareAndSwap", req, cond, req.Value, func(ttl time.Duration) (uint64, bool) {
+		return s.storageFor(ctx).CompareAndSwap(req.Key, string(req.Value), req.Version, ttl)
+	})
+}
+
+// SetIfNotExists stores a key-value pair only if the key does not already exist.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) SetIfNotExists(ctx context.Context, req *proto.SetRequest) (*proto.ConditionalSetResponse, error) {
+	cond := kvstore.Compare{Key: req.Key, Target: kvstore.CompareExists, Exists: false}
+	return s.conditionalSet(ctx, "SetIfNotExists", req, cond, req.Value, func(ttl time.Duration) (uint64, bool) {
+		return s.storageFor(ctx).SetIfNotExists(req.Key, string(req.Value), ttl)
+	})
+}
+
+// SetIfExists replaces the value of a key only if the key already exists.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) SetIfExists(ctx context.Context, req *proto.SetRequest) (*proto.ConditionalSetResponse, error) {
+	cond := kvstore.Compare{Key: req.Key, Target: kvstore.CompareExists, Exists: true}
+	return s.conditionalSet(ctx, "SetIfExists", req, cond, req.Value, func(ttl time.Duration) (uint64, bool) {
+		return s.storageFor(ctx).SetIfExists(req.Key, string(req.Value), ttl)
+	})
+}
+
+// Watch streams put, delete, and expire events for a key, or for every key with a prefix, until the client
+// cancels. A non-zero revision resumes after that revision, replaying any events the client missed.
+// It fails with OutOfRange if those events are no longer retained, and with Unimplemented if the storage
+// backend does not implement kvstore.Watchable. If a PreHookFunc is set, it runs before the stream starts.
+func (s *Server) Watch(req *proto.WatchRequest, stream proto.KVStore_WatchServer) error {
+	ctx := stream.Context()
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "Watch", req); err != nil {
+			return err
+		}
+	}
+
+	watchable, ok := s.storageFor(ctx).(kvstore.Watchable)
+	if !ok {
+		return status.Error(codes.Unimplemented, "storage backend does not support watches")
+	}
+	events, err := watchable.Watch(ctx, req.Key, req.Prefix, req.Revision)
+	if errors.Is(err, kvstore.ErrRevisionCompacted) {
+		return status.Error(codes.OutOfRange, err.Error())
+	} else if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				// The store cancelled the watch because it is closing or the client fell behind.
+				return status.Error(codes.Unavailable, "watch cancelled by the server; resume from the last revision")
+			}
+			if err := stream.Send(watchEvent(ev)); err != nil {
+				return err
+			}
+		case <-s.shutdown:
+			// End open streams so that a graceful stop does not wait on them forever.
+			return status.Error(codes.Unavailable, "server is shutting down; resume from the last revision")
+		}
+	}
+}
+
+// List returns a page of keys in ascending order, optionally restricted to a prefix and a [start, end) range.
+// If more keys remain, the response includes a token that continues the listing from the next key.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) List(ctx context.Context, req *proto.ListRequest) (*proto.ListResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "List", req); err != nil {
+			return nil, err
+		}
+	}
+
+	start, end := req.Start, req.End
+	if req.Prefix != "" {
+		if start < req.Prefix {
+			start = req.Prefix
+		}
+		if prefixEnd := kvstore.PrefixEnd(req.Prefix); prefixEnd != "" && (end == "" || prefixEnd < end) {
+			end = prefixEnd
+		}
+	}
+	if req.PageToken != "" {
+		next, err := base64.RawURLEncoding.DecodeString(req.PageToken)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "invalid page token")
+		}
+		if string(next) > start {
+			start = string(next)
+		}
+	}
+	limit := int(req.Limit)
+	if limit <= 0 {
+		limit = DefaultListLimit
+	} else if limit > MaxListLimit {
+		limit = MaxListLimit
+	}
+
+	// Fetch one extra key to learn whether another page follows.
+	found := s.storageFor(ctx).Scan(start, end, limit+1)
+	resp := &proto.ListResponse{}
+	if len(found) > limit {
+		found = found[:limit]
+		// The smallest key after the last one returned.
+		resp.NextPageToken = base64.RawURLEncoding.EncodeToString([]byte(found[limit-1].Key + "\x00"))
+	}
+	resp.Items = make([]*proto.KeyValue, len(found))
+	for i, kv := range found {
+		resp.Items[i] = &proto.KeyValue{Key: kv.Key, Value: []byte(kv.Value), Version: kv.Version}
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "List", req, resp)
+	}
+
+	return resp, nil
+}
+
+// Txn runs a transaction atomically: if every compare clause holds, the success operations run,
+// otherwise the failure operations run. Puts without a TTL use the default TTL.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) Txn(ctx context.Context, req *proto.TxnRequest) (*proto.TxnResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "Txn", req); err != nil {
+			return nil, err
+		}
+	}
+
+	then, err := s.txnOps(req.Success)
+	if err != nil {
+		return nil, err
+	}
+	otherwise, err := s.txnOps(req.Failure)
+	if err != nil {
+		return nil, err
+	}
+	txn := kvstore.Txn{
+		If:   make([]kvstore.Compare, len(req.Compare)),
+		Then: then,
+		Else: otherwise,
+	}
+	for i, c := range req.Compare {
+		txn.If[i] = kvstore.Compare{Key: c.Key, Value: string(c.Value), Version: c.Version, Exists: c.Exists}
+		switch c.Target {
+		case proto.Compare_VERSION:
+			txn.If[i].Target = kvstore.CompareVersion
+		case proto.Compare_EXISTS:
+			txn.If[i].Target = kvstore.CompareExists
+		default:
+			txn.If[i].Target = kvstore.CompareValue
+		}
+	}
+
+	result := s.storageFor(ctx).Txn(txn)
+	resp := &proto.TxnResponse{
+		Succeeded: result.Succeeded,
+		Results:   make([]*proto.TxnOpResult, len(result.Results)),
+	}
+	for i, r := range result.Results {
+		resp.Results[i] = &proto.TxnOpResult{Key: r.Key, Value: []byte(r.Value), Version: r.Version, Found: r.Found}
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "Txn", req, resp)
+	}
+
+	return resp, nil
+}
+
+// Expire sets a key to expire after the requested TTL without changing its value or version.
+// The TTL must be positive; Persist removes a TTL.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) Expire(ctx context.Context, req *proto.ExpireRequest) (*proto.ExpireResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "Expire", req); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := req.Ttl.AsDuration()
+	if ttl <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl must be positive")
+	}
+
+	resp := &proto.ExpireResponse{
+		Found: s.storageFor(ctx).Expire(req.Key, ttl),
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "Expire", req, resp)
+	}
+
+	return resp, nil
+}
+
+// Persist removes a key's TTL so it never expires.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) Persist(ctx context.Context, req *proto.PersistRequest) (*proto.PersistResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "Persist", req); err != nil {
+			return nil, err
+		}
+	}
+
+	resp := &proto.PersistResponse{
+		Success: s.storageFor(ctx).Persist(req.Key),
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "Persist", req, resp)
+	}
+
+	return resp, nil
+}
+
+// TTL returns a key's remaining lifetime, leaving the TTL unset if the key never expires.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) TTL(ctx context.Context, req *proto.TTLRequest) (*proto.TTLResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "TTL", req); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl, found := s.storageFor(ctx).TTL(req.Key)
+
+	resp := &proto.TTLResponse{Found: found}
+	if ttl > 0 {
+		resp.Ttl = durationpb.New(ttl)
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "TTL", req, resp)
+	}
+
+	return resp, nil
+}
+
+// GetAndTouch retrieves a value and resets its TTL to the requested TTL, or the server's default TTL,
+// for sliding expiration. It fails with InvalidArgument if neither is set.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) GetAndTouch(ctx context.Context, req *proto.GetAndTouchRequest) (*proto.GetAndTouchResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "GetAndTouch", req); err != nil {
+			return nil, err
+		}
+	}
+
+	ttl := req.Ttl.AsDuration()
+	if ttl <= 0 {
+		ttl = s.defaultTTL
+	}
+	if ttl <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "ttl must be positive")
+	}
+
+	value, found := s.storageFor(ctx).GetAndTouch(req.Key, ttl)
+
+	resp := &proto.GetAndTouchResponse{
+		Value: []byte(value),
+		Found: found,
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "GetAndTouch", req, resp)
+	}
+
+	return resp, nil
+}
+
+// IncrBy atomically adds the delta to an integer value, treating a missing key as zero.
+// It fails with InvalidArgument if the value is not an integer, and OutOfRange if the result would overflow.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) IncrBy(ctx context.Context, req *proto.IncrByRequest) (*proto.IncrByResponse, error) {
+	return s.incrBy(ctx, "IncrBy", req, s.storageFor(ctx).IncrBy)
+}
+
+// DecrBy atomically subtracts the delta from an integer value, treating a missing key as zero.
+// It fails with InvalidArgument if the value is not an integer, and OutOfRange if the result would overflow.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) DecrBy(ctx context.Context, req *proto.IncrByRequest) (*proto.IncrByResponse, error) {
+	return s.incrBy(ctx, "DecrBy", req, s.storageFor(ctx).DecrBy)
+}
+
+// IncrByFloat atomically adds the delta to a numeric value, treating a missing key as zero.
+// It fails with InvalidArgument if the value or delta is not a finite number, and OutOfRange if the result would overflow.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) IncrByFloat(ctx context.Context, req *proto.IncrByFloatRequest) (*proto.IncrByFloatResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, "IncrByFloat", req); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := s.storageFor(ctx).IncrByFloat(req.Key, req.Delta)
+	if err != nil {
+		return nil, counterError(err)
+	}
+
+	resp := &proto.IncrByFloatResponse{Value: value}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "IncrByFloat", req, resp)
+	}
+
+	return resp, nil
+}
+
+// incrBy runs the hooks around an integer counter update.
+func (s *Server) incrBy(ctx context.Context, method string, req *proto.IncrByRequest, update func(key string, delta int64) (int64, error)) (*proto.IncrByResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, method, req); err != nil {
+			return nil, err
+		}
+	}
+
+	value, err := update(req.Key, req.Delta)
+	if err != nil {
+		return nil, counterError(err)
+	}
+
+	resp := &proto.IncrByResponse{Value: value}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, method, req, resp)
+	}
+
+	return resp, nil
+}
+
+// counterError converts a counter error from the storage backend to a gRPC status.
+func counterError(err error) error {
+	switch {
+	case errors.Is(err, kvstore.ErrNotInteger), errors.Is(err, kvstore.ErrNotNumber):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, kvstore.ErrOverflow):
+		return status.Error(codes.OutOfRange, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// Type returns the type of value stored at a key: a string, hash, list, or set.
+// It fails with Unimplemented if the storage backend does not implement kvstore.Collections.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after the operation.
+func (s *Server) Type(ctx context.Context, req *proto.TypeRequest) (*proto.TypeResponse, error) {
+	collections, err := s.collections(ctx, "Type", req)
+	if err != nil {
+		return nil, err
+	}
+
+	typ, found := collections.Type(req.Key)
+
+	resp := &proto.TypeResponse{
+		Type:  proto.TypeResponse_Type(typ),
+		Found: found,
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "Type", req, resp)
+	}
+
+	return resp, nil
+}
+
+// HSet sets fields of a hash, creating it if needed, and returns the number of fields that were added.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) HSet(ctx context.Context, req *proto.HSetRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "HSet", req)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := make(map[string]string, len(req.Fields))
+	for field, value := range req.Fields {
+		fields[field] = string(value)
+	}
+	n, err := collections.HSet(req.Key, fields)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "HSet", req, n), nil
+}
+
+// HGet retrieves one field of a hash.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) HGet(ctx context.Context, req *proto.HGetRequest) (*proto.HGetResponse, error) {
+	collections, err := s.collections(ctx, "HGet", req)
+	if err != nil {
+		return nil, err
+	}
+
+	value, found, err := collections.HGet(req.Key, req.Field)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	resp := &proto.HGetResponse{
+		Value: []byte(value),
+		Found: found,
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "HGet", req, resp)
+	}
+
+	return resp, nil
+}
+
+// HDel removes fields from a hash and returns the number that were removed.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) HDel(ctx context.Context, req *proto.HDelRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "HDel", req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := collections.HDel(req.Key, req.Fields...)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "HDel", req, n), nil
+}
+
+// HGetAll retrieves every field of a hash; the result is empty if the key does not exist.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) HGetAll(ctx context.Context, req *proto.KeyRequest) (*proto.HGetAllResponse, error) {
+	collections, err := s.collections(ctx, "HGetAll", req)
+	if err != nil {
+		return nil, err
+	}
+
+	fields, err := collections.HGetAll(req.Key)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	resp := &proto.HGetAllResponse{Fields: make(map[string][]byte, len(fields))}
+	for field, value := range fields {
+		resp.Fields[field] = []byte(value)
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, "HGetAll", req, resp)
+	}
+
+	return resp, nil
+}
+
+// LPush inserts values at the head of a list, creating it if needed, and returns the new length.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) LPush(ctx context.Context, req *proto.PushRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "LPush", req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := collections.LPush(req.Key, stringValues(req.Values)...)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "LPush", req, n), nil
+}
+
+// RPush appends values to the tail of a list, creating it if needed, and returns the new length.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) RPush(ctx context.Context, req *proto.PushRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "RPush", req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := collections.RPush(req.Key, stringValues(req.Values)...)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "RPush", req, n), nil
+}
+
+// LPop removes and returns up to count elements, or one if count is unset, from the head of a list.
+// It fails with InvalidArgument if count is negative, and FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) LPop(ctx context.Context, req *proto.LPopRequest) (*proto.ValuesResponse, error) {
+	collections, err := s.collections(ctx, "LPop", req)
+	if err != nil {
+		return nil, err
+	}
+
+	count := int(req.Count)
+	if count < 0 {
+		return nil, status.Error(codes.InvalidArgument, "count must not be negative")
+	} else if count == 0 {
+		count = 1
+	}
+	values, err := collections.LPop(req.Key, count)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.values(ctx, "LPop", req, values), nil
+}
+
+// LRange retrieves the elements of a list from start to stop inclusive, counting negative indexes from the end.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) LRange(ctx context.Context, req *proto.LRangeRequest) (*proto.ValuesResponse, error) {
+	collections, err := s.collections(ctx, "LRange", req)
+	if err != nil {
+		return nil, err
+	}
+
+	values, err := collections.LRange(req.Key, int(req.Start), int(req.Stop))
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.values(ctx, "LRange", req, values), nil
+}
+
+// SAdd adds members to a set, creating it if needed, and returns the number that were not already present.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) SAdd(ctx context.Context, req *proto.MembersRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "SAdd", req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := collections.SAdd(req.Key, stringValues(req.Members)...)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "SAdd", req, n), nil
+}
+
+// SRem removes members from a set and returns the number that were removed.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) SRem(ctx context.Context, req *proto.MembersRequest) (*proto.CountResponse, error) {
+	collections, err := s.collections(ctx, "SRem", req)
+	if err != nil {
+		return nil, err
+	}
+
+	n, err := collections.SRem(req.Key, stringValues(req.Members)...)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.count(ctx, "SRem", req, n), nil
+}
+
+// SMembers retrieves the members of a set in ascending order.
+// It fails with FailedPrecondition if the key holds another type of value.
+// If a PreHookFunc is set, it runs before the operation.
+// If a PostHookFunc is set, it runs after a successful operation.
+func (s *Server) SMembers(ctx context.Context, req *proto.KeyRequest) (*proto.ValuesResponse, error) {
+	collections, err := s.collections(ctx, "SMembers", req)
+	if err != nil {
+		return nil, err
+	}
+
+	members, err := collections.SMembers(req.Key)
+	if err != nil {
+		return nil, collectionError(err)
+	}
+
+	return s.values(ctx, "SMembers", req, members), nil
+}
+
+// collections runs the pre-hook for a collection method and returns the storage backend's collections,
+// failing with Unimplemented if it has none.
+func (s *Server) collections(ctx context.Context, method string, req interface{}) (kvstore.Collections, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, method, req); err != nil {
+			return nil, err
+		}
+	}
+
+	collections, ok := s.storageFor(ctx).(kvstore.Collections)
+	if !ok {
+		return nil, status.Error(codes.Unimplemented, "storage backend does not support hashes, lists, or sets")
+	}
+	return collections, nil
+}
+
+// count builds a CountResponse and runs the post-hook.
+func (s *Server) count(ctx context.Context, method string, req interface{}, n int) *proto.CountResponse {
+	resp := &proto.CountResponse{Count: int64(n)}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, method, req, resp)
+	}
+
+	return resp
+}
+
+// values builds a ValuesResponse and runs the post-hook.
+func (s *Server) values(ctx context.Context, method string, req interface{}, values []string) *proto.ValuesResponse {
+	resp := &proto.ValuesResponse{Values: make([][]byte, len(values))}
+	for i, value := range values {
+		resp.Values[i] = []byte(value)
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, method, req, resp)
+	}
+
+	return resp
+}
+
+// collectionError converts a collection error from the storage backend to a gRPC status.
+func collectionError(err error) error {
+	if errors.Is(err, kvstore.ErrWrongType) {
+		return status.Error(codes.FailedPrecondition, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// stringValues converts byte-slice values from a request to the strings the storage backend holds.
+func stringValues(values [][]byte) []string {
+	out := make([]string, len(values))
+	for i, value := range values {
+		out[i] = string(value)
+	}
+	return out
+}
+
+// txnOps converts transaction operations to their storage form, failing if a put has an invalid TTL.
+func (s *Server) txnOps(ops []*proto.TxnOp) ([]kvstore.Op, error) {
+	out := make([]kvstore.Op, len(ops))
+	for i, op := range ops {
+		out[i] = kvstore.Op{Key: op.Key, Value: string(op.Value)}
+		switch op.Type {
+		case proto.TxnOp_DELETE:
+			out[i].Type = kvstore.OpDelete
+		case proto.TxnOp_GET:
+			out[i].Type = kvstore.OpGet
+		default:
+			exp, err := s.ttlFor(op)
+			if err != nil {
+				return nil, err
+			}
+			out[i].Type = kvstore.OpPut
+			out[i].TTL, out[i].ExpiresAt = exp.ttl, exp.at
+		}
+	}
+	return out, nil
+}
+
+// watchEvent converts a storage event to its protobuf form.
+func watchEvent(ev kvstore.Event) *proto.WatchEvent {
+	out := &proto.WatchEvent{Key: ev.Key, Value: []byte(ev.Value), Revision: ev.Revision}
+	switch ev.Type {
+	case kvstore.EventDelete:
+		out.Type = proto.WatchEvent_DELETE
+	case kvstore.EventExpire:
+		out.Type = proto.WatchEvent_EXPIRE
+	default:
+		out.Type = proto.WatchEvent_PUT
+	}
+	return out
+}
+
+// conditionalSet runs the hooks around a conditional write, passing it the request's TTL, and reports its outcome.
+// A request with an absolute expiry instead sets cond's key to value with SetIf, so that the expiry is stored as given.
+func (s *Server) conditionalSet(ctx context.Context, method string, req ttlRequest, cond kvstore.Compare, value []byte, write func(ttl time.Duration) (uint64, bool)) (*proto.ConditionalSetResponse, error) {
+	if s.preHook != nil {
+		if err := s.preHook(ctx, method, req); err != nil {
+			return nil, err
+		}
+	}
+
+	exp, err := s.ttlFor(req)
+	if err != nil {
+		return nil, err
+	}
+	var version uint64
+	var success bool
+	if exp.at.IsZero() {
+		version, success = write(exp.ttl)
+	} else {
+		version, success = s.storageFor(ctx).SetIf(cond, string(value), exp.at)
+	}
+
+	resp := &proto.ConditionalSetResponse{
+		Success: success,
+		Version: version,
+	}
+
+	if s.postHook != nil {
+		_ = s.postHook(ctx, method, req, resp)
+	}
+
+	return resp, nil
+}
+
+// ttlRequest is implemented by the requests that carry a TTL: SetRequest, CompareAndSwapRequest, and TxnOp.
+type ttlRequest interface {
+	GetTtl() int64
+	GetTtlDuration() *durationpb.Duration
+	GetExpireAt() *timestamppb.Timestamp
+}
+
+// expiry is when a write expires: after a relative TTL, or at an absolute time if at is set.
+// The zero value means no expiry.
+type expiry struct {
+	ttl time.Duration
+	at  time.Time
+}
+
+// ttlFor returns a request's expiry, falling back to the server's default TTL if none is set.
+// The TTL may be given as legacy whole seconds, as a duration, or as an absolute expiry, which is kept
+// absolute; setting more than one, a negative duration, or an expiry that has passed fails with
+// InvalidArgument. An explicit ttl_duration of zero means no expiry, overriding the default.
+func (s *Server) ttlFor(req ttlRequest) (expiry, error) {
+	seconds, ttl, expireAt := req.GetTtl(), req.GetTtlDuration(), req.GetExpireAt()
+	if (seconds != 0 && ttl != nil) || (seconds != 0 && expireAt != nil) || (ttl != nil && expireAt != nil) {
+		return expiry{}, status.Error(codes.InvalidArgument, "at most one of ttl, ttl_duration, and expire_at may be set")
+	}
+
+	switch {
+	case expireAt != nil:
+		if err := expireAt.CheckValid(); err != nil {
+			return expiry{}, status.Errorf(codes.InvalidArgument, "invalid expire_at: %v", err)
+		}
+		at := expireAt.AsTime()
+		if !at.After(time.Now()) {
+			return expiry{}, status.Error(codes.InvalidArgument, "expire_at is in the past")
+		}
+		return expiry{at: at}, nil
+	case ttl != nil:
+		if err := ttl.CheckValid(); err != nil || ttl.AsDuration() < 0 {
+			return expiry{}, status.Error(codes.InvalidArgument, "ttl_duration must be a non-negative duration")
+		}
+		return expiry{ttl: ttl.AsDuration()}, nil
+	case seconds > 0:
+		return expiry{ttl: time.Duration(seconds) * time.Second}, nil
+	}
+	return expiry{ttl: s.defaultTTL}, nil
+}
+
+// Stats returns the default storage backend's counters, such as evictions and expirations.
+// It returns false if the backend does not implement kvstore.StatsProvider.
+func (s *Server) Stats() (kvstore.Stats, bool) {
+	provider, ok := s.storage.(kvstore.StatsProvider)
+	if !ok {
+		return kvstore.Stats{}, false
+	}
+	return provider.Stats(), true
+}
+
+// Close flushes and closes the storage backend and any namespaces, stopping their background work.
+// It should be called once the server has stopped handling requests.
+func (s *Server) Close() error {
+	err := s.storage.Close()
+	if s.namespaces != nil {
+		if nsErr := s.namespaces.Close(); nsErr != nil && err == nil {
+			err = nsErr
+		}
+	}
+	return err
+}
+
 // Listen starts the gRPC server on the specified TCP address (e.g., ":50051").
-// It registers the KVStore service and begins serving incoming requests.
+// It registers the KVStore service and begins serving incoming requests, over TLS if WithTLS is set.
+// On SIGINT or SIGTERM it stops gracefully and then closes the storage backend,
+// so buffered writes are flushed before the process exits.
 func (s *Server) Listen(addr string) error {
 	lis, err := net.Listen("tcp", addr)
 	if err != nil {
 		return err
 	}
 
-	grpcServer := grpc.NewServer()
-	proto.RegisterKVStoreServer(grpcServer, s)
-
-	reflection.Register(grpcServer)
-
 	// Setup signal handling
 	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
 	defer stop()
 
+	return s.serve(ctx, lis)
+}
+
+// serverOptions returns the gRPC server options for the configured TLS, metrics, authentication, namespaces, and rate limits.
+func (s *Server) serverOptions() ([]grpc.ServerOption, error) {
+	if s.optionErr != nil {
+		return nil, s.optionErr
+	}
+	var opts []grpc.ServerOption
+	if s.tls.enabled() {
+		creds, err := s.tls.credentials()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, grpc.Creds(creds))
+	}
+	// Metrics come first, so that they record requests rejected by the interceptors after them.
+	if s.rpcMetrics != nil {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(s.metricsUnary),
+			grpc.ChainStreamInterceptor(s.metricsStream),
+		)
+	}
+	if s.authEnabled() {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(s.authUnary),
+			grpc.ChainStreamInterceptor(s.authStream),
+		)
+	}
+	// Namespaces are resolved after authentication, since principals may be bound to one.
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(s.namespaceUnary),
+		grpc.ChainStreamInterceptor(s.namespaceStream),
+	)
+	// Rate limits come next, so that they can count requests by principal or namespace.
+	if len(s.rateLimiters) > 0 {
+		opts = append(opts,
+			grpc.ChainUnaryInterceptor(s.rateLimitUnary),
+			grpc.ChainStreamInterceptor(s.rateLimitStream),
+		)
+	}
+	// Namespace quotas come after rate limits, so that a request a rate limit rejects is not charged to its namespace.
+	opts = append(opts,
+		grpc.ChainUnaryInterceptor(s.quotaUnary),
+		grpc.ChainStreamInterceptor(s.quotaStream),
+	)
+	opts = append(opts, grpc.ChainUnaryInterceptor(s.storageFailureUnary))
+	return opts, nil
+}
+
+// failingStorage is implemented by storage backends that stop accepting writes after a failure,
+// such as kvstore.PersistentKVStore when its log cannot be written.
+type failingStorage interface {
+	Err() error
+}
+
+// storageFailureUnary fails write requests to storage that has failed, since their changes may not
+// have been persisted even if the handler succeeded.
+func (s *Server) storageFailureUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	resp, err := handler(ctx, req)
+	if err != nil || !isWriteRequest(req) {
+		return resp, err
+	}
+	if storage, ok := s.storageFor(ctx).(failingStorage); ok {
+		if err := storage.Err(); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+	return resp, nil
+}
+
+// isWriteRequest reports whether req changes keys.
+func isWriteRequest(req interface{}) bool {
+	scopes, _ := requestScopes(req)
+	for _, sc := range scopes {
+		if sc.perm&(PermWrite|PermDelete) != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// endWatches closes the shutdown channel, ending open watches. Calling it again has no effect.
+func (s *Server) endWatches() {
+	s.shutdownOnce.Do(func() { close(s.shutdown) })
+}
+
+// serve runs the gRPC server on lis until ctx is cancelled or serving fails,
+// closing the storage backend in either case.
+func (s *Server) serve(ctx context.Context, lis net.Listener) error {
+	opts, err := s.serverOptions()
+	var stopMetrics func()
+	if err == nil {
+		stopMetrics, err = s.startMetrics()
+	}
+	if err != nil {
+		lis.Close()
+		if closeErr := s.Close(); closeErr != nil {
+			log.Printf("Failed to close storage: %v", closeErr)
+		}
+		return err
+	}
+	defer stopMetrics()
+
+	grpcServer := grpc.NewServer(opts...)
+	proto.RegisterKVStoreServer(grpcServer, s)
+
+	reflection.Register(grpcServer)
+
 	// Run gRPC server in background
 	errCh := make(chan error, 1)
 	go func() {
 		errCh <- grpcServer.Serve(lis)
 	}()
 
-	log.Printf("KVStore server started on %s", addr)
+	log.Printf("KVStore server started on %s", lis.Addr())
 
 	// Wait for signal
 	select {
 	case <-ctx.Done():
 		log.Println("Shutdown signal received. Stopping gRPC server...")
+		s.endWatches()
 		grpcServer.GracefulStop()
+		if err := s.Close(); err != nil {
+			log.Printf("Failed to close storage: %v", err)
+			return err
+		}
 		return nil
 	case err := <-errCh:
+		if closeErr := s.Close(); closeErr != nil {
+			log.Printf("Failed to close storage: %v", closeErr)
+		}
 		return err
 	}
 }
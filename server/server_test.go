@@ -1,15 +1,22 @@
 package server
 
 import (
+	"bytes"
 	"context"
 	"net"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/ahmad-masud/KVStore/kvstore"
 	"github.com/ahmad-masud/KVStore/proto"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+	"google.golang.org/protobuf/types/known/timestamppb"
 )
 
 func startTestServer(t *testing.T) (proto.KVStoreClient, func()) {
@@ -53,7 +60,7 @@ func TestServer_SetAndGet(t *testing.T) {
 	// Set key
 	_, err := client.Set(ctx, &proto.SetRequest{
 		Key:   "foo",
-		Value: "bar",
+		Value: []byte("bar"),
 	})
 	if err != nil {
 		t.Fatalf("Set failed: %v", err)
@@ -66,7 +73,7 @@ func TestServer_SetAndGet(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Get failed: %v", err)
 	}
-	if !resp.Found || resp.Value != "bar" {
+	if !resp.Found || string(resp.Value) != "bar" {
 		t.Fatalf("unexpected Get response: %+v", resp)
 	}
 }
@@ -80,7 +87,7 @@ func TestServer_Delete(t *testing.T) {
 	// Set key
 	_, err := client.Set(ctx, &proto.SetRequest{
 		Key:   "foo",
-		Value: "bar",
+		Value: []byte("bar"),
 	})
 	if err != nil {
 		t.Fatalf("Set failed: %v", err)
@@ -118,7 +125,7 @@ func TestServer_TTLExpiration(t *testing.T) {
 	// Set key with short TTL
 	_, err := client.Set(ctx, &proto.SetRequest{
 		Key:        "baz",
-		Value:      "qux",
+		Value:      []byte("qux"),
 		Ttl: 1, // expires in 1 second
 	})
 	if err != nil {
@@ -132,7 +139,7 @@ func TestServer_TTLExpiration(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Get failed: %v", err)
 	}
-	if !getResp.Found || getResp.Value != "qux" {
+	if !getResp.Found || string(getResp.Value) != "qux" {
 		t.Fatalf("unexpected immediate Get: %+v", getResp)
 	}
 
@@ -149,3 +156,594 @@ func TestServer_TTLExpiration(t *testing.T) {
 		t.Fatalf("expected key to expire, but found: %+v", getResp)
 	}
 }
+
+func TestServer_Stats(t *testing.T) {
+	s := NewServer(WithStorage(kvstore.New(kvstore.WithMaxEntries(1))))
+
+	ctx := context.Background()
+	for _, key := range []string{"a", "b"} {
+		if _, err := s.Set(ctx, &proto.SetRequest{Key: key, Value: []byte("v")}); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+
+	stats, ok := s.Stats()
+	if !ok {
+		t.Fatalf("expected in-memory storage to expose stats")
+	}
+	if stats.Evicted != 1 || stats.Keys != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+}
+
+func TestServer_ShutdownClosesStorage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "kv.log")
+	store, err := kvstore.NewPersistentKVStore(path, true, kvstore.WithSyncPolicy(kvstore.SyncNever))
+	if err != nil {
+		t.Fatalf("failed to create persistent store: %v", err)
+	}
+	s := NewServer(WithStorage(store))
+
+	lis, err := net.Listen("tcp", "localhost:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(ctx, lis)
+	}()
+
+	conn, err := grpc.NewClient(lis.Addr().String(), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	if _, err := proto.NewKVStoreClient(conn).Set(context.Background(), &proto.SetRequest{Key: "foo", Value: []byte("bar")}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Fatalf("expected clean shutdown, got %v", err)
+	}
+
+	// The storage is already closed, so closing it again is a no-op.
+	if err := s.Close(); err != nil {
+		t.Fatalf("expected second Close to succeed, got %v", err)
+	}
+
+	reopened, err := kvstore.NewPersistentKVStore(path, false)
+	if err != nil {
+		t.Fatalf("failed to reopen persistent store: %v", err)
+	}
+	defer reopened.Close()
+	if val, ok := reopened.Get("foo"); !ok || val != "bar" {
+		t.Fatalf("expected write to survive shutdown, got %q", val)
+	}
+}
+
+func TestServer_Batch(t *testing.T) {
+	var methods []string
+	s := NewServer(WithPreHook(func(ctx context.Context, method string, req interface{}) error {
+		methods = append(methods, method)
+		return nil
+	}))
+	defer s.Close()
+
+	ctx := context.Background()
+	_, err := s.MSet(ctx, &proto.MSetRequest{Entries: []*proto.SetRequest{
+		{Key: "foo", Value: []byte("bar")},
+		{Key: "baz", Value: []byte("qux"), Ttl: 60},
+	}})
+	if err != nil {
+		t.Fatalf("MSet failed: %v", err)
+	}
+
+	getResp, err := s.MGet(ctx, &proto.MGetRequest{Keys: []string{"foo", "missing", "baz"}})
+	if err != nil {
+		t.Fatalf("MGet failed: %v", err)
+	}
+	got := getResp.Results
+	if len(got) != 3 || string(got[0].Value) != "bar" || got[1].Found || string(got[2].Value) != "qux" {
+		t.Fatalf("unexpected MGet results: %v", got)
+	}
+
+	delResp, err := s.MDelete(ctx, &proto.MDeleteRequest{Keys: []string{"foo", "missing"}})
+	if err != nil {
+		t.Fatalf("MDelete failed: %v", err)
+	}
+	if !delResp.Results[0].Success || delResp.Results[1].Success {
+		t.Fatalf("unexpected MDelete results: %v", delResp.Results)
+	}
+
+	if len(methods) != 3 || methods[0] != "MSet" || methods[1] != "MGet" || methods[2] != "MDelete" {
+		t.Fatalf("expected hooks to run once per batch, got %v", methods)
+	}
+}
+
+func TestServer_ConditionalWrites(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+
+	created, err := client.SetIfNotExists(ctx, &proto.SetRequest{Key: "lock", Value: []byte("owner-1")})
+	if err != nil || !created.Success {
+		t.Fatalf("expected SetIfNotExists to succeed, got %v, %v", created, err)
+	}
+	again, err := client.SetIfNotExists(ctx, &proto.SetRequest{Key: "lock", Value: []byte("owner-2")})
+	if err != nil || again.Success || again.Version != created.Version {
+		t.Fatalf("expected SetIfNotExists on a held lock to fail, got %v, %v", again, err)
+	}
+
+	getResp, err := client.Get(ctx, &proto.GetRequest{Key: "lock"})
+	if err != nil || getResp.Version != created.Version {
+		t.Fatalf("expected Get to return version %d, got %v, %v", created.Version, getResp, err)
+	}
+
+	swapped, err := client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: "lock", Value: []byte("owner-2"), Version: getResp.Version})
+	if err != nil || !swapped.Success || swapped.Version <= created.Version {
+		t.Fatalf("expected CompareAndSwap to succeed, got %v, %v", swapped, err)
+	}
+	stale, err := client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: "lock", Value: []byte("owner-3"), Version: getResp.Version})
+	if err != nil || stale.Success {
+		t.Fatalf("expected CompareAndSwap with a stale version to fail, got %v, %v", stale, err)
+	}
+
+	missing, err := client.SetIfExists(ctx, &proto.SetRequest{Key: "missing", Value: []byte("x")})
+	if err != nil || missing.Success {
+		t.Fatalf("expected SetIfExists on a missing key to fail, got %v, %v", missing, err)
+	}
+}
+
+func TestServer_Watch(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	for _, key := range []string{"other", "config/a"} {
+		if _, err := client.Set(ctx, &proto.SetRequest{Key: key, Value: []byte("1")}); err != nil {
+			t.Fatalf("Set failed: %v", err)
+		}
+	}
+	got, err := client.Get(ctx, &proto.GetRequest{Key: "config/a"})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+
+	// Watching from just before the write replays it, so the stream is known to be live.
+	// Revision 0 would mean new events only, hence the earlier write to another key.
+	stream, err := client.Watch(ctx, &proto.WatchRequest{Key: "config/", Prefix: true, Revision: got.Version - 1})
+	if err != nil {
+		t.Fatalf("Watch failed: %v", err)
+	}
+	first, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if first.Type != proto.WatchEvent_PUT || first.Key != "config/a" || string(first.Value) != "1" || first.Revision != got.Version {
+		t.Fatalf("unexpected replayed event: %v", first)
+	}
+
+	client.Set(ctx, &proto.SetRequest{Key: "other", Value: []byte("x")})
+	client.Delete(ctx, &proto.DeleteRequest{Key: "config/a"})
+
+	ev, err := stream.Recv()
+	if err != nil {
+		t.Fatalf("Recv failed: %v", err)
+	}
+	if ev.Type != proto.WatchEvent_DELETE || ev.Key != "config/a" || ev.Revision <= first.Revision {
+		t.Fatalf("unexpected event: %v", ev)
+	}
+}
+
+// testWatchStream is a minimal server stream for calling Watch directly.
+type testWatchStream struct {
+	grpc.ServerStream
+	ctx    context.Context
+	events []*proto.WatchEvent
+}
+
+func (s *testWatchStream) Context() context.Context { return s.ctx }
+
+func (s *testWatchStream) Send(ev *proto.WatchEvent) error {
+	s.events = append(s.events, ev)
+	return nil
+}
+
+func TestServer_WatchUnsupportedStorage(t *testing.T) {
+	s := NewServer(WithStorage(kvstore.NewSharded(2)))
+	defer s.Close()
+
+	err := s.Watch(&proto.WatchRequest{Key: "k"}, &testWatchStream{ctx: context.Background()})
+	if status.Code(err) != codes.Unimplemented {
+		t.Fatalf("expected Unimplemented, got %v", err)
+	}
+}
+
+func TestServer_ShutdownEndsWatches(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	stream := &testWatchStream{ctx: context.Background()}
+	done := make(chan error, 1)
+	go func() {
+		done <- s.Watch(&proto.WatchRequest{Key: "k"}, stream)
+	}()
+
+	s.endWatches()
+	select {
+	case err := <-done:
+		if status.Code(err) != codes.Unavailable {
+			t.Fatalf("expected Unavailable, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected shutdown to end the watch")
+	}
+}
+
+func TestServer_ShutdownTwice(t *testing.T) {
+	s := NewServer()
+	for i := 0; i < 2; i++ {
+		_, stop := startServing(t, s)
+		if err := stop(); err != nil {
+			t.Fatalf("expected shutdown %d to succeed, got %v", i+1, err)
+		}
+	}
+}
+
+func TestServer_ListPaginates(t *testing.T) {
+	s := NewServer()
+	defer s.Close()
+
+	ctx := context.Background()
+	for _, key := range []string{"t1/a", "t1/b", "t1/c", "t1/d", "t1/e", "t2/a"} {
+		s.Set(ctx, &proto.SetRequest{Key: key, Value: []byte("v")})
+	}
+
+	var keys []string
+	req := &proto.ListRequest{Prefix: "t1/", Limit: 2}
+	pages := 0
+	for {
+		resp, err := s.List(ctx, req)
+		if err != nil {
+			t.Fatalf("List failed: %v", err)
+		}
+		pages++
+		for _, item := range resp.Items {
+			keys = append(keys, item.Key)
+		}
+		if resp.NextPageToken == "" {
+			break
+		}
+		req.PageToken = resp.NextPageToken
+	}
+
+	if pages != 3 || len(keys) != 5 || keys[0] != "t1/a" || keys[4] != "t1/e" {
+		t.Fatalf("unexpected listing over %d pages: %v", pages, keys)
+	}
+
+	resp, err := s.List(ctx, &proto.ListRequest{Start: "t1/d", End: "t2/a"})
+	if err != nil || len(resp.Items) != 2 || resp.NextPageToken != "" {
+		t.Fatalf("unexpected range listing: %v, %v", resp, err)
+	}
+
+	if _, err := s.List(ctx, &proto.ListRequest{PageToken: "not base64!"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a bad token, got %v", err)
+	}
+}
+
+func TestServer_Txn(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	client.Set(ctx, &proto.SetRequest{Key: "balance/a", Value: []byte("100")})
+
+	transfer := &proto.TxnRequest{
+		Compare: []*proto.Compare{
+			{Key: "balance/a", Target: proto.Compare_VALUE, Value: []byte("100")},
+			{Key: "balance/b", Target: proto.Compare_EXISTS, Exists: false},
+		},
+		Success: []*proto.TxnOp{
+			{Type: proto.TxnOp_PUT, Key: "balance/a", Value: []byte("50")},
+			{Type: proto.TxnOp_PUT, Key: "balance/b", Value: []byte("50")},
+		},
+		Failure: []*proto.TxnOp{
+			{Type: proto.TxnOp_GET, Key: "balance/a"},
+		},
+	}
+	resp, err := client.Txn(ctx, transfer)
+	if err != nil {
+		t.Fatalf("Txn failed: %v", err)
+	}
+	if !resp.Succeeded || len(resp.Results) != 2 || resp.Results[1].Version == 0 {
+		t.Fatalf("expected the success branch to run, got %v", resp)
+	}
+
+	resp, err = client.Txn(ctx, transfer)
+	if err != nil {
+		t.Fatalf("Txn failed: %v", err)
+	}
+	if resp.Succeeded || len(resp.Results) != 1 || string(resp.Results[0].Value) != "50" {
+		t.Fatalf("expected the failure branch to run, got %v", resp)
+	}
+}
+
+func TestServer_BinaryValues(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	value := []byte{0x00, 0xff, 0xfe, 0x80, '\n'} // not valid UTF-8
+
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "blob", Value: value}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	resp, err := client.Get(ctx, &proto.GetRequest{Key: "blob"})
+	if err != nil {
+		t.Fatalf("Get failed: %v", err)
+	}
+	if !resp.Found || !bytes.Equal(resp.Value, value) {
+		t.Fatalf("expected binary value to round-trip, got %v", resp.Value)
+	}
+}
+
+func TestServer_TTLManagement(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "session", Value: []byte("data")}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	ttlResp, err := client.TTL(ctx, &proto.TTLRequest{Key: "session"})
+	if err != nil || !ttlResp.Found || ttlResp.Ttl != nil {
+		t.Fatalf("expected key without TTL, got %+v (err=%v)", ttlResp, err)
+	}
+
+	expResp, err := client.Expire(ctx, &proto.ExpireRequest{Key: "session", Ttl: durationpb.New(time.Hour)})
+	if err != nil || !expResp.Found {
+		t.Fatalf("Expire failed: %+v (err=%v)", expResp, err)
+	}
+	ttlResp, _ = client.TTL(ctx, &proto.TTLRequest{Key: "session"})
+	if ttl := ttlResp.Ttl.AsDuration(); ttl <= 59*time.Minute || ttl > time.Hour {
+		t.Fatalf("expected about an hour remaining, got %v", ttl)
+	}
+
+	touchResp, err := client.GetAndTouch(ctx, &proto.GetAndTouchRequest{Key: "session", Ttl: durationpb.New(time.Minute)})
+	if err != nil || !touchResp.Found || string(touchResp.Value) != "data" {
+		t.Fatalf("GetAndTouch failed: %+v (err=%v)", touchResp, err)
+	}
+	ttlResp, _ = client.TTL(ctx, &proto.TTLRequest{Key: "session"})
+	if ttl := ttlResp.Ttl.AsDuration(); ttl <= 0 || ttl > time.Minute {
+		t.Fatalf("expected touch to reset the TTL to a minute, got %v", ttl)
+	}
+
+	persistResp, err := client.Persist(ctx, &proto.PersistRequest{Key: "session"})
+	if err != nil || !persistResp.Success {
+		t.Fatalf("Persist failed: %+v (err=%v)", persistResp, err)
+	}
+	ttlResp, _ = client.TTL(ctx, &proto.TTLRequest{Key: "session"})
+	if ttlResp.Ttl != nil {
+		t.Fatalf("expected Persist to remove the TTL, got %v", ttlResp.Ttl.AsDuration())
+	}
+
+	if _, err := client.Expire(ctx, &proto.ExpireRequest{Key: "session"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for Expire without a TTL, got %v", err)
+	}
+	if _, err := client.GetAndTouch(ctx, &proto.GetAndTouchRequest{Key: "session"}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for GetAndTouch without a TTL or default, got %v", err)
+	}
+	if resp, _ := client.Expire(ctx, &proto.ExpireRequest{Key: "missing", Ttl: durationpb.New(time.Hour)}); resp.Found {
+		t.Fatalf("expected Expire on a missing key to report not found")
+	}
+}
+
+func TestServer_SubSecondTTL(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "short", Value: []byte("v"), TtlDuration: durationpb.New(200 * time.Millisecond)}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+	expireAt := timestamppb.New(time.Now().Add(300 * time.Millisecond))
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "absolute", Value: []byte("v"), ExpireAt: expireAt}); err != nil {
+		t.Fatalf("Set failed: %v", err)
+	}
+
+	ttlResp, _ := client.TTL(ctx, &proto.TTLRequest{Key: "short"})
+	if ttl := ttlResp.Ttl.AsDuration(); ttl <= 0 || ttl > 200*time.Millisecond {
+		t.Fatalf("expected a sub-second TTL, got %v", ttl)
+	}
+
+	time.Sleep(400 * time.Millisecond)
+	for _, key := range []string{"short", "absolute"} {
+		if resp, _ := client.Get(ctx, &proto.GetRequest{Key: key}); resp.Found {
+			t.Fatalf("expected %q to expire", key)
+		}
+	}
+}
+
+func TestServer_TTLDefaultsAndAbsoluteExpiry(t *testing.T) {
+	// A frozen clock makes any drift between the requested and stored expiry visible.
+	now := time.Now()
+	store := kvstore.New(kvstore.WithClock(func() time.Time { return now }))
+	defer store.Close()
+	s := NewServer(WithStorage(store), WithDefaultTTL(time.Hour))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := context.Background()
+
+	client.Set(ctx, &proto.SetRequest{Key: "default", Value: []byte("v")})
+	client.Set(ctx, &proto.SetRequest{Key: "forever", Value: []byte("v"), TtlDuration: durationpb.New(0)})
+	expireAt := timestamppb.New(now.Add(90 * time.Second))
+	client.Set(ctx, &proto.SetRequest{Key: "absolute", Value: []byte("v"), ExpireAt: expireAt})
+	client.MSet(ctx, &proto.MSetRequest{Entries: []*proto.SetRequest{{Key: "batch", Value: []byte("v"), ExpireAt: expireAt}}})
+	client.Txn(ctx, &proto.TxnRequest{Success: []*proto.TxnOp{{Type: proto.TxnOp_PUT, Key: "txn", ExpireAt: expireAt}}})
+	if resp, err := client.SetIfNotExists(ctx, &proto.SetRequest{Key: "new", Value: []byte("v"), ExpireAt: expireAt}); err != nil || !resp.Success {
+		t.Fatalf("expected SetIfNotExists to succeed, got %+v (err=%v)", resp, err)
+	}
+	if resp, _ := client.SetIfNotExists(ctx, &proto.SetRequest{Key: "new", Value: []byte("w"), ExpireAt: expireAt}); resp.Success || resp.Version == 0 {
+		t.Fatalf("expected SetIfNotExists on an existing key to fail with its version, got %+v", resp)
+	}
+	cas, _ := client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: "new", Value: []byte("w"), Version: 1, ExpireAt: expireAt})
+	if cas.Success {
+		t.Fatalf("expected CompareAndSwap with a stale version to fail")
+	}
+	cas, _ = client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: "new", Value: []byte("w"), Version: cas.Version, ExpireAt: expireAt})
+	if !cas.Success {
+		t.Fatalf("expected CompareAndSwap with the current version to succeed")
+	}
+
+	if resp, _ := client.TTL(ctx, &proto.TTLRequest{Key: "default"}); resp.Ttl.AsDuration() != time.Hour {
+		t.Fatalf("expected the default TTL, got %v", resp.Ttl.AsDuration())
+	}
+	if resp, _ := client.TTL(ctx, &proto.TTLRequest{Key: "forever"}); !resp.Found || resp.Ttl != nil {
+		t.Fatalf("expected an explicit zero ttl_duration to mean no expiry, got %v", resp.Ttl.AsDuration())
+	}
+	for _, key := range []string{"absolute", "batch", "txn", "new"} {
+		if resp, _ := client.TTL(ctx, &proto.TTLRequest{Key: key}); resp.Ttl.AsDuration() != 90*time.Second {
+			t.Fatalf("expected %q to expire exactly at expire_at, got a TTL of %v", key, resp.Ttl.AsDuration())
+		}
+	}
+}
+
+func TestServer_InvalidTTL(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	invalid := []*proto.SetRequest{
+		{Key: "k", Ttl: 1, TtlDuration: durationpb.New(time.Second)},
+		{Key: "k", TtlDuration: durationpb.New(time.Second), ExpireAt: timestamppb.Now()},
+		{Key: "k", TtlDuration: durationpb.New(-time.Second)},
+		{Key: "k", ExpireAt: timestamppb.New(time.Now().Add(-time.Second))},
+	}
+	for _, req := range invalid {
+		if _, err := client.Set(ctx, req); status.Code(err) != codes.InvalidArgument {
+			t.Fatalf("expected InvalidArgument for %v, got %v", req, err)
+		}
+	}
+	if _, err := client.MSet(ctx, &proto.MSetRequest{Entries: invalid[:1]}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument from MSet, got %v", err)
+	}
+	if _, err := client.CompareAndSwap(ctx, &proto.CompareAndSwapRequest{Key: "k", Ttl: 1, TtlDuration: durationpb.New(time.Second)}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument from CompareAndSwap, got %v", err)
+	}
+	txn := &proto.TxnRequest{Success: []*proto.TxnOp{{Type: proto.TxnOp_PUT, Key: "k", TtlDuration: durationpb.New(-time.Second)}}}
+	if _, err := client.Txn(ctx, txn); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument from Txn, got %v", err)
+	}
+	if resp, _ := client.Get(ctx, &proto.GetRequest{Key: "k"}); resp.Found {
+		t.Fatalf("expected rejected writes not to store the key")
+	}
+}
+
+func TestServer_Counters(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if resp, err := client.IncrBy(ctx, &proto.IncrByRequest{Key: "hits", Delta: 10}); err != nil || resp.Value != 10 {
+		t.Fatalf("IncrBy failed: %+v (err=%v)", resp, err)
+	}
+	if resp, err := client.DecrBy(ctx, &proto.IncrByRequest{Key: "hits", Delta: 3}); err != nil || resp.Value != 7 {
+		t.Fatalf("DecrBy failed: %+v (err=%v)", resp, err)
+	}
+	if resp, err := client.IncrByFloat(ctx, &proto.IncrByFloatRequest{Key: "hits", Delta: 0.5}); err != nil || resp.Value != 7.5 {
+		t.Fatalf("IncrByFloat failed: %+v (err=%v)", resp, err)
+	}
+	if resp, _ := client.Get(ctx, &proto.GetRequest{Key: "hits"}); string(resp.Value) != "7.5" {
+		t.Fatalf("expected the counter to read back as 7.5, got %q", resp.Value)
+	}
+
+	if _, err := client.IncrBy(ctx, &proto.IncrByRequest{Key: "hits", Delta: 1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a non-integer value, got %v", err)
+	}
+	client.Set(ctx, &proto.SetRequest{Key: "name", Value: []byte("alice")})
+	if _, err := client.IncrByFloat(ctx, &proto.IncrByFloatRequest{Key: "name", Delta: 1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a non-numeric value, got %v", err)
+	}
+	client.Set(ctx, &proto.SetRequest{Key: "max", Value: []byte("9223372036854775807")})
+	if _, err := client.IncrBy(ctx, &proto.IncrByRequest{Key: "max", Delta: 1}); status.Code(err) != codes.OutOfRange {
+		t.Fatalf("expected OutOfRange on overflow, got %v", err)
+	}
+}
+
+func TestServer_Collections(t *testing.T) {
+	client, cleanup := startTestServer(t)
+	defer cleanup()
+
+	ctx := context.Background()
+	if resp, err := client.HSet(ctx, &proto.HSetRequest{Key: "user", Fields: map[string][]byte{"name": []byte("alice"), "raw": {0x00, 0xff}}}); err != nil || resp.Count != 2 {
+		t.Fatalf("HSet failed: %+v (err=%v)", resp, err)
+	}
+	if resp, err := client.HGet(ctx, &proto.HGetRequest{Key: "user", Field: "raw"}); err != nil || !resp.Found || !bytes.Equal(resp.Value, []byte{0x00, 0xff}) {
+		t.Fatalf("HGet failed: %+v (err=%v)", resp, err)
+	}
+	client.HDel(ctx, &proto.HDelRequest{Key: "user", Fields: []string{"raw"}})
+	if resp, _ := client.HGetAll(ctx, &proto.KeyRequest{Key: "user"}); len(resp.Fields) != 1 || string(resp.Fields["name"]) != "alice" {
+		t.Fatalf("unexpected hash: %v", resp.Fields)
+	}
+
+	client.RPush(ctx, &proto.PushRequest{Key: "queue", Values: [][]byte{[]byte("b"), []byte("c")}})
+	if resp, err := client.LPush(ctx, &proto.PushRequest{Key: "queue", Values: [][]byte{[]byte("a")}}); err != nil || resp.Count != 3 {
+		t.Fatalf("LPush failed: %+v (err=%v)", resp, err)
+	}
+	if resp, _ := client.LRange(ctx, &proto.LRangeRequest{Key: "queue", Start: 1, Stop: -1}); len(resp.Values) != 2 || string(resp.Values[0]) != "b" {
+		t.Fatalf("unexpected range: %q", resp.Values)
+	}
+	if resp, _ := client.LPop(ctx, &proto.LPopRequest{Key: "queue"}); len(resp.Values) != 1 || string(resp.Values[0]) != "a" {
+		t.Fatalf("expected LPop to default to one element, got %q", resp.Values)
+	}
+	if _, err := client.LPop(ctx, &proto.LPopRequest{Key: "queue", Count: -1}); status.Code(err) != codes.InvalidArgument {
+		t.Fatalf("expected InvalidArgument for a negative count, got %v", err)
+	}
+
+	client.SAdd(ctx, &proto.MembersRequest{Key: "tags", Members: [][]byte{[]byte("go"), []byte("db")}})
+	client.SRem(ctx, &proto.MembersRequest{Key: "tags", Members: [][]byte{[]byte("db")}})
+	if resp, _ := client.SMembers(ctx, &proto.KeyRequest{Key: "tags"}); len(resp.Values) != 1 || string(resp.Values[0]) != "go" {
+		t.Fatalf("unexpected members: %q", resp.Values)
+	}
+	if resp, _ := client.Type(ctx, &proto.TypeRequest{Key: "tags"}); !resp.Found || resp.Type != proto.TypeResponse_SET {
+		t.Fatalf("expected a set, got %+v", resp)
+	}
+
+	if _, err := client.SAdd(ctx, &proto.MembersRequest{Key: "user", Members: [][]byte{[]byte("x")}}); status.Code(err) != codes.FailedPrecondition {
+		t.Fatalf("expected FailedPrecondition for SAdd on a hash, got %v", err)
+	}
+}
+
+// failedStorage is a backend whose log has failed.
+type failedStorage struct {
+	kvstore.Storage
+}
+
+func (failedStorage) Err() error {
+	return kvstore.ErrStoreFailed
+}
+
+func TestServer_FailedStorage(t *testing.T) {
+	s := NewServer(WithStorage(failedStorage{kvstore.New()}))
+	addr, stop := startServing(t, s)
+	defer stop()
+	client, _ := dialAuth(t, addr)
+	ctx := context.Background()
+
+	if _, err := client.Set(ctx, &proto.SetRequest{Key: "k", Value: []byte("v")}); status.Code(err) != codes.Internal {
+		t.Fatalf("expected Internal for a write to failed storage, got %v", err)
+	}
+	if _, err := client.Delete(ctx, &proto.DeleteRequest{Key: "k"}); status.Code(err) != codes.Internal {
+		t.Fatalf("expected Internal for a delete from failed storage, got %v", err)
+	}
+	if _, err := client.Get(ctx, &proto.GetRequest{Key: "k"}); err != nil {
+		t.Fatalf("expected reads from failed storage to succeed, got %v", err)
+	}
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// DefaultCertPollInterval is how often, at most, the certificate files are polled for changes.
+const DefaultCertPollInterval = 10 * time.Second
+
+// tlsOptions configures the transport security of Listen.
+type tlsOptions struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string // set for mutual TLS
+	minVersion   uint16
+	pollInterval time.Duration
+}
+
+// WithTLS serves over TLS using the PEM-encoded certificate and private key in certFile and keyFile.
+// The files are polled for changes and re-read when they change, so certificates can be rotated without
+// a restart; see WithCertPollInterval.
+func WithTLS(certFile, keyFile string) Option {
+	return func(s *Server) {
+		s.tls.certFile = certFile
+		s.tls.keyFile = keyFile
+	}
+}
+
+// WithClientCA enables mutual TLS: clients must present a certificate signed by one of the
+// PEM-encoded CAs in caFile. It requires WithTLS.
+func WithClientCA(caFile string) Option {
+	return func(s *Server) {
+		s.tls.clientCAFile = caFile
+	}
+}
+
+// WithMinTLSVersion sets the lowest TLS version the server accepts, such as tls.VersionTLS13.
+// The default is TLS 1.2.
+func WithMinTLSVersion(version uint16) Option {
+	return func(s *Server) {
+		s.tls.minVersion = version
+	}
+}
+
+// WithCertPollInterval sets how often, at most, the certificate, key, and client CA files are polled for
+// changes. The files are not watched: a handshake checks their sizes and modification times if the interval
+// has passed since the last check, so a change is picked up by the first handshake at least one interval
+// after the previous check. 0 disables reloading.
+func WithCertPollInterval(interval time.Duration) Option {
+	return func(s *Server) {
+		s.tls.pollInterval = interval
+	}
+}
+
+// enabled reports whether the server should serve over TLS.
+func (o tlsOptions) enabled() bool {
+	return o.certFile != "" || o.keyFile != "" || o.clientCAFile != ""
+}
+
+// credentials loads the certificates and returns gRPC transport credentials that serve them.
+func (o tlsOptions) credentials() (credentials.TransportCredentials, error) {
+	if o.certFile == "" || o.keyFile == "" {
+		return nil, errors.New("TLS requires both a certificate and a key file")
+	}
+	reloader, err := newCertReloader(o, time.Now)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(&tls.Config{
+		MinVersion:         o.minVersion,
+		GetConfigForClient: reloader.configForClient,
+	}), nil
+}
+
+// certReloader holds the TLS configuration built from the certificate files, polling them during
+// handshakes and rebuilding it when they change. A failed reload keeps the previous configuration.
+type certReloader struct {
+	opts tlsOptions
+	now  func() time.Time
+
+	mu      sync.Mutex
+	config  *tls.Config
+	stamps  []fileStamp // the files' state when config was loaded
+	checked time.Time   // when the files were last checked for changes
+}
+
+// fileStamp identifies a version of a file by its size and modification time.
+type fileStamp struct {
+	size    int64
+	modTime time.Time
+}
+
+// newCertReloader loads the certificate files, failing if any of them is missing or invalid.
+func newCertReloader(opts tlsOptions, now func() time.Time) (*certReloader, error) {
+	r := &certReloader{opts: opts, now: now}
+	stamps, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	if r.config, err = r.load(); err != nil {
+		return nil, err
+	}
+	r.stamps = stamps
+	r.checked = now()
+	return r, nil
+}
+
+// configForClient returns the configuration for a new connection, first reloading the
+// certificate files if the poll interval has passed and they have changed.
+func (r *certReloader) configForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if r.opts.pollInterval <= 0 || now.Sub(r.checked) < r.opts.pollInterval {
+		return r.config, nil
+	}
+	r.checked = now
+
+	stamps, err := r.stat()
+	if err != nil {
+		log.Printf("Failed to check TLS certificates: %v", err)
+		return r.config, nil
+	}
+	if equalStamps(stamps, r.stamps) {
+		return r.config, nil
+	}
+	config, err := r.load()
+	if err != nil {
+		// The files may be part-way through being replaced; try again after the next interval.
+		log.Printf("Failed to reload TLS certificates: %v", err)
+		return r.config, nil
+	}
+	r.config, r.stamps = config, stamps
+	log.Println("Reloaded TLS certificates")
+	return r.config, nil
+}
+
+// load reads the certificate files and builds a configuration from them.
+func (r *certReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.opts.certFile, r.opts.keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load TLS certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   r.opts.minVersion,
+		NextProtos:   []string{"h2"}, // gRPC runs over HTTP/2
+	}
+	if r.opts.clientCAFile != "" {
+		pem, err := os.ReadFile(r.opts.clientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("load client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("load client CA: no certificates found in %s", r.opts.clientCAFile)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// stat returns the current state of the certificate files.
+func (r *certReloader) stat() ([]fileStamp, error) {
+	files := []string{r.opts.certFile, r.opts.keyFile}
+	if r.opts.clientCAFile != "" {
+		files = append(files, r.opts.clientCAFile)
+	}
+	stamps := make([]fileStamp, len(files))
+	for i, file := range files {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		stamps[i] = fileStamp{size: info.Size(), modTime: info.ModTime()}
+	}
+	return stamps, nil
+}
+
+// equalStamps reports whether none of the files have changed.
+func equalStamps(a, b []fileStamp) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].size != b[i].size || !a[i].modTime.Equal(b[i].modTime) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,307 @@
+package server
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ahmad-masud/KVStore/proto"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+)
+
+// testCA is a certificate authority that issues certificates for tests.
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	pem  []byte
+}
+
+var testSerial int64
+
+func newTestCA(t *testing.T) *testCA {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate CA key: %v", err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(testSerial),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	return &testCA{cert: cert, key: key, pem: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})}
+}
+
+// issue returns a PEM-encoded certificate and key for a server on localhost or for a client named name.
+func (ca *testCA) issue(t *testing.T, name string, usage x509.ExtKeyUsage) (certPEM, keyPEM []byte, serial int64) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	testSerial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(testSerial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatalf("failed to create certificate: %v", err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %v", err)
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+		testSerial
+}
+
+// writeFile writes data to name in dir and returns its path.
+func writeFile(t *testing.T, dir, name string, data []byte) string {
+	t.Helper()
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// startServing serves s on a local port, as Listen does, and returns its address and a function that
+// stops it.
+func startServing(t *testing.T, s *Server) (string, func() error) {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- s.serve(ctx, lis)
+	}()
+	return lis.Addr().String(), func() error {
+		cancel()
+		return <-done
+	}
+}
+
+// tryGet makes a Get call over a fresh connection with the given client TLS configuration,
+// or without TLS if config is nil.
+func tryGet(t *testing.T, addr string, config *tls.Config) error {
+	t.Helper()
+	creds := insecure.NewCredentials()
+	if config != nil {
+		creds = credentials.NewTLS(config)
+	}
+	conn, err := grpc.NewClient(addr, grpc.WithTransportCredentials(creds))
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err = proto.NewKVStoreClient(conn).Get(ctx, &proto.GetRequest{Key: "foo"})
+	return err
+}
+
+func TestServer_TLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	s := NewServer(WithTLS(writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)))
+	addr, stop := startServing(t, s)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots}); err != nil {
+		t.Fatalf("expected a TLS client to succeed, got %v", err)
+	}
+	if err := tryGet(t, addr, nil); err == nil {
+		t.Fatalf("expected a plaintext client to be rejected")
+	}
+	if err := tryGet(t, addr, &tls.Config{RootCAs: x509.NewCertPool()}); err == nil {
+		t.Fatalf("expected a client that does not trust the server's CA to fail")
+	}
+}
+
+func TestServer_MutualTLS(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	s := NewServer(
+		WithTLS(writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)),
+		WithClientCA(writeFile(t, dir, "ca.pem", ca.pem)),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots}); err == nil {
+		t.Fatalf("expected a client without a certificate to be rejected")
+	}
+
+	clientPEM, clientKey, _ := ca.issue(t, "client", x509.ExtKeyUsageClientAuth)
+	clientCert, err := tls.X509KeyPair(clientPEM, clientKey)
+	if err != nil {
+		t.Fatalf("failed to load client certificate: %v", err)
+	}
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{clientCert}}); err != nil {
+		t.Fatalf("expected a client with a trusted certificate to succeed, got %v", err)
+	}
+
+	otherPEM, otherKey, _ := newTestCA(t).issue(t, "intruder", x509.ExtKeyUsageClientAuth)
+	otherCert, _ := tls.X509KeyPair(otherPEM, otherKey)
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots, Certificates: []tls.Certificate{otherCert}}); err == nil {
+		t.Fatalf("expected a client certificate from another CA to be rejected")
+	}
+}
+
+func TestServer_MinTLSVersion(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	s := NewServer(
+		WithTLS(writeFile(t, dir, "server.pem", certPEM), writeFile(t, dir, "server.key", keyPEM)),
+		WithMinTLSVersion(tls.VersionTLS13),
+	)
+	addr, stop := startServing(t, s)
+	defer stop()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots, MaxVersion: tls.VersionTLS12}); err == nil {
+		t.Fatalf("expected a TLS 1.2 client to be rejected")
+	}
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots}); err != nil {
+		t.Fatalf("expected a TLS 1.3 client to succeed, got %v", err)
+	}
+}
+
+func TestServer_TLSInvalidCertificate(t *testing.T) {
+	dir := t.TempDir()
+	s := NewServer(WithTLS(writeFile(t, dir, "server.pem", []byte("not a certificate")), filepath.Join(dir, "missing.key")))
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	if err := s.serve(context.Background(), lis); err == nil {
+		t.Fatalf("expected serve to fail with an invalid certificate")
+	}
+
+	if err := NewServer(WithClientCA("ca.pem")).serve(context.Background(), lis); err == nil {
+		t.Fatalf("expected serve to fail with a client CA but no certificate")
+	}
+}
+
+func TestCertReloader_ReloadsChangedFiles(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, serial := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "server.pem", certPEM)
+	keyFile := writeFile(t, dir, "server.key", keyPEM)
+
+	now := time.Now()
+	clock := func() time.Time { return now }
+	reloader, err := newCertReloader(tlsOptions{certFile: certFile, keyFile: keyFile, pollInterval: time.Minute}, clock)
+	if err != nil {
+		t.Fatalf("failed to load certificates: %v", err)
+	}
+	servedSerial := func() int64 {
+		t.Helper()
+		config, err := reloader.configForClient(nil)
+		if err != nil {
+			t.Fatalf("configForClient failed: %v", err)
+		}
+		leaf, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+		if err != nil {
+			t.Fatalf("failed to parse served certificate: %v", err)
+		}
+		return leaf.SerialNumber.Int64()
+	}
+
+	// Rotate the certificate, moving the modification time forward so the change is visible
+	// even on file systems with coarse timestamps.
+	newCertPEM, newKeyPEM, newSerial := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "server.pem", newCertPEM)
+	writeFile(t, dir, "server.key", newKeyPEM)
+	later := now.Add(time.Hour)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	if got := servedSerial(); got != serial {
+		t.Fatalf("expected the old certificate until the reload interval passes, got serial %d", got)
+	}
+	now = now.Add(time.Minute)
+	if got := servedSerial(); got != newSerial {
+		t.Fatalf("expected the rotated certificate %d, got serial %d", newSerial, got)
+	}
+
+	// A broken file keeps the last good certificate.
+	writeFile(t, dir, "server.pem", []byte("half-written"))
+	os.Chtimes(certFile, later.Add(time.Hour), later.Add(time.Hour))
+	now = now.Add(time.Minute)
+	if got := servedSerial(); got != newSerial {
+		t.Fatalf("expected a failed reload to keep certificate %d, got serial %d", newSerial, got)
+	}
+}
+
+func TestServer_TLSReloadOverTheWire(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t)
+	certPEM, keyPEM, _ := ca.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	certFile := writeFile(t, dir, "server.pem", certPEM)
+	keyFile := writeFile(t, dir, "server.key", keyPEM)
+	s := NewServer(WithTLS(certFile, keyFile), WithCertPollInterval(time.Nanosecond))
+	addr, stop := startServing(t, s)
+	defer stop()
+
+	// Replace the certificate with one from a new CA; clients that only trust the new CA
+	// can connect once the server picks it up.
+	newCA := newTestCA(t)
+	newCertPEM, newKeyPEM, _ := newCA.issue(t, "server", x509.ExtKeyUsageServerAuth)
+	writeFile(t, dir, "server.pem", newCertPEM)
+	writeFile(t, dir, "server.key", newKeyPEM)
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(certFile, later, later)
+	os.Chtimes(keyFile, later, later)
+
+	roots := x509.NewCertPool()
+	roots.AddCert(newCA.cert)
+	if err := tryGet(t, addr, &tls.Config{RootCAs: roots}); err != nil {
+		t.Fatalf("expected the rotated certificate to be served without a restart, got %v", err)
+	}
+}